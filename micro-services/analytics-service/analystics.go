@@ -21,7 +21,7 @@ import (
 
 type Event struct {
 	EventID       string    `json:"event_id"`
-	UserID        string    `json:"user_id" validate:"required"`
+	UserID        string    `json:"user_id" validate:"required_without=SessionID"`
 	SessionID     string    `json:"session_id"`
 	EventType     string    `json:"event_type" validate:"required,eventtype"`
 	EventSubtype  string    `json:"event_subtype"`
@@ -159,10 +159,15 @@ func isValidEvent(event Event) bool {
 		"system_metric": true,
 	}
 
-	return event.UserID != "" &&
+	// Guests have no user id, only the session they are tracked by
+	return (event.UserID != "" || event.SessionID != "") &&
 		validTypes[event.EventType] &&
-		!strings.ContainsAny(event.UserID, "<>{}'\"") &&
-		len(event.UserID) < 256
+		isValidIdentifier(event.UserID) &&
+		isValidIdentifier(event.SessionID)
+}
+
+func isValidIdentifier(id string) bool {
+	return !strings.ContainsAny(id, "<>{}'\"") && len(id) < 256
 }
 
 func addToBatch(event Event) error {
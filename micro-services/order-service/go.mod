@@ -6,6 +6,9 @@ require (
 	github.com/aws/aws-sdk-go v1.55.6
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
+	mallhive/shared v0.0.0
 )
 
 require github.com/jmespath/go-jmespath v0.4.0 // indirect
+
+replace mallhive/shared => ../shared
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed migrations/*.sql
+var embeddedMigrations embed.FS
+
+// migrationFiles are the schema migrations shipped in the binary, applied
+// by the shared migrate package.
+var migrationFiles, _ = fs.Sub(embeddedMigrations, "migrations")
@@ -0,0 +1,11 @@
+-- Orders as first shipped in schema.sql. The table is created only when
+-- missing, so a database bootstrapped from that script takes this as
+-- applied and picks up every later column from the migrations after it.
+CREATE TABLE IF NOT EXISTS orders (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    product_ids INT[] NOT NULL,
+    total NUMERIC(10,2) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
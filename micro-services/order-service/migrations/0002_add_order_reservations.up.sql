@@ -0,0 +1,2 @@
+-- Stock reservation the product service holds for the order until payment
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS reservation_id INT;
@@ -0,0 +1,3 @@
+-- SKU of each line, 0 for products without variants, aligned with
+-- product_ids
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS sku_ids INT[] NOT NULL DEFAULT '{}';
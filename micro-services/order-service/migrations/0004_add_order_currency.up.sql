@@ -0,0 +1,2 @@
+-- Currency the order was charged in; earlier orders were all in USD
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'USD';
@@ -0,0 +1,5 @@
+-- Status changes stamp updated_at; orders that predate the column start
+-- out last updated when they were created.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP;
+UPDATE orders SET updated_at = created_at WHERE updated_at IS NULL;
+ALTER TABLE orders ALTER COLUMN updated_at SET NOT NULL;
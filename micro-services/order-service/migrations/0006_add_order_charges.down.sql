@@ -0,0 +1,5 @@
+ALTER TABLE orders
+    DROP COLUMN IF EXISTS subtotal,
+    DROP COLUMN IF EXISTS discount,
+    DROP COLUMN IF EXISTS tax,
+    DROP COLUMN IF EXISTS shipping;
@@ -0,0 +1,9 @@
+-- Break the charged total down the way the cart priced it. Earlier orders
+-- were charged their lines only, so their subtotal is their total.
+ALTER TABLE orders
+    ADD COLUMN IF NOT EXISTS subtotal NUMERIC(10,2),
+    ADD COLUMN IF NOT EXISTS discount NUMERIC(10,2) NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS tax NUMERIC(10,2) NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS shipping NUMERIC(10,2) NOT NULL DEFAULT 0;
+UPDATE orders SET subtotal = total WHERE subtotal IS NULL;
+ALTER TABLE orders ALTER COLUMN subtotal SET NOT NULL;
@@ -0,0 +1,2 @@
+-- Coupon codes whose discounts the order was charged with
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS coupon_codes TEXT[] NOT NULL DEFAULT '{}';
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -19,22 +20,50 @@ import (
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/joho/godotenv"
 	"github.com/lib/pq"
+	"mallhive/shared/migrate"
+	"mallhive/shared/money"
 )
 
 type Order struct {
-	ID         int       `json:"id"`
-	UserID     int       `json:"user_id"`
-	ProductIDs []int64   `json:"product_ids"`
-	Total      float64   `json:"total"`
-	Status     string    `json:"status"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at,omitempty"`
+	ID            int         `json:"id"`
+	UserID        int         `json:"user_id"`
+	ProductIDs    []int64     `json:"product_ids"`
+	SKUIDs        []int64     `json:"sku_ids,omitempty"` // parallel to ProductIDs, 0 when no SKU
+	Subtotal      money.Money `json:"subtotal"`
+	Discount      money.Money `json:"discount"`
+	CouponCodes   []string    `json:"coupon_codes,omitempty"` // the coupons the discount came from
+	Tax           money.Money `json:"tax"`
+	Shipping      money.Money `json:"shipping"`
+	Total         money.Money `json:"total"` // subtotal - discount + tax + shipping, the amount charged
+	Status        string      `json:"status"`
+	ReservationID int         `json:"reservation_id,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at,omitempty"`
 }
 
+// CartItem is a cart line as the cart service serves it, which renders
+// product ids as strings.
 type CartItem struct {
-	ProductID int64   `json:"product_id"`
-	Price     float64 `json:"price"`
-	Quantity  int     `json:"quantity"`
+	ProductID int64       `json:"product_id,string"`
+	SKUID     int64       `json:"sku_id,omitempty"`
+	Price     money.Money `json:"price"`
+	Quantity  int         `json:"quantity"`
+}
+
+// Cart is the part of a cart service read an order is built from. Every
+// item and amount is priced in Currency.
+type Cart struct {
+	Currency string      `json:"currency"`
+	Items    []CartItem  `json:"items"`
+	Subtotal money.Money `json:"subtotal"`
+	Coupons  []struct {
+		Code   string `json:"code"`
+		Reason string `json:"reason"` // set when the coupon no longer applies
+	} `json:"coupons"`
+	Discount money.Money `json:"discount"`
+	Tax      money.Money `json:"tax"`
+	Shipping money.Money `json:"shipping"`
+	Total    money.Money `json:"total"`
 }
 
 type PaymentCallback struct {
@@ -49,6 +78,12 @@ const (
 	StatusPaid     = "paid"
 	StatusFailed   = "payment_failed"
 	StatusComplete = "completed"
+	StatusNoStock  = "out_of_stock"
+
+	// Paid, but product-service would not take the stock, e.g. because the
+	// reservation expired and the units were sold again. Needs a person to
+	// restock or refund.
+	StatusUnsettled = "paid_unsettled"
 )
 
 var (
@@ -57,7 +92,8 @@ var (
 	eventBridgeClient *eventbridge.EventBridge
 )
 
-func init() {
+// initServices loads the environment and connects to the database and AWS.
+func initServices() {
 	err := godotenv.Load()
 	if err != nil {
 		log.Println("Error loading .env file:", err)
@@ -88,6 +124,25 @@ func init() {
 }
 
 func main() {
+	initServices()
+
+	// Schema migrations run on their own instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Run(db, migrationFiles, os.Args[2:]); err != nil {
+			log.Fatal("Migration failed:", err)
+		}
+		return
+	}
+	if migrate.OnStart() {
+		applied, err := migrate.Up(db, migrationFiles)
+		if err != nil {
+			log.Fatal("Migration failed:", err)
+		}
+		for _, m := range applied {
+			log.Printf("Applied migration %04d_%s\n", m.Version, m.Name)
+		}
+	}
+
 	http.HandleFunc("/orders/", ordersHandler)
 	http.HandleFunc("/orders/callback", paymentCallbackHandler)
 	log.Println("Order service running on :8080")
@@ -122,20 +177,24 @@ func handleCreateOrder(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Fetch and validate cart
-	cartItems, err := fetchCartItems(order.UserID)
+	cart, err := fetchCart(order.UserID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Validate products
+	cartItems := cart.Items
 	if err := validateProducts(cartItems); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	// Calculate order details
-	order.ProductIDs, order.Total = calculateOrderDetails(cartItems)
+	if err := calculateOrderDetails(cart, &order); err != nil {
+		http.Error(w, "Invalid cart prices: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 	order.Status = StatusPending
 
 	// Save to database
@@ -144,10 +203,25 @@ func handleCreateOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Hold stock until payment settles
+	order.ReservationID, err = reserveStock(order.ID, cartItems)
+	if err != nil {
+		log.Printf("Stock reservation failed for order %d: %v", order.ID, err)
+		if err := updateOrderStatus(order.ID, StatusNoStock); err != nil {
+			log.Printf("Failed to update order status: %v", err)
+		}
+		http.Error(w, "Insufficient stock", http.StatusConflict)
+		return
+	}
+	if _, err := db.Exec(`UPDATE orders SET reservation_id = $1 WHERE id = $2`, order.ReservationID, order.ID); err != nil {
+		log.Printf("Failed to record reservation for order %d: %v", order.ID, err)
+	}
+
 	// Async integrations
 	go processPostOrderActions(order)
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(order)
 }
 
@@ -158,16 +232,7 @@ func handleGetOrder(w http.ResponseWriter, r *http.Request, orderID string) {
 		return
 	}
 
-	var order Order
-	var productIDs []int64
-
-	query := `SELECT id, user_id, product_ids, total, status, created_at, updated_at 
-			  FROM orders WHERE id = $1`
-
-	row := db.QueryRow(query, id)
-	err = row.Scan(&order.ID, &order.UserID, pq.Array(&productIDs),
-		&order.Total, &order.Status, &order.CreatedAt, &order.UpdatedAt)
-
+	order, err := scanOrder(db.QueryRow(orderSelect+" WHERE id = $1", id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Order not found", http.StatusNotFound)
@@ -177,7 +242,6 @@ func handleGetOrder(w http.ResponseWriter, r *http.Request, orderID string) {
 		return
 	}
 
-	order.ProductIDs = productIDs
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(order)
 }
@@ -214,6 +278,18 @@ func paymentCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Take the held stock on success, hand it back on failure
+	switch newStatus {
+	case StatusPaid:
+		go commitReservation(callback.OrderID)
+	case StatusFailed:
+		go func() {
+			if err := settleReservation(callback.OrderID, "release"); err != nil {
+				log.Printf("Failed to release stock for order %d: %v", callback.OrderID, err)
+			}
+		}()
+	}
+
 	// Send notification about order status update
 	go sendOrderStatusUpdate(callback.OrderID, newStatus)
 
@@ -230,10 +306,14 @@ func updateOrderStatus(orderID int, status string) error {
 func sendOrderStatusUpdate(orderID int, status string) {
 	var order Order
 	var productIDs []int64
+	var currency, total string
 
-	query := `SELECT id, user_id, product_ids, total, status FROM orders WHERE id = $1`
+	query := `SELECT id, user_id, product_ids, currency, total::text, status FROM orders WHERE id = $1`
 	err := db.QueryRow(query, orderID).Scan(&order.ID, &order.UserID,
-		pq.Array(&productIDs), &order.Total, &order.Status)
+		pq.Array(&productIDs), &currency, &total, &order.Status)
+	if err == nil {
+		order.Total, err = money.Parse(total, currency)
+	}
 	if err != nil {
 		log.Printf("Error fetching order for notification: %v", err)
 		return
@@ -279,63 +359,250 @@ func sendStatusUpdateToEventBridge(order Order, status string) {
 	}
 }
 
-func fetchCartItems(userID int) ([]CartItem, error) {
+func fetchCart(userID int) (Cart, error) {
+	var cart Cart
 	cartServiceURL := os.Getenv("CART_SERVICE_URL")
 	resp, err := http.Get(fmt.Sprintf("%s/%d", cartServiceURL, userID))
 	if err != nil || resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch cart data")
+		return cart, fmt.Errorf("failed to fetch cart data")
 	}
 	defer resp.Body.Close()
 
-	var cartItems []CartItem
-	if err := json.NewDecoder(resp.Body).Decode(&cartItems); err != nil {
-		return nil, fmt.Errorf("failed to parse cart data")
+	if err := json.NewDecoder(resp.Body).Decode(&cart); err != nil {
+		return cart, fmt.Errorf("failed to parse cart data")
+	}
+	if !money.ValidCurrency(cart.Currency) {
+		return cart, fmt.Errorf("cart has no valid currency")
 	}
 
-	if len(cartItems) == 0 {
-		return nil, fmt.Errorf("cart is empty")
+	if len(cart.Items) == 0 {
+		return cart, fmt.Errorf("cart is empty")
 	}
 
-	return cartItems, nil
+	return cart, nil
 }
 
+// validateProducts checks every line's product, or SKU, is still on sale:
+// active, and available to buy.
 func validateProducts(cartItems []CartItem) error {
 	productServiceURL := os.Getenv("PRODUCT_SERVICE_URL")
 
 	for _, item := range cartItems {
-		resp, err := http.Get(fmt.Sprintf("%s/%d", productServiceURL, item.ProductID))
-		if err != nil || resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("invalid product ID: %d", item.ProductID)
+		url := fmt.Sprintf("%s/%d", productServiceURL, item.ProductID)
+		what := fmt.Sprintf("product ID: %d", item.ProductID)
+		if item.SKUID != 0 {
+			url = fmt.Sprintf("%s/skus/%d", url, item.SKUID)
+			what = fmt.Sprintf("SKU ID: %d", item.SKUID)
+		}
+		resp, err := http.Get(url)
+		if err != nil {
+			return fmt.Errorf("invalid %s", what)
+		}
+		var product struct {
+			Status    string `json:"status"`
+			Available bool   `json:"available"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&product)
 		}
 		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("invalid %s", what)
+		}
+		if product.Status != "active" || !product.Available {
+			return fmt.Errorf("%s is no longer available", what)
+		}
 	}
 	return nil
 }
 
-func calculateOrderDetails(cartItems []CartItem) ([]int64, float64) {
-	var total float64
-	var productIDs []int64
+// reserveStock asks product-service to hold the cart quantities for the order
+// and returns the reservation id.
+func reserveStock(orderID int, cartItems []CartItem) (int, error) {
+	reservationURL := os.Getenv("PRODUCT_RESERVATIONS_URL")
 
+	items := make([]map[string]interface{}, 0, len(cartItems))
 	for _, item := range cartItems {
-		total += item.Price * float64(item.Quantity)
-		productIDs = append(productIDs, item.ProductID)
+		items = append(items, map[string]interface{}{
+			"product_id": item.ProductID,
+			"sku_id":     item.SKUID,
+			"quantity":   item.Quantity,
+		})
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"order_id": orderID,
+		"items":    items,
+	})
+
+	resp, err := postReservation(reservationURL, body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return 0, fmt.Errorf("reservation rejected with status %d", resp.StatusCode)
+	}
+
+	var reservation struct {
+		ID int `json:"id"`
 	}
-	return productIDs, total
+	if err := json.NewDecoder(resp.Body).Decode(&reservation); err != nil {
+		return 0, fmt.Errorf("failed to parse reservation")
+	}
+	return reservation.ID, nil
+}
+
+// postReservation posts to product-service's reservation endpoints, which
+// only accept PRODUCT_SERVICE_TOKEN, a token carrying the service role.
+func postReservation(url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("PRODUCT_SERVICE_TOKEN"))
+	return http.DefaultClient.Do(req)
+}
+
+// commitReservation takes the stock held for a paid order. When that fails,
+// most likely because the reservation expired before payment and the stock
+// went to someone else, the order is flagged paid_unsettled for manual
+// handling rather than left looking fulfilled.
+func commitReservation(orderID int) {
+	err := settleReservation(orderID, "commit")
+	if err == nil {
+		return
+	}
+	log.Printf("Failed to commit stock for paid order %d, flagging it %s: %v", orderID, StatusUnsettled, err)
+	if err := updateOrderStatus(orderID, StatusUnsettled); err != nil {
+		log.Printf("Failed to update order status: %v", err)
+		return
+	}
+	sendOrderStatusUpdate(orderID, StatusUnsettled)
+}
+
+// settleReservation commits or releases the stock held for an order.
+func settleReservation(orderID int, action string) error {
+	var reservationID sql.NullInt64
+	err := db.QueryRow(`SELECT reservation_id FROM orders WHERE id = $1`, orderID).Scan(&reservationID)
+	if err != nil {
+		return err
+	}
+	if !reservationID.Valid {
+		return fmt.Errorf("order has no reservation to %s", action)
+	}
+
+	reservationURL := os.Getenv("PRODUCT_RESERVATIONS_URL")
+	resp, err := postReservation(fmt.Sprintf("%s/%d/%s", reservationURL, reservationID.Int64, action), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("reservation %s returned status %d: %s", action, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// calculateOrderDetails collects the ordered ids and charges the cart's
+// total. The lines are summed exactly in the cart's currency and must add
+// up to its subtotal, and the total must follow from the subtotal,
+// discount, tax and shipping, so the order charges what the shopper saw.
+func calculateOrderDetails(cart Cart, order *Order) error {
+	subtotal := money.Money{Currency: cart.Currency}
+	order.ProductIDs, order.SKUIDs = nil, nil
+
+	for _, item := range cart.Items {
+		line, err := item.Price.Mul(item.Quantity)
+		if err == nil {
+			subtotal, err = subtotal.Add(line)
+		}
+		if err != nil {
+			return err
+		}
+		order.ProductIDs = append(order.ProductIDs, item.ProductID)
+		order.SKUIDs = append(order.SKUIDs, item.SKUID)
+	}
+	if cart.Subtotal.In(cart.Currency) != subtotal {
+		return fmt.Errorf("cart subtotal %s does not match its lines (%s)", cart.Subtotal, subtotal)
+	}
+
+	order.Subtotal = subtotal
+	order.Discount = cart.Discount.In(cart.Currency)
+	order.CouponCodes = nil
+	for _, c := range cart.Coupons {
+		if c.Reason == "" {
+			order.CouponCodes = append(order.CouponCodes, c.Code)
+		}
+	}
+	order.Tax = cart.Tax.In(cart.Currency)
+	order.Shipping = cart.Shipping.In(cart.Currency)
+	total, err := subtotal.Sub(order.Discount)
+	if err == nil {
+		total, err = total.Add(order.Tax)
+	}
+	if err == nil {
+		total, err = total.Add(order.Shipping)
+	}
+	if err != nil {
+		return err
+	}
+	if cart.Total.In(cart.Currency) != total {
+		return fmt.Errorf("cart total %s does not match its breakdown (%s)", cart.Total, total)
+	}
+	order.Total = total
+	return nil
 }
 
 func saveOrderToDB(order *Order) error {
-	query := `INSERT INTO orders (user_id, product_ids, total, status, created_at, updated_at)
-	          VALUES ($1, $2, $3, $4, $5, $5) RETURNING id, created_at`
+	query := `INSERT INTO orders (user_id, product_ids, sku_ids, currency, subtotal, discount, coupon_codes, tax, shipping, total, status, created_at, updated_at)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $12) RETURNING id, created_at`
 	return db.QueryRow(
 		query,
 		order.UserID,
 		pq.Array(order.ProductIDs),
+		pq.Array(order.SKUIDs),
+		order.Total.Currency,
+		order.Subtotal,
+		order.Discount,
+		pq.Array(order.CouponCodes),
+		order.Tax,
+		order.Shipping,
 		order.Total,
 		order.Status,
 		time.Now(),
 	).Scan(&order.ID, &order.CreatedAt)
 }
 
+// orderSelect reads the columns scanOrder expects. Amounts are read as
+// text and parsed in the order's currency.
+const orderSelect = `SELECT id, user_id, product_ids, COALESCE(sku_ids, '{}'), currency,
+	subtotal::text, discount::text, coupon_codes, tax::text, shipping::text, total::text,
+	status, created_at, updated_at FROM orders`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOrder(row rowScanner) (Order, error) {
+	var order Order
+	var currency string
+	amounts := make([]string, 5)
+	err := row.Scan(&order.ID, &order.UserID, pq.Array(&order.ProductIDs), pq.Array(&order.SKUIDs), &currency,
+		&amounts[0], &amounts[1], pq.Array(&order.CouponCodes), &amounts[2], &amounts[3], &amounts[4],
+		&order.Status, &order.CreatedAt, &order.UpdatedAt)
+	if err != nil {
+		return order, err
+	}
+	for i, m := range []*money.Money{&order.Subtotal, &order.Discount, &order.Tax, &order.Shipping, &order.Total} {
+		if *m, err = money.Parse(amounts[i], currency); err != nil {
+			return order, err
+		}
+	}
+	return order, nil
+}
+
 func processPostOrderActions(order Order) {
 	sendToPaymentService(order)
 	sendToNotificationService(order)
@@ -353,7 +620,8 @@ func sendToPaymentService(order Order) {
 
 	body, _ := json.Marshal(map[string]interface{}{
 		"order_id":     order.ID,
-		"amount":       order.Total,
+		"amount":       order.Total.Decimal(), // exact decimal string
+		"currency":     order.Total.Currency,
 		"user_id":      order.UserID,
 		"callback_url": callbackURL,
 	})
@@ -413,8 +681,38 @@ func sendToEventBridge(order Order) {
 	}
 }
 
-func handleListOrders(w http.ResponseWriter, _ *http.Request) {
-	rows, err := db.Query("SELECT id, user_id, product_ids, total, status, created_at, updated_at FROM orders ORDER BY created_at DESC")
+// handleListOrders lists orders newest first, optionally narrowed by
+// ?user_id=, ?product_id= and a comma-separated ?status=.
+func handleListOrders(w http.ResponseWriter, r *http.Request) {
+	var where []string
+	var args []interface{}
+	for _, param := range []string{"user_id", "product_id"} {
+		s := r.URL.Query().Get(param)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "Invalid "+param, http.StatusBadRequest)
+			return
+		}
+		args = append(args, n)
+		if param == "user_id" {
+			where = append(where, fmt.Sprintf("user_id = $%d", len(args)))
+		} else {
+			where = append(where, fmt.Sprintf("$%d = ANY(product_ids)", len(args)))
+		}
+	}
+	if s := r.URL.Query().Get("status"); s != "" {
+		args = append(args, pq.Array(strings.Split(s, ",")))
+		where = append(where, fmt.Sprintf("status = ANY($%d)", len(args)))
+	}
+	query := orderSelect
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	rows, err := db.Query(query+" ORDER BY created_at DESC", args...)
 	if err != nil {
 		http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
 		return
@@ -423,13 +721,11 @@ func handleListOrders(w http.ResponseWriter, _ *http.Request) {
 
 	var orders []Order
 	for rows.Next() {
-		var order Order
-		var productIDs []int64
-		if err := rows.Scan(&order.ID, &order.UserID, pq.Array(&productIDs), &order.Total, &order.Status, &order.CreatedAt, &order.UpdatedAt); err != nil {
+		order, err := scanOrder(rows)
+		if err != nil {
 			log.Println("Scan error:", err)
 			continue
 		}
-		order.ProductIDs = productIDs
 		orders = append(orders, order)
 	}
 
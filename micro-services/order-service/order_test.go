@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"mallhive/shared/money"
+)
+
+// cartFixture is what shoppingcart-service's getCart serves for a cart at
+// checkout, kept in step with the handler by that service's tests.
+const cartFixture = "../shoppingcart-service/testdata/checkout_cart.json"
+
+func TestFetchCart(t *testing.T) {
+	body, err := os.ReadFile(cartFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/42" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(body)
+	}))
+	defer carts.Close()
+	t.Setenv("CART_SERVICE_URL", carts.URL)
+
+	cart, err := fetchCart(42)
+	if err != nil {
+		t.Fatalf("fetchCart: %v", err)
+	}
+	order := Order{UserID: 42}
+	if err := calculateOrderDetails(cart, &order); err != nil {
+		t.Fatalf("calculateOrderDetails: %v", err)
+	}
+
+	eur := func(cents int64) money.Money { return money.Money{Amount: cents, Currency: "EUR"} }
+	if !reflect.DeepEqual(order.ProductIDs, []int64{7}) || !reflect.DeepEqual(order.SKUIDs, []int64{3}) {
+		t.Errorf("ordered products %v skus %v, want [7] and [3]", order.ProductIDs, order.SKUIDs)
+	}
+	if cart.Items[0].Quantity != 2 {
+		t.Errorf("quantity %d, want 2", cart.Items[0].Quantity)
+	}
+	if !reflect.DeepEqual(order.CouponCodes, []string{"TENOFF"}) {
+		t.Errorf("coupons %v, want [TENOFF]", order.CouponCodes)
+	}
+	if order.Subtotal != eur(2500) || order.Discount != eur(250) || order.Tax != eur(428) ||
+		order.Shipping != eur(499) || order.Total != eur(3177) {
+		t.Errorf("order priced %v - %v + %v + %v = %v, want 25.00 - 2.50 + 4.28 + 4.99 = 31.77 EUR",
+			order.Subtotal, order.Discount, order.Tax, order.Shipping, order.Total)
+	}
+}
+
+func TestValidateProducts(t *testing.T) {
+	products := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1", "/2/skus/5":
+			w.Write([]byte(`{"status": "active", "available": true}`))
+		case "/3":
+			w.Write([]byte(`{"status": "archived", "available": false}`))
+		case "/4":
+			w.Write([]byte(`{"status": "active", "available": false}`))
+		case "/2/skus/6":
+			w.Write([]byte(`{"status": "active", "available": false}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer products.Close()
+	t.Setenv("PRODUCT_SERVICE_URL", products.URL)
+
+	tests := []struct {
+		name  string
+		items []CartItem
+		ok    bool
+	}{
+		{"on sale", []CartItem{{ProductID: 1}, {ProductID: 2, SKUID: 5}}, true},
+		{"archived", []CartItem{{ProductID: 1}, {ProductID: 3}}, false},
+		{"unavailable", []CartItem{{ProductID: 4}}, false},
+		{"unavailable sku", []CartItem{{ProductID: 2, SKUID: 6}}, false},
+		{"not found", []CartItem{{ProductID: 9}}, false},
+	}
+	for _, tt := range tests {
+		if err := validateProducts(tt.items); (err == nil) != tt.ok {
+			t.Errorf("%s: validateProducts = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Attribute types. Text and enum values are filtered and faceted as
+// keywords, numbers by range.
+const (
+	AttributeText    = "text"
+	AttributeEnum    = "enum"
+	AttributeNumber  = "number"
+	AttributeBoolean = "boolean"
+)
+
+// facetValueLimit caps the values listed for one keyword facet.
+const facetValueLimit = 50
+
+// AttributeDef is one entry of a category's attribute schema, e.g. brand
+// (text), screen_size (number, in inches) or material (enum).
+type AttributeDef struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required"`
+	Choices  []string `json:"choices,omitempty"` // enum only
+	Unit     string   `json:"unit,omitempty"`
+}
+
+// Facet summarises one attribute over the products matching a listing
+// query: value counts for keywords and booleans, the range for numbers.
+type Facet struct {
+	Name   string       `json:"name"`
+	Type   string       `json:"type"`
+	Unit   string       `json:"unit,omitempty"`
+	Values []FacetValue `json:"values,omitempty"`
+	Min    *float64     `json:"min,omitempty"`
+	Max    *float64     `json:"max,omitempty"`
+}
+
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+var (
+	errAttributes            = errors.New("invalid attributes")
+	errAttributeTypeConflict = errors.New("attribute already defined with another type")
+)
+
+// attributeFilterPrefix marks listing parameters such as attr.brand=Apple,
+// attr.screen_size.min=6 and attr.screen_size.max=7.
+const attributeFilterPrefix = "attr."
+
+// validAttributeName keeps names usable as query parameters and search
+// field names: lowercase letters, digits and underscores.
+func validAttributeName(name string) bool {
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func validateAttributeSchema(defs []AttributeDef) error {
+	seen := map[string]bool{}
+	for i := range defs {
+		d := &defs[i]
+		d.Name = strings.ToLower(strings.TrimSpace(d.Name))
+		if !validAttributeName(d.Name) || seen[d.Name] {
+			return fmt.Errorf("attribute names must be unique and use a-z, 0-9 and _: %q", d.Name)
+		}
+		seen[d.Name] = true
+
+		switch d.Type {
+		case AttributeEnum:
+			if len(d.Choices) == 0 {
+				return fmt.Errorf("enum attribute %s needs choices", d.Name)
+			}
+		case AttributeText, AttributeNumber, AttributeBoolean:
+			if len(d.Choices) > 0 {
+				return fmt.Errorf("choices only apply to enum attributes: %s", d.Name)
+			}
+		default:
+			return fmt.Errorf("attribute %s: type must be text, enum, number or boolean", d.Name)
+		}
+		if d.Choices == nil {
+			d.Choices = []string{}
+		}
+	}
+	return nil
+}
+
+// normalizeAttributes checks values against defs and returns them in their
+// stored form. Null and blank values count as absent.
+func normalizeAttributes(defs []AttributeDef, values map[string]any) (map[string]any, error) {
+	byName := make(map[string]AttributeDef, len(defs))
+	for _, d := range defs {
+		byName[d.Name] = d
+	}
+
+	out := map[string]any{}
+	for name, v := range values {
+		d, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown attribute %s", errAttributes, name)
+		}
+		if v == nil {
+			continue
+		}
+		switch d.Type {
+		case AttributeText, AttributeEnum:
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s must be a string", errAttributes, name)
+			}
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			if d.Type == AttributeEnum && !slices.Contains(d.Choices, s) {
+				return nil, fmt.Errorf("%w: %q is not a valid %s", errAttributes, s, name)
+			}
+			out[name] = s
+		case AttributeNumber:
+			f, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s must be a number", errAttributes, name)
+			}
+			out[name] = f
+		case AttributeBoolean:
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s must be true or false", errAttributes, name)
+			}
+			out[name] = b
+		}
+	}
+	for _, d := range defs {
+		if _, ok := out[d.Name]; d.Required && !ok {
+			return nil, fmt.Errorf("%w: missing %s", errAttributes, d.Name)
+		}
+	}
+	return out, nil
+}
+
+func getAttributeSchema(q querier, categoryID int) ([]AttributeDef, error) {
+	rows, err := q.Query(`
+        SELECT name, type, required, choices, unit FROM category_attributes
+        WHERE category_id = $1 ORDER BY position
+    `, categoryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	defs := []AttributeDef{}
+	for rows.Next() {
+		var d AttributeDef
+		if err := rows.Scan(&d.Name, &d.Type, &d.Required, pq.Array(&d.Choices), &d.Unit); err != nil {
+			return nil, err
+		}
+		defs = append(defs, d)
+	}
+	return defs, rows.Err()
+}
+
+// checkAttributes validates p.Attributes against its category's schema and
+// normalises them. The category row is share-locked so the schema cannot
+// change before tx commits.
+func checkAttributes(tx *sql.Tx, p *Product) error {
+	if _, err := tx.Exec("SELECT 1 FROM categories WHERE id = $1 FOR SHARE", p.CategoryID); err != nil {
+		return err
+	}
+	defs, err := getAttributeSchema(tx, p.CategoryID)
+	if err != nil {
+		return err
+	}
+	p.Attributes, err = normalizeAttributes(defs, p.Attributes)
+	return err
+}
+
+// categoryAttributesHandler serves GET and PUT /categories/{id}/attributes.
+func categoryAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	categoryID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM categories WHERE id = $1)", categoryID).Scan(&exists); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		}
+		defs, err := getAttributeSchema(db, categoryID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(defs)
+
+	case http.MethodPut:
+		var defs []AttributeDef
+		if err := json.NewDecoder(r.Body).Decode(&defs); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		if defs == nil {
+			defs = []AttributeDef{}
+		}
+		if err := validateAttributeSchema(defs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := replaceAttributeSchema(categoryID, defs)
+		switch {
+		case err == sql.ErrNoRows:
+			http.Error(w, "Category not found", http.StatusNotFound)
+		case errors.Is(err, errAttributeTypeConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, errAttributes):
+			http.Error(w, "Existing products do not fit the new attributes: "+err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(defs)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// replaceAttributeSchema swaps a category's schema, refusing when an
+// existing product would no longer fit it. An attribute name has one type
+// across all categories, since it maps to one search field.
+func replaceAttributeSchema(categoryID int, defs []AttributeDef) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var one int
+	if err := tx.QueryRow("SELECT 1 FROM categories WHERE id = $1 FOR UPDATE", categoryID).Scan(&one); err != nil {
+		return err
+	}
+
+	types := map[string]string{}
+	names := make([]string, len(defs))
+	for i, d := range defs {
+		types[d.Name] = d.Type
+		names[i] = d.Name
+	}
+	rows, err := tx.Query(`
+        SELECT a.name, a.type, c.slug FROM category_attributes a
+        JOIN categories c ON c.id = a.category_id
+        WHERE a.category_id <> $1 AND a.name = ANY($2)
+    `, categoryID, pq.Array(names))
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name, typ, slug string
+		if err := rows.Scan(&name, &typ, &slug); err != nil {
+			rows.Close()
+			return err
+		}
+		if types[name] != typ {
+			rows.Close()
+			return fmt.Errorf("%w: %s is %s in %s", errAttributeTypeConflict, name, typ, slug)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM category_attributes WHERE category_id = $1", categoryID); err != nil {
+		return err
+	}
+	for i, d := range defs {
+		if _, err := tx.Exec(`
+            INSERT INTO category_attributes (category_id, name, type, required, choices, unit, position)
+            VALUES ($1, $2, $3, $4, $5, $6, $7)
+        `, categoryID, d.Name, d.Type, d.Required, pq.Array(d.Choices), d.Unit, i); err != nil {
+			return err
+		}
+	}
+
+	// Product writes share-lock the category, so none can slip past this check
+	rows, err = tx.Query("SELECT slug, attributes FROM products WHERE category_id = $1", categoryID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var slug string
+		var raw []byte
+		if err := rows.Scan(&slug, &raw); err != nil {
+			return err
+		}
+		var values map[string]any
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return err
+		}
+		if _, err := normalizeAttributes(defs, values); err != nil {
+			return fmt.Errorf("%s: %w", slug, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// filterAttributes adds the attr.* parameters of v to q. Comma-separated
+// values match any of them; .min and .max bound numeric attributes.
+func filterAttributes(q *productQuery, v url.Values) error {
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		if strings.HasPrefix(key, attributeFilterPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.Get(key)
+		if s == "" {
+			continue
+		}
+		name := strings.TrimPrefix(key, attributeFilterPrefix)
+		op := ""
+		if base, ok := strings.CutSuffix(name, ".min"); ok {
+			name, op = base, ">="
+		} else if base, ok := strings.CutSuffix(name, ".max"); ok {
+			name, op = base, "<="
+		}
+		if !validAttributeName(name) {
+			return fmt.Errorf("invalid attribute filter %s", key)
+		}
+
+		if op == "" {
+			q.args = append(q.args, name, pq.Array(strings.Split(s, ",")))
+			q.where = append(q.where, fmt.Sprintf("p.attributes->>$%d::text = ANY($%d)", len(q.args)-1, len(q.args)))
+			continue
+		}
+		bound, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid attribute filter %s", key)
+		}
+		q.args = append(q.args, name, strconv.FormatFloat(bound, 'f', -1, 64))
+		q.where = append(q.where, fmt.Sprintf(
+			"CASE WHEN jsonb_typeof(p.attributes->$%[1]d::text) = 'number' THEN (p.attributes->>$%[1]d::text)::numeric END %[2]s $%[3]d",
+			len(q.args)-1, op, len(q.args),
+		))
+	}
+	return nil
+}
+
+// facetsHandler serves GET /products/facets?category=..., taking the same
+// filters as the listing. Each facet ignores its own attribute's filter, so
+// a shopper can widen a selection they already made.
+func facetsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	slug := r.URL.Query().Get("category")
+	if slug == "" {
+		http.Error(w, "Missing category", http.StatusBadRequest)
+		return
+	}
+	var categoryID int
+	err := db.QueryRow("SELECT id FROM categories WHERE slug = $1", slug).Scan(&categoryID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defs, err := getAttributeSchema(db, categoryID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	view, err := newPriceView(r)
+	if err != nil {
+		writeCurrencyError(w, err)
+		return
+	}
+
+	facets := []Facet{}
+	for _, d := range defs {
+		v := url.Values{}
+		for key, values := range r.URL.Query() {
+			name, _, _ := strings.Cut(strings.TrimPrefix(key, attributeFilterPrefix), ".")
+			if !strings.HasPrefix(key, attributeFilterPrefix) || name != d.Name {
+				v[key] = values
+			}
+		}
+		q, err := parseProductQuery(v, view)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, err := facetFor(q, d)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		facets = append(facets, f)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(facets)
+}
+
+func facetFor(q *productQuery, d AttributeDef) (Facet, error) {
+	f := Facet{Name: d.Name, Type: d.Type, Unit: d.Unit}
+
+	if d.Type == AttributeNumber {
+		q.filter("jsonb_typeof(p.attributes->$%d::text) = 'number'", d.Name)
+		var min, max sql.NullFloat64
+		err := db.QueryRow(fmt.Sprintf(
+			"SELECT MIN((p.attributes->>$%[1]d::text)::numeric)::float8, MAX((p.attributes->>$%[1]d::text)::numeric)::float8",
+			len(q.args),
+		)+productFrom+q.whereClause(), q.args...).Scan(&min, &max)
+		if min.Valid {
+			f.Min, f.Max = &min.Float64, &max.Float64
+		}
+		return f, err
+	}
+
+	q.filter("p.attributes->>$%d::text IS NOT NULL", d.Name)
+	rows, err := db.Query(fmt.Sprintf("SELECT p.attributes->>$%d::text, COUNT(*)", len(q.args))+
+		productFrom+q.whereClause()+fmt.Sprintf(" GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT %d", facetValueLimit),
+		q.args...)
+	if err != nil {
+		return f, err
+	}
+	defer rows.Close()
+	f.Values = []FacetValue{}
+	for rows.Next() {
+		var fv FacetValue
+		if err := rows.Scan(&fv.Value, &fv.Count); err != nil {
+			return f, err
+		}
+		f.Values = append(f.Values, fv)
+	}
+	return f, rows.Err()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Product lifecycle states. Archived products are hidden from the catalog
+// but can be restored; deleted products are kept so historical orders still
+// resolve them.
+const (
+	ProductActive   = "active"
+	ProductArchived = "archived"
+	ProductDeleted  = "deleted"
+)
+
+// Audit actions
+const (
+	AuditCreated  = "created"
+	AuditUpdated  = "updated"
+	AuditArchived = "archived"
+	AuditDeleted  = "deleted"
+	AuditRestored = "restored"
+)
+
+// Actors for changes no request made
+const (
+	ActorScheduler = "system:price-scheduler"
+	ActorStock     = "system:stock"
+)
+
+const auditListLimit = 200
+
+// AuditEntry records one change to a product: a field moving from OldValue
+// to NewValue, or the whole product on creation.
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	ProductID int             `json:"product_id"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Field     string          `json:"field,omitempty"`
+	OldValue  json.RawMessage `json:"old_value,omitempty"`
+	NewValue  json.RawMessage `json:"new_value,omitempty"`
+	ChangedAt time.Time       `json:"changed_at"`
+}
+
+var errProductStatus = errors.New("status must be active, archived or deleted")
+
+func validProductStatus(status string) bool {
+	switch status {
+	case ProductActive, ProductArchived, ProductDeleted:
+		return true
+	}
+	return false
+}
+
+// visibleTo reports whether a product in status may be read by r's caller.
+// Archived and deleted products are gone for shoppers and the services
+// acting for them, so carts and orders cannot pick them up; catalog staff
+// still read them, e.g. to restore one.
+func visibleTo(r *http.Request, status string) bool {
+	if status == ProductActive {
+		return true
+	}
+	p, err := authenticate(r)
+	return err == nil && p.can(RoleReadOnly)
+}
+
+// auditedFields are the product fields whose changes are recorded.
+var auditedFields = []struct {
+	name  string
+	value func(p Product) any
+}{
+	{"name", func(p Product) any { return p.Name }},
+	{"slug", func(p Product) any { return p.Slug }},
+	{"description", func(p Product) any { return p.Description }},
+	{"category_id", func(p Product) any { return p.CategoryID }},
+	{"price", func(p Product) any { return p.Price }},
+	{"sale_price", func(p Product) any {
+		if p.WasPrice == nil {
+			return nil
+		}
+		return p.EffectivePrice
+	}},
+	{"attributes", func(p Product) any { return p.Attributes }},
+	{"available", func(p Product) any { return p.Available }},
+	{"image_url", func(p Product) any { return p.ImageURL }},
+	{"stock_quantity", func(p Product) any { return p.StockQuantity }},
+	{"weight_grams", func(p Product) any { return p.WeightGrams }},
+	{"low_stock_threshold", func(p Product) any { return p.LowStockThreshold }},
+	{"status", func(p Product) any { return p.Status }},
+}
+
+// auditCreate records p as created by actor.
+func auditCreate(tx execer, actor string, p Product) error {
+	snapshot, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return insertAudit(tx, AuditEntry{ProductID: p.ID, Actor: actor, Action: AuditCreated, NewValue: snapshot})
+}
+
+// auditChanges records every audited field that differs between old and
+// new. A status change is recorded as an archive, delete or restore.
+func auditChanges(tx execer, actor string, old, new Product) error {
+	for _, f := range auditedFields {
+		before, err := json.Marshal(f.value(old))
+		if err != nil {
+			return err
+		}
+		after, err := json.Marshal(f.value(new))
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(before, after) {
+			continue
+		}
+		action := AuditUpdated
+		if f.name == "status" {
+			action = statusAction(new.Status)
+		}
+		if err := insertAudit(tx, AuditEntry{
+			ProductID: new.ID, Actor: actor, Action: action,
+			Field: f.name, OldValue: before, NewValue: after,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func statusAction(status string) string {
+	switch status {
+	case ProductArchived:
+		return AuditArchived
+	case ProductDeleted:
+		return AuditDeleted
+	default:
+		return AuditRestored
+	}
+}
+
+func insertAudit(tx execer, e AuditEntry) error {
+	_, err := tx.Exec(`
+        INSERT INTO product_audit (product_id, actor, action, field, old_value, new_value)
+        VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6)
+    `, e.ProductID, e.Actor, e.Action, e.Field, nullJSON(e.OldValue), nullJSON(e.NewValue))
+	return err
+}
+
+// nullJSON stores an absent value as NULL rather than an empty document.
+func nullJSON(v json.RawMessage) any {
+	if len(v) == 0 {
+		return nil
+	}
+	return []byte(v)
+}
+
+// productHistoryHandler serves GET /products/{id}/history, newest first.
+// ?field= narrows it to one field. Deleted products keep their history.
+func productHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !productExists(w, productID) {
+		return
+	}
+
+	query := `
+        SELECT id, product_id, actor, action, COALESCE(field, ''), old_value, new_value, changed_at
+        FROM product_audit WHERE product_id = $1`
+	args := []any{productID}
+	if field := r.URL.Query().Get("field"); field != "" {
+		query += " AND field = $2"
+		args = append(args, field)
+	}
+	rows, err := db.Query(query+" ORDER BY changed_at DESC, id DESC LIMIT "+strconv.Itoa(auditListLimit), args...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var before, after []byte
+		if err := rows.Scan(&e.ID, &e.ProductID, &e.Actor, &e.Action, &e.Field, &before, &after, &e.ChangedAt); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		e.OldValue, e.NewValue = before, after
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// enqueueAuditedRefresh audits how the product changed since before and
+// queues its update event, for writes made outside updateProductRow.
+func enqueueAuditedRefresh(tx *sql.Tx, actor string, before Product) error {
+	after, err := scanProduct(tx.QueryRow(productSelect+" WHERE p.id = $1", before.ID))
+	if err != nil {
+		return err
+	}
+	if err := auditChanges(tx, actor, before, after); err != nil {
+		return err
+	}
+	return enqueueProductEvent(tx, EventProductUpdated, after)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVisibleTo(t *testing.T) {
+	saved := verifier
+	verifier = &tokenVerifier{secret: []byte("test-secret")}
+	defer func() { verifier = saved }()
+
+	staff := "Bearer " + signHS256(t, "test-secret", testClaims{}.with("role", RoleReadOnly))
+	shopper := "Bearer " + signHS256(t, "test-secret", testClaims{})
+	tests := []struct {
+		status string
+		header string
+		want   bool
+	}{
+		{ProductActive, "", true},
+		{ProductArchived, "", false},
+		{ProductDeleted, "", false},
+		{ProductArchived, shopper, false},
+		{ProductArchived, staff, true},
+		{ProductDeleted, staff, true},
+		{ProductArchived, "Bearer not-a-token", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/products/7", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if got := visibleTo(r, tt.status); got != tt.want {
+			t.Errorf("visibleTo(%s, %.20q) = %v, want %v", tt.status, tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles, from least to most privileged. Each role may do everything the
+// ones before it may.
+const (
+	RoleReadOnly     = "read-only"
+	RoleMerchandiser = "merchandiser"
+	RoleAdmin        = "admin"
+)
+
+var roleRank = map[string]int{RoleReadOnly: 1, RoleMerchandiser: 2, RoleAdmin: 3}
+
+// RoleService is held by the services that hold and settle stock for
+// checkouts. It sits outside the ranking above: no catalog role implies
+// it, though admin may do everything.
+const RoleService = "service"
+
+// Clock skew tolerated on exp and nbf
+const tokenLeeway = time.Minute
+
+// How often an unknown key id may trigger a JWKS refetch
+const jwksRefreshInterval = time.Minute
+
+var (
+	errMissingToken = errors.New("missing bearer token")
+	errInvalidToken = errors.New("invalid token")
+)
+
+// Principal is the authenticated caller.
+type Principal struct {
+	Subject string
+	Roles   []string
+}
+
+// can reports whether p holds role or a role above it.
+func (p Principal) can(role string) bool {
+	for _, r := range p.Roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+		if roleRank[role] > 0 && roleRank[r] >= roleRank[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenVerifier checks bearer tokens against a shared HS256 secret and/or
+// the RS256 keys of a JWKS document.
+type tokenVerifier struct {
+	secret   []byte
+	issuer   string
+	audience string
+
+	jwksFile string
+	jwksURL  string
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	lastRefresh time.Time
+}
+
+// verifier is nil when AUTH_DISABLED is set, which lets every caller
+// through as admin. It is only honoured with APP_ENV=development.
+var verifier *tokenVerifier
+
+// newTokenVerifier reads JWT_SECRET, JWT_JWKS_FILE or JWT_JWKS_URL, and the
+// optional JWT_ISSUER and JWT_AUDIENCE. At least one key source is
+// required unless AUTH_DISABLED=true, which anywhere but APP_ENV=development
+// is an error rather than an open door.
+func newTokenVerifier() (*tokenVerifier, error) {
+	if os.Getenv("AUTH_DISABLED") == "true" {
+		if os.Getenv("APP_ENV") != "development" {
+			return nil, errors.New("AUTH_DISABLED=true is only allowed with APP_ENV=development")
+		}
+		return nil, nil
+	}
+	v := &tokenVerifier{
+		secret:   []byte(os.Getenv("JWT_SECRET")),
+		issuer:   os.Getenv("JWT_ISSUER"),
+		audience: os.Getenv("JWT_AUDIENCE"),
+		jwksFile: os.Getenv("JWT_JWKS_FILE"),
+		jwksURL:  os.Getenv("JWT_JWKS_URL"),
+	}
+	if len(v.secret) == 0 && v.jwksFile == "" && v.jwksURL == "" {
+		return nil, errors.New("set JWT_SECRET, JWT_JWKS_FILE or JWT_JWKS_URL")
+	}
+	if v.jwksFile != "" || v.jwksURL != "" {
+		if err := v.refreshKeys(); err != nil {
+			return nil, fmt.Errorf("load JWKS: %w", err)
+		}
+	}
+	return v, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// refreshKeys reloads the RSA signing keys from the JWKS file or URL.
+func (v *tokenVerifier) refreshKeys() error {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if v.jwksFile != "" {
+		data, err := os.ReadFile(v.jwksFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+	} else {
+		resp, err := syncClient.Get(v.jwksURL)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			return err
+		}
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("key %q: bad modulus", k.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			return fmt.Errorf("key %q: bad exponent", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.lastRefresh = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+// rsaKey returns the key for kid, refetching the JWKS once per interval
+// when the id is unknown so rotated keys are picked up.
+func (v *tokenVerifier) rsaKey(kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.lastRefresh) > jwksRefreshInterval
+	v.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if (v.jwksFile == "" && v.jwksURL == "") || !stale {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidToken, kid)
+	}
+	if err := v.refreshKeys(); err != nil {
+		log.Println("❌ JWKS refresh failed:", err)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", errInvalidToken, kid)
+}
+
+// audience accepts the aud claim as a single string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+type tokenClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt float64  `json:"exp"`
+	NotBefore float64  `json:"nbf"`
+	Role      string   `json:"role"`
+	Roles     []string `json:"roles"`
+}
+
+// verify checks the token's signature and claims and returns its caller.
+func (v *tokenVerifier) verify(token string) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Principal{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, errInvalidToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch header.Alg {
+	case "HS256":
+		if len(v.secret) == 0 {
+			return Principal{}, fmt.Errorf("%w: HS256 not accepted", errInvalidToken)
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return Principal{}, fmt.Errorf("%w: bad signature", errInvalidToken)
+		}
+	case "RS256":
+		key, err := v.rsaKey(header.Kid)
+		if err != nil {
+			return Principal{}, err
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return Principal{}, fmt.Errorf("%w: bad signature", errInvalidToken)
+		}
+	default:
+		return Principal{}, fmt.Errorf("%w: unsupported alg %q", errInvalidToken, header.Alg)
+	}
+
+	var claims tokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Principal{}, err
+	}
+	now := time.Now()
+	switch {
+	case claims.Subject == "":
+		return Principal{}, fmt.Errorf("%w: missing sub", errInvalidToken)
+	case claims.ExpiresAt == 0 || now.After(time.Unix(int64(claims.ExpiresAt), 0).Add(tokenLeeway)):
+		return Principal{}, fmt.Errorf("%w: expired", errInvalidToken)
+	case claims.NotBefore != 0 && now.Add(tokenLeeway).Before(time.Unix(int64(claims.NotBefore), 0)):
+		return Principal{}, fmt.Errorf("%w: not yet valid", errInvalidToken)
+	case v.issuer != "" && claims.Issuer != v.issuer:
+		return Principal{}, fmt.Errorf("%w: wrong issuer", errInvalidToken)
+	case v.audience != "" && !contains(claims.Audience, v.audience):
+		return Principal{}, fmt.Errorf("%w: wrong audience", errInvalidToken)
+	}
+
+	p := Principal{Subject: claims.Subject}
+	for _, r := range append(claims.Roles, claims.Role) {
+		if _, ok := roleRank[r]; ok || r == RoleService {
+			p.Roles = append(p.Roles, r)
+		}
+	}
+	return p, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errInvalidToken
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// authenticate resolves the caller from the Authorization header.
+func authenticate(r *http.Request) (Principal, error) {
+	if verifier == nil {
+		return Principal{Subject: "anonymous", Roles: []string{RoleAdmin}}, nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return Principal{}, errMissingToken
+	}
+	return verifier.verify(token)
+}
+
+// requireRole lets a request through to h only when the caller holds role.
+// The caller is stored on the request for requestActor.
+func requireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticate(r)
+		if err != nil {
+			writeUnauthorized(w)
+			return
+		}
+		if !p.can(role) {
+			http.Error(w, "Forbidden: requires role "+role, http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// writeUnauthorized rejects a request that carries no usable token.
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="product-service"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// requireUser lets a request through to h only when it carries a valid
+// token, whatever roles it holds. Shoppers' tokens hold none.
+func requireUser(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticate(r)
+		if err != nil {
+			writeUnauthorized(w)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// guardWrites keeps GET and HEAD public and requires role for every other
+// method.
+func guardWrites(role string, h http.HandlerFunc) http.HandlerFunc {
+	return publicReads(h, requireRole(role, h))
+}
+
+// guardUserWrites keeps GET and HEAD public and requires a signed-in caller
+// for every other method.
+func guardUserWrites(h http.HandlerFunc) http.HandlerFunc {
+	return publicReads(h, requireUser(h))
+}
+
+// publicReads serves GET and HEAD with h and everything else with guarded.
+func publicReads(h, guarded http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			h(w, r)
+			return
+		}
+		guarded(w, r)
+	}
+}
+
+// requestActor names the authenticated caller of r for the audit log.
+func requestActor(r *http.Request) string {
+	if p, ok := requestPrincipal(r); ok {
+		return p.Subject
+	}
+	return "anonymous"
+}
+
+// requestPrincipal is the caller a guard authenticated for r.
+func requestPrincipal(r *http.Request) (Principal, bool) {
+	p, ok := r.Context().Value(principalKey{}).(Principal)
+	return p, ok
+}
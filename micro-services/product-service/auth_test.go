@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClaims is a token payload; exp is an hour out unless set.
+type testClaims map[string]any
+
+func (c testClaims) with(key string, value any) testClaims {
+	out := testClaims{"sub": "42", "exp": time.Now().Add(time.Hour).Unix()}
+	for k, v := range c {
+		out[k] = v
+	}
+	if value == nil {
+		delete(out, key)
+	} else {
+		out[key] = value
+	}
+	return out
+}
+
+func segment(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signHS256(t *testing.T, secret string, c testClaims) string {
+	t.Helper()
+	signed := segment(t, map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + segment(t, c)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, c testClaims) string {
+	t.Helper()
+	signed := segment(t, map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid}) + "." + segment(t, c)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// tamper swaps the token's payload for c, keeping the original signature.
+func tamper(t *testing.T, token string, c testClaims) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	return parts[0] + "." + segment(t, c) + "." + parts[2]
+}
+
+// writeJWKS stores the public halves of keys, by kid, as a JWKS file.
+func writeJWKS(t *testing.T, keys map[string]*rsa.PrivateKey) string {
+	t.Helper()
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, k := range keys {
+		doc.Keys = append(doc.Keys, jwk{
+			Kty: "RSA", Kid: kid, Use: "sig",
+			N: base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		})
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	data, _ := json.Marshal(doc)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyHS256(t *testing.T) {
+	v := &tokenVerifier{secret: []byte("test-secret"), issuer: "user-service", audience: "mallhive"}
+	base := testClaims{"iss": "user-service", "aud": "mallhive"}
+	valid := signHS256(t, "test-secret", base.with("role", RoleMerchandiser))
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"audience list", signHS256(t, "test-secret", base.with("aud", []string{"other", "mallhive"})), true},
+		{"expired within leeway", signHS256(t, "test-secret", base.with("exp", now.Add(-30*time.Second).Unix())), true},
+		{"expired", signHS256(t, "test-secret", base.with("exp", now.Add(-2*tokenLeeway).Unix())), false},
+		{"no expiry", signHS256(t, "test-secret", base.with("exp", nil)), false},
+		{"not yet valid", signHS256(t, "test-secret", base.with("nbf", now.Add(time.Hour).Unix())), false},
+		{"missing subject", signHS256(t, "test-secret", base.with("sub", nil)), false},
+		{"wrong issuer", signHS256(t, "test-secret", base.with("iss", "elsewhere")), false},
+		{"wrong audience", signHS256(t, "test-secret", base.with("aud", "other")), false},
+		{"wrong secret", signHS256(t, "other-secret", base), false},
+		{"tampered payload", tamper(t, valid, base.with("role", RoleAdmin)), false},
+		{"tampered signature", valid[:len(valid)-2] + "AA", false},
+		{"alg none", segment(t, map[string]string{"alg": "none"}) + "." + segment(t, base.with("role", RoleAdmin)) + ".", false},
+		{"not a jwt", "not-a-token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := v.verify(tt.token)
+			if !tt.ok {
+				if !errors.Is(err, errInvalidToken) {
+					t.Fatalf("verify = %+v, %v, want errInvalidToken", p, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if p.Subject != "42" {
+				t.Errorf("subject %q, want 42", p.Subject)
+			}
+		})
+	}
+}
+
+func TestVerifyRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AUTH_DISABLED", "")
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_JWKS_FILE", writeJWKS(t, map[string]*rsa.PrivateKey{"k1": key}))
+	v, err := newTokenVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := signRS256(t, key, "k1", testClaims{}.with("role", RoleAdmin))
+	// HS256 keyed with the public modulus, the classic algorithm confusion
+	confused := signHS256(t, string(key.N.Bytes()), testClaims{}.with("role", RoleAdmin))
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"expired", signRS256(t, key, "k1", testClaims{}.with("exp", time.Now().Add(-time.Hour).Unix())), false},
+		{"unknown key id", signRS256(t, key, "k2", testClaims{}), false},
+		{"signed by another key", signRS256(t, other, "k1", testClaims{}), false},
+		{"tampered payload", tamper(t, valid, testClaims{}.with("sub", "1")), false},
+		{"HS256 without a secret", confused, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.verify(tt.token)
+			if tt.ok && err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if !tt.ok && !errors.Is(err, errInvalidToken) {
+				t.Fatalf("verify = %v, want errInvalidToken", err)
+			}
+		})
+	}
+}
+
+func TestVerifyRoles(t *testing.T) {
+	v := &tokenVerifier{secret: []byte("test-secret")}
+	tests := []struct {
+		name   string
+		claims testClaims
+		want   []string
+	}{
+		{"shopper", testClaims{}, nil},
+		{"single role", testClaims{"role": RoleMerchandiser}, []string{RoleMerchandiser}},
+		{"role list", testClaims{"roles": []string{RoleReadOnly, RoleService}}, []string{RoleReadOnly, RoleService}},
+		{"unknown roles dropped", testClaims{"roles": []string{"superuser"}, "role": "root"}, nil},
+	}
+	for _, tt := range tests {
+		p, err := v.verify(signHS256(t, "test-secret", tt.claims.with("sub", "42")))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(p.Roles, tt.want) {
+			t.Errorf("%s: roles %v, want %v", tt.name, p.Roles, tt.want)
+		}
+	}
+}
+
+func TestPrincipalCan(t *testing.T) {
+	tests := []struct {
+		roles []string
+		role  string
+		want  bool
+	}{
+		{nil, RoleReadOnly, false},
+		{[]string{RoleReadOnly}, RoleReadOnly, true},
+		{[]string{RoleReadOnly}, RoleMerchandiser, false},
+		{[]string{RoleMerchandiser}, RoleReadOnly, true},
+		{[]string{RoleMerchandiser}, RoleAdmin, false},
+		{[]string{RoleAdmin}, RoleMerchandiser, true},
+		{[]string{RoleAdmin}, RoleService, true},
+		{[]string{RoleService}, RoleService, true},
+		{[]string{RoleService}, RoleReadOnly, false},
+		{[]string{RoleMerchandiser}, RoleService, false},
+		{[]string{RoleReadOnly, RoleService}, RoleService, true},
+	}
+	for _, tt := range tests {
+		if got := (Principal{Roles: tt.roles}).can(tt.role); got != tt.want {
+			t.Errorf("%v can %s = %v, want %v", tt.roles, tt.role, got, tt.want)
+		}
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	tests := []struct {
+		env     string
+		wantErr bool
+	}{
+		{"development", false},
+		{"production", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTH_DISABLED", "true")
+		t.Setenv("APP_ENV", tt.env)
+		v, err := newTokenVerifier()
+		if (err != nil) != tt.wantErr || v != nil {
+			t.Errorf("APP_ENV=%q: verifier %v, error %v, want error %v", tt.env, v, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	saved := verifier
+	verifier = &tokenVerifier{secret: []byte("test-secret")}
+	defer func() { verifier = saved }()
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"invalid token", "Bearer " + signHS256(t, "other-secret", testClaims{}.with("role", RoleAdmin)), http.StatusUnauthorized},
+		{"too weak", "Bearer " + signHS256(t, "test-secret", testClaims{}.with("role", RoleReadOnly)), http.StatusForbidden},
+		{"allowed", "Bearer " + signHS256(t, "test-secret", testClaims{}.with("role", RoleMerchandiser)), http.StatusOK},
+		{"admin", "Bearer " + signHS256(t, "test-secret", testClaims{}.with("role", RoleAdmin)), http.StatusOK},
+	}
+	for _, tt := range tests {
+		var actor string
+		h := requireRole(RoleMerchandiser, func(w http.ResponseWriter, r *http.Request) { actor = requestActor(r) })
+		req := httptest.NewRequest(http.MethodPost, "/products", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+		if tt.status == http.StatusOK && actor != "42" {
+			t.Errorf("%s: actor %q, want 42", tt.name, actor)
+		}
+	}
+}
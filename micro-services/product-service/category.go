@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type Category struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+var (
+	errMissingCategory  = errors.New("missing category")
+	errCategoryNotFound = errors.New("category not found")
+)
+
+func categoryHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query("SELECT id, name, slug FROM categories ORDER BY name")
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		categories := []Category{}
+		for rows.Next() {
+			var c Category
+			if err := rows.Scan(&c.ID, &c.Name, &c.Slug); err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			categories = append(categories, c)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(categories)
+
+	case http.MethodPost:
+		var c Category
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil || c.Name == "" {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		if c.Slug == "" {
+			c.Slug = c.Name
+		}
+		c.Slug = slugify(c.Slug)
+
+		err := db.QueryRow(
+			"INSERT INTO categories (name, slug) VALUES ($1, $2) RETURNING id", c.Name, c.Slug,
+		).Scan(&c.ID)
+		if isUniqueViolation(err) {
+			http.Error(w, "Category already exists", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Database insert failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func categoryItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var c Category
+		err := db.QueryRow("SELECT id, name, slug FROM categories WHERE id = $1", id).
+			Scan(&c.ID, &c.Name, &c.Slug)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+
+	case http.MethodPut:
+		var c Category
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil || c.Name == "" {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		c.ID = id
+		if c.Slug == "" {
+			c.Slug = c.Name
+		}
+		c.Slug = slugify(c.Slug)
+
+		res, err := db.Exec("UPDATE categories SET name = $1, slug = $2 WHERE id = $3", c.Name, c.Slug, id)
+		if isUniqueViolation(err) {
+			http.Error(w, "Category name or slug already in use", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+
+	case http.MethodDelete:
+		// products.category_id cascades, so refuse rather than wipe the catalog
+		var inUse bool
+		if err := db.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM products WHERE category_id = $1)", id,
+		).Scan(&inUse); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if inUse {
+			http.Error(w, "Category still has products", http.StatusConflict)
+			return
+		}
+
+		res, err := db.Exec("DELETE FROM categories WHERE id = $1", id)
+		if err != nil {
+			http.Error(w, "Database delete failed", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// resolveCategory fills in whichever of CategoryID or Category (slug) is
+// missing, preferring the id when both are given.
+func resolveCategory(p *Product) error {
+	var err error
+	switch {
+	case p.CategoryID != 0:
+		err = db.QueryRow("SELECT slug FROM categories WHERE id = $1", p.CategoryID).Scan(&p.Category)
+	case p.Category != "":
+		err = db.QueryRow("SELECT id FROM categories WHERE slug = $1", p.Category).Scan(&p.CategoryID)
+	default:
+		return errMissingCategory
+	}
+	if err == sql.ErrNoRows {
+		return errCategoryNotFound
+	}
+	return err
+}
+
+func writeCategoryError(w http.ResponseWriter, err error) {
+	switch err {
+	case errMissingCategory:
+		http.Error(w, "Missing category", http.StatusBadRequest)
+	case errCategoryNotFound:
+		http.Error(w, "Category not found", http.StatusBadRequest)
+	default:
+		http.Error(w, "Database error", http.StatusInternalServerError)
+	}
+}
+
+// slugify lowercases s and collapses every run of non-alphanumerics into a
+// single hyphen, e.g. "Wooden Dining Table" -> "wooden-dining-table".
+func slugify(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			hyphen = false
+		} else if !hyphen && b.Len() > 0 {
+			b.WriteByte('-')
+			hyphen = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// uniqueSlug returns base, or base suffixed with -2, -3, ... if the slug is
+// already taken in table.
+func uniqueSlug(table, base string) (string, error) {
+	if base == "" {
+		base = "item"
+	}
+	slug := base
+	for n := 2; ; n++ {
+		var taken bool
+		err := db.QueryRow(
+			fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE slug = $1)", table), slug,
+		).Scan(&taken)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return slug, nil
+		}
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+}
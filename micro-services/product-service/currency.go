@@ -0,0 +1,380 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"mallhive/shared/money"
+)
+
+// exchangeRates maps a currency to its units per one DefaultCurrency. Rates
+// are exact decimals, so a conversion rounds only once.
+type exchangeRates map[string]*big.Rat
+
+// RateTable is the wire format of the rate file and the admin endpoint, e.g.
+// {"base": "USD", "rates": {"EUR": "0.92", "GBP": 0.79}}.
+type RateTable struct {
+	Base  string                 `json:"base"`
+	Rates map[string]json.Number `json:"rates"`
+}
+
+var (
+	errUnsupportedCurrency = errors.New("unsupported currency")
+	errCurrencyPrecision   = errors.New("currencies with more than two decimals are not supported")
+	errCurrencyLocked      = errors.New("base currency cannot change while SKU price overrides or price schedules exist")
+)
+
+// maxRateScale matches the scale of exchange_rates.rate.
+const maxRateScale = 10
+
+func loadExchangeRates(q querier) (exchangeRates, error) {
+	rows, err := q.Query("SELECT currency, rate::text FROM exchange_rates")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := exchangeRates{money.DefaultCurrency: big.NewRat(1, 1)}
+	for rows.Next() {
+		var code, text string
+		if err := rows.Scan(&code, &text); err != nil {
+			return nil, err
+		}
+		rate, ok := new(big.Rat).SetString(text)
+		if !ok {
+			return nil, fmt.Errorf("invalid stored rate %q for %s", text, code)
+		}
+		rates[code] = rate
+	}
+	return rates, rows.Err()
+}
+
+// convert expresses m in currency to, rounding half away from zero to the
+// target's minor unit.
+func (rates exchangeRates) convert(m money.Money, to string) (money.Money, error) {
+	if m.Currency == to {
+		return m, nil
+	}
+	from, ok := rates[m.Currency]
+	target, ok2 := rates[to]
+	if !ok || !ok2 {
+		return m, fmt.Errorf("%w: %s to %s", errUnsupportedCurrency, m.Currency, to)
+	}
+
+	// amount / 10^expFrom / from * target * 10^expTo
+	r := new(big.Rat).SetInt64(m.Amount)
+	r.Mul(r, target)
+	r.Quo(r, from)
+	shift := money.Exponent(to) - money.Exponent(m.Currency)
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(shift))), nil))
+	if shift >= 0 {
+		r.Mul(r, scale)
+	} else {
+		r.Quo(r, scale)
+	}
+
+	amount, ok := roundRat(r)
+	if !ok {
+		return m, money.ErrInvalidAmount
+	}
+	return money.Money{Amount: amount, Currency: to}, nil
+}
+
+// roundRat rounds r to an integer, half away from zero.
+func roundRat(r *big.Rat) (int64, bool) {
+	q, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if rem.Abs(rem).Lsh(rem, 1).Cmp(r.Denom()) >= 0 {
+		if r.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q.Int64(), q.IsInt64()
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// storableCurrency reports whether code can be a product's base currency:
+// it needs a rate, and prices are stored with two decimals. The rate row is
+// share-locked so it cannot be dropped before tx commits.
+func storableCurrency(tx *sql.Tx, code string) error {
+	if money.Exponent(code) > 2 {
+		return errCurrencyPrecision
+	}
+	var one int
+	err := tx.QueryRow("SELECT 1 FROM exchange_rates WHERE currency = $1 FOR SHARE", code).Scan(&one)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s", errUnsupportedCurrency, code)
+	}
+	return err
+}
+
+// checkCurrencyChange refuses to move a product to another base currency
+// while amounts stored in the old one still refer to it.
+func checkCurrencyChange(tx *sql.Tx, productID int) error {
+	var locked bool
+	if err := tx.QueryRow(`
+        SELECT EXISTS (SELECT 1 FROM skus WHERE product_id = $1 AND price IS NOT NULL)
+            OR EXISTS (SELECT 1 FROM price_schedules WHERE product_id = $1 AND status IN ($2, $3))
+    `, productID, PriceScheduled, PriceActive).Scan(&locked); err != nil {
+		return err
+	}
+	if locked {
+		return errCurrencyLocked
+	}
+	return nil
+}
+
+// priceView converts the prices of a read into the currency asked for with
+// ?currency=. Without the parameter prices stay in each product's base
+// currency.
+type priceView struct {
+	currency string
+	rates    exchangeRates
+}
+
+func newPriceView(r *http.Request) (priceView, error) {
+	var v priceView
+	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("currency")))
+	if code == "" {
+		return v, nil
+	}
+	if !money.ValidCurrency(code) {
+		return v, money.ErrInvalidCurrency
+	}
+	rates, err := loadExchangeRates(db)
+	if err != nil {
+		return v, err
+	}
+	if _, ok := rates[code]; !ok {
+		return v, fmt.Errorf("%w: %s", errUnsupportedCurrency, code)
+	}
+	return priceView{currency: code, rates: rates}, nil
+}
+
+func (v priceView) convert(m *money.Money) error {
+	if v.currency == "" || m == nil {
+		return nil
+	}
+	converted, err := v.rates.convert(*m, v.currency)
+	if err != nil {
+		return err
+	}
+	*m = converted
+	return nil
+}
+
+// pivotBound turns a price bound given in the view's currency into the
+// DefaultCurrency decimal the listing's pivotPrice column is compared with.
+func (v priceView) pivotBound(s string) (string, error) {
+	code := v.currency
+	if code == "" {
+		code = money.DefaultCurrency
+	}
+	m, err := money.Parse(s, code)
+	if err != nil {
+		return "", err
+	}
+	if code == money.DefaultCurrency {
+		return m.Decimal(), nil
+	}
+	r, _ := new(big.Rat).SetString(m.Decimal())
+	return r.Quo(r, v.rates[code]).FloatString(maxRateScale), nil
+}
+
+func (v priceView) product(p *Product) error {
+	for _, m := range []*money.Money{&p.Price, &p.EffectivePrice, p.WasPrice} {
+		if err := v.convert(m); err != nil {
+			return err
+		}
+	}
+	for i := range p.SKUs {
+		if err := v.sku(&p.SKUs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v priceView) sku(s *SKU) error {
+	for _, m := range []*money.Money{s.PriceOverride, &s.Price, s.WasPrice} {
+		if err := v.convert(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCurrencyError maps currency lookup and conversion errors to a response.
+func writeCurrencyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, money.ErrInvalidCurrency), errors.Is(err, errUnsupportedCurrency), errors.Is(err, errCurrencyPrecision):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "Database error", http.StatusInternalServerError)
+	}
+}
+
+// parseRateTable validates t and returns its rates keyed by currency. The
+// table must be quoted against DefaultCurrency.
+func parseRateTable(t RateTable) (exchangeRates, error) {
+	if t.Base != "" && strings.ToUpper(t.Base) != money.DefaultCurrency {
+		return nil, fmt.Errorf("rates must be quoted against %s", money.DefaultCurrency)
+	}
+	rates := exchangeRates{money.DefaultCurrency: big.NewRat(1, 1)}
+	for code, n := range t.Rates {
+		code = strings.ToUpper(code)
+		if !money.ValidCurrency(code) {
+			return nil, fmt.Errorf("%w: %q", money.ErrInvalidCurrency, code)
+		}
+		rate, ok := new(big.Rat).SetString(n.String())
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid rate for %s", code)
+		}
+		if code == money.DefaultCurrency && rate.Cmp(big.NewRat(1, 1)) != 0 {
+			return nil, fmt.Errorf("rate for %s must be 1", money.DefaultCurrency)
+		}
+		rates[code] = rate
+	}
+	return rates, nil
+}
+
+// storeExchangeRates replaces the rate table. Currencies still used as a
+// product's base currency cannot be dropped.
+func storeExchangeRates(rates exchangeRates) error {
+	codes := make([]string, 0, len(rates))
+	for code := range rates {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Dropping a rate waits for product writes that share-locked it, so the
+	// check below sees every product that uses it
+	if _, err := tx.Exec("DELETE FROM exchange_rates WHERE currency <> ALL($1)", pq.Array(codes)); err != nil {
+		return err
+	}
+	var missing []string
+	rows, err := tx.Query(
+		"SELECT DISTINCT currency FROM products WHERE currency <> ALL($1) ORDER BY currency", pq.Array(codes),
+	)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			rows.Close()
+			return err
+		}
+		missing = append(missing, code)
+	}
+	rows.Close()
+	if len(missing) > 0 {
+		return &missingRatesError{missing}
+	}
+
+	for _, code := range codes {
+		if _, err := tx.Exec(`
+            INSERT INTO exchange_rates (currency, rate) VALUES ($1, $2)
+            ON CONFLICT (currency) DO UPDATE SET rate = EXCLUDED.rate, updated_at = NOW()
+        `, code, rates[code].FloatString(maxRateScale)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type missingRatesError struct {
+	Currencies []string
+}
+
+func (e *missingRatesError) Error() string {
+	return "rates missing for currencies in use: " + strings.Join(e.Currencies, ", ")
+}
+
+// loadRateFile replaces the rate table with the contents of a local JSON file.
+func loadRateFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var t RateTable
+	if err := json.NewDecoder(f).Decode(&t); err != nil {
+		return 0, err
+	}
+	rates, err := parseRateTable(t)
+	if err != nil {
+		return 0, err
+	}
+	return len(rates), storeExchangeRates(rates)
+}
+
+// exchangeRatesHandler serves GET and PUT /admin/exchange-rates.
+func exchangeRatesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rates, err := loadExchangeRates(db)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rateTable(rates))
+
+	case http.MethodPut:
+		var t RateTable
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&t); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		rates, err := parseRateTable(t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var missing *missingRatesError
+		if err := storeExchangeRates(rates); errors.As(err, &missing) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rateTable(rates))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func rateTable(rates exchangeRates) RateTable {
+	t := RateTable{Base: money.DefaultCurrency, Rates: make(map[string]json.Number, len(rates))}
+	for code, rate := range rates {
+		s := strings.TrimRight(rate.FloatString(maxRateScale), "0")
+		t.Rates[code] = json.Number(strings.TrimSuffix(s, "."))
+	}
+	return t
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errVersionConflict = errors.New("product was modified since it was read; fetch it again and retry")
+
+// etag renders a version as a strong entity tag.
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// etagMatches evaluates an If-Match header against the current version. An
+// absent header matches anything, as does "*". Weak tags never match, as
+// If-Match requires strong comparison.
+func etagMatches(ifMatch string, version int) bool {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+	current := etag(version)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(tag) == current {
+			return true
+		}
+	}
+	return false
+}
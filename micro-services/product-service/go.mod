@@ -8,6 +8,9 @@ require (
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
 	github.com/opensearch-project/opensearch-go v1.1.0
+	mallhive/shared v0.0.0
 )
 
 require github.com/stretchr/testify v1.9.0 // indirect
+
+replace mallhive/shared => ../shared
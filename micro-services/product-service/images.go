@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Upload limits. maxImagePixels guards against small files that decode to
+// huge bitmaps.
+const (
+	defaultMaxImageBytes = 10 << 20
+	maxImagePixels       = 40_000_000
+	maxGalleryImages     = 30
+)
+
+// thumbnailSizes bounds the longer edge of each generated rendition, largest
+// first so each one is scaled from the previous.
+var thumbnailSizes = []struct {
+	name string
+	edge int
+}{
+	{"large", 1200},
+	{"medium", 600},
+	{"small", 200},
+}
+
+// imageTypes maps the accepted content types to their file extension.
+var imageTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+// ProductImage is one picture in a product's gallery. The first image is
+// the product's primary image_url.
+type ProductImage struct {
+	ID          int               `json:"id"`
+	ProductID   int               `json:"product_id"`
+	Position    int               `json:"position"`
+	URL         string            `json:"url"`
+	Thumbnails  map[string]string `json:"thumbnails"`
+	ContentType string            `json:"content_type"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	SizeBytes   int64             `json:"size_bytes"`
+	Alt         string            `json:"alt"`
+	CreatedAt   time.Time         `json:"created_at"`
+
+	keyPrefix string
+	ext       string
+}
+
+var (
+	errImageTooLarge    = errors.New("image too large")
+	errImageType        = errors.New("image must be JPEG, PNG or GIF")
+	errGalleryFull      = fmt.Errorf("a product can have at most %d images", maxGalleryImages)
+	errGalleryOrder     = errors.New("order must list every image of the product exactly once")
+	errMissingImageFile = errors.New("missing file part")
+)
+
+const imageSelect = `
+    SELECT id, product_id, position, key_prefix, ext, content_type, width, height, size_bytes, alt, created_at
+    FROM product_images`
+
+func scanImage(row rowScanner) (ProductImage, error) {
+	var img ProductImage
+	err := row.Scan(&img.ID, &img.ProductID, &img.Position, &img.keyPrefix, &img.ext, &img.ContentType,
+		&img.Width, &img.Height, &img.SizeBytes, &img.Alt, &img.CreatedAt)
+	if err != nil {
+		return img, err
+	}
+	img.URL = imageStore.URL(img.originalKey())
+	img.Thumbnails = make(map[string]string, len(thumbnailSizes))
+	for _, size := range thumbnailSizes {
+		img.Thumbnails[size.name] = imageStore.URL(img.thumbnailKey(size.name))
+	}
+	return img, nil
+}
+
+func (img ProductImage) originalKey() string {
+	return img.keyPrefix + "/original." + img.ext
+}
+
+// thumbnailKey names a rendition. GIFs are thumbnailed as PNG.
+func (img ProductImage) thumbnailKey(size string) string {
+	ext := img.ext
+	if ext == "gif" {
+		ext = "png"
+	}
+	return img.keyPrefix + "/" + size + "." + ext
+}
+
+func (img ProductImage) keys() []string {
+	keys := []string{img.originalKey()}
+	for _, size := range thumbnailSizes {
+		keys = append(keys, img.thumbnailKey(size.name))
+	}
+	return keys
+}
+
+func maxImageBytes() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("IMAGE_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return defaultMaxImageBytes
+}
+
+func getProductImages(q querier, productID int) ([]ProductImage, error) {
+	rows, err := q.Query(imageSelect+" WHERE product_id = $1 ORDER BY position", productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []ProductImage{}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
+// productImagesHandler lists a product's gallery in order and accepts new
+// images as multipart/form-data with a "file" part and an optional "alt".
+func productImagesHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	if !productExists(w, productID) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		images, err := getProductImages(db, productID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(images)
+
+	case http.MethodPost:
+		data, alt, err := readImageUpload(w, r)
+		switch {
+		case errors.Is(err, errImageTooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		img, err := addProductImage(r.Context(), productID, data, alt)
+		switch {
+		case errors.Is(err, errImageType), errors.Is(err, errImageTooLarge):
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		case err == errGalleryFull:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			log.Println("❌ Image upload failed:", err)
+			http.Error(w, "Image upload failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(img)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// readImageUpload streams the multipart body and returns the file part,
+// refusing anything over the configured size.
+func readImageUpload(w http.ResponseWriter, r *http.Request) ([]byte, string, error) {
+	limit := maxImageBytes()
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20) // room for the other parts
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", errors.New("expected multipart/form-data")
+	}
+
+	var data []byte
+	var alt string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, "", errImageTooLarge
+		} else if err != nil {
+			return nil, "", errors.New("invalid multipart body")
+		}
+
+		switch part.FormName() {
+		case "file":
+			data, err = io.ReadAll(io.LimitReader(part, limit+1))
+			if err == nil && int64(len(data)) > limit {
+				err = errImageTooLarge
+			}
+		case "alt":
+			var b []byte
+			b, err = io.ReadAll(io.LimitReader(part, 1024))
+			alt = string(b)
+		}
+		part.Close()
+		if errors.As(err, &maxErr) || err == errImageTooLarge {
+			return nil, "", errImageTooLarge
+		} else if err != nil {
+			return nil, "", errors.New("invalid multipart body")
+		}
+	}
+	if data == nil {
+		return nil, "", errMissingImageFile
+	}
+	return data, alt, nil
+}
+
+// addProductImage validates data, stores it with its thumbnails and appends
+// it to the gallery. Stored files are removed again if the row cannot be
+// written.
+func addProductImage(ctx context.Context, productID int, data []byte, alt string) (ProductImage, error) {
+	var img ProductImage
+
+	// The content is sniffed; the client's declared type is not trusted
+	contentType := http.DetectContentType(data)
+	ext, ok := imageTypes[contentType]
+	if !ok {
+		return img, errImageType
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return img, errImageType
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return img, fmt.Errorf("%w: at most %d pixels", errImageTooLarge, maxImagePixels)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return img, errImageType
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return img, err
+	}
+	img = ProductImage{
+		ProductID:   productID,
+		ContentType: contentType,
+		Width:       cfg.Width,
+		Height:      cfg.Height,
+		SizeBytes:   int64(len(data)),
+		Alt:         alt,
+		keyPrefix:   fmt.Sprintf("products/%d/%s", productID, hex.EncodeToString(token)),
+		ext:         ext,
+	}
+
+	stored := []string{}
+	cleanup := func() {
+		for _, key := range stored {
+			if err := imageStore.Delete(context.Background(), key); err != nil {
+				log.Printf("❌ Failed to remove %s: %v", key, err)
+			}
+		}
+	}
+	if err := imageStore.Put(ctx, img.originalKey(), contentType, bytes.NewReader(data)); err != nil {
+		return img, err
+	}
+	stored = append(stored, img.originalKey())
+
+	scaled := src
+	for _, size := range thumbnailSizes {
+		scaled = shrink(scaled, size.edge)
+		var buf bytes.Buffer
+		thumbType := "image/png"
+		if ext == "jpg" {
+			thumbType = "image/jpeg"
+			err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 85})
+		} else {
+			err = png.Encode(&buf, scaled)
+		}
+		if err == nil {
+			err = imageStore.Put(ctx, img.thumbnailKey(size.name), thumbType, &buf)
+		}
+		if err != nil {
+			cleanup()
+			return img, err
+		}
+		stored = append(stored, img.thumbnailKey(size.name))
+	}
+
+	img, err = insertProductImage(img)
+	if err != nil {
+		cleanup()
+	}
+	return img, err
+}
+
+func insertProductImage(img ProductImage) (ProductImage, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return img, err
+	}
+	defer tx.Rollback()
+
+	// The product row serialises gallery changes for the product
+	if _, err := tx.Exec("SELECT 1 FROM products WHERE id = $1 FOR UPDATE", img.ProductID); err != nil {
+		return img, err
+	}
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM product_images WHERE product_id = $1", img.ProductID).Scan(&count); err != nil {
+		return img, err
+	}
+	if count >= maxGalleryImages {
+		return img, errGalleryFull
+	}
+
+	created, err := scanImage(tx.QueryRow(`
+        INSERT INTO product_images (product_id, position, key_prefix, ext, content_type, width, height, size_bytes, alt)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        RETURNING id, product_id, position, key_prefix, ext, content_type, width, height, size_bytes, alt, created_at
+    `, img.ProductID, count, img.keyPrefix, img.ext, img.ContentType, img.Width, img.Height, img.SizeBytes, img.Alt))
+	if err != nil {
+		return img, err
+	}
+	if err := syncPrimaryImage(tx, img.ProductID); err != nil {
+		return img, err
+	}
+	return created, tx.Commit()
+}
+
+// productImageItemHandler reads or deletes one image.
+func productImageItemHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	imageID, err := strconv.Atoi(r.PathValue("image_id"))
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		img, err := scanImage(db.QueryRow(imageSelect+" WHERE id = $1 AND product_id = $2", imageID, productID))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(img)
+
+	case http.MethodDelete:
+		img, err := deleteProductImage(productID, imageID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database delete failed", http.StatusInternalServerError)
+			return
+		}
+		// Files go once the row is gone; a leftover file is harmless
+		for _, key := range img.keys() {
+			if err := imageStore.Delete(r.Context(), key); err != nil {
+				log.Printf("❌ Failed to remove %s: %v", key, err)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func deleteProductImage(productID, imageID int) (ProductImage, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return ProductImage{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT 1 FROM products WHERE id = $1 FOR UPDATE", productID); err != nil {
+		return ProductImage{}, err
+	}
+	img, err := scanImage(tx.QueryRow(`
+        DELETE FROM product_images WHERE id = $1 AND product_id = $2
+        RETURNING id, product_id, position, key_prefix, ext, content_type, width, height, size_bytes, alt, created_at
+    `, imageID, productID))
+	if err != nil {
+		return img, err
+	}
+	if _, err := tx.Exec(
+		"UPDATE product_images SET position = position - 1 WHERE product_id = $1 AND position > $2",
+		productID, img.Position,
+	); err != nil {
+		return img, err
+	}
+	if err := syncPrimaryImage(tx, productID); err != nil {
+		return img, err
+	}
+	return img, tx.Commit()
+}
+
+// productImageOrderHandler serves PUT /products/{id}/images/order with the
+// image ids in their new order.
+func productImageOrderHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var order []int
+	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	images, err := reorderProductImages(productID, order)
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Product not found", http.StatusNotFound)
+	case err == errGalleryOrder:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(images)
+	}
+}
+
+func reorderProductImages(productID int, order []int) ([]ProductImage, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var one int
+	if err := tx.QueryRow("SELECT 1 FROM products WHERE id = $1 FOR UPDATE", productID).Scan(&one); err != nil {
+		return nil, err
+	}
+	images, err := getProductImages(tx, productID)
+	if err != nil {
+		return nil, err
+	}
+	current := make([]int, len(images))
+	for i, img := range images {
+		current[i] = img.ID
+	}
+	wanted := slices.Clone(order)
+	slices.Sort(current)
+	slices.Sort(wanted)
+	if !slices.Equal(current, wanted) {
+		return nil, errGalleryOrder
+	}
+
+	for i, id := range order {
+		if _, err := tx.Exec("UPDATE product_images SET position = $1 WHERE id = $2", i, id); err != nil {
+			return nil, err
+		}
+	}
+	if err := syncPrimaryImage(tx, productID); err != nil {
+		return nil, err
+	}
+	if images, err = getProductImages(tx, productID); err != nil {
+		return nil, err
+	}
+	return images, tx.Commit()
+}
+
+// syncPrimaryImage points the product's image_url at the first gallery
+// image and queues the product for reindexing. A product whose gallery is
+// empty keeps whatever image_url it was given directly.
+func syncPrimaryImage(tx *sql.Tx, productID int) error {
+	img, err := scanImage(tx.QueryRow(imageSelect+" WHERE product_id = $1 AND position = 0", productID))
+	if err == nil {
+		_, err = tx.Exec("UPDATE products SET imageURL = $1, version = version + 1 WHERE id = $2 AND imageURL IS DISTINCT FROM $1", img.URL, productID)
+	} else if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return enqueueProductRefresh(tx, productID)
+}
+
+// shrink scales src down so neither edge exceeds edge, averaging the source
+// pixels behind each target pixel. Smaller images are returned unchanged.
+func shrink(src image.Image, edge int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= edge && h <= edge {
+		return src
+	}
+	tw, th := edge, edge
+	if w > h {
+		th = max(1, h*edge/w)
+	} else {
+		tw = max(1, w*edge/h)
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"mallhive/shared/money"
+)
+
+const (
+	maxImportBytes  = 100 << 20
+	maxImportErrors = 1000
+	maxJSONLLine    = 1 << 20
+)
+
+// catalogColumns is the CSV layout used by export and understood by import.
+var catalogColumns = []string{
+	"id", "slug", "name", "description", "category", "price", "currency", "available", "image_url", "stock_quantity",
+}
+
+// ImportRowError reports why one input row was skipped.
+type ImportRowError struct {
+	Line  int    `json:"line"`
+	Slug  string `json:"slug,omitempty"`
+	Error string `json:"error"`
+}
+
+type ImportReport struct {
+	Format  string           `json:"format"`
+	DryRun  bool             `json:"dry_run"`
+	Rows    int              `json:"rows"`
+	Created int              `json:"created"`
+	Updated int              `json:"updated"`
+	Failed  int              `json:"failed"`
+	Errors  []ImportRowError `json:"errors"`
+}
+
+func (r *ImportReport) fail(line int, slug string, err error) {
+	r.Failed++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, ImportRowError{Line: line, Slug: slug, Error: err.Error()})
+	}
+}
+
+// rowError marks a problem confined to a single input row.
+type rowError struct{ msg string }
+
+func (e *rowError) Error() string { return e.msg }
+
+// importSource yields one patch per input row and io.EOF at the end.
+type importSource interface {
+	next() (patch ProductPatch, line int, err error)
+}
+
+type csvSource struct {
+	r       *csv.Reader
+	columns []string
+}
+
+func newCSVSource(body io.Reader) (*csvSource, error) {
+	r := csv.NewReader(body)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV header: %w", err)
+	}
+
+	known := map[string]bool{"category_id": true}
+	for _, col := range catalogColumns {
+		known[col] = true
+	}
+	columns := make([]string, len(header))
+	for i, col := range header {
+		col = strings.ToLower(strings.TrimSpace(col))
+		if !known[col] {
+			return nil, fmt.Errorf("unknown CSV column %q", col)
+		}
+		columns[i] = col
+	}
+	return &csvSource{r: r, columns: columns}, nil
+}
+
+func (s *csvSource) next() (ProductPatch, int, error) {
+	var patch ProductPatch
+	record, err := s.r.Read()
+	if err == io.EOF {
+		return patch, 0, err
+	}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount {
+		return patch, parseErr.Line, &rowError{"wrong number of fields"}
+	} else if err != nil {
+		return patch, 0, err
+	}
+	line, _ := s.r.FieldPos(0)
+
+	// Empty cells leave the field unset so updates keep the stored value
+	var price, currency string
+	for i, col := range s.columns {
+		v := record[i]
+		if v == "" {
+			continue
+		}
+		switch col {
+		case "name":
+			patch.Name = &v
+		case "slug":
+			patch.Slug = &v
+		case "description":
+			patch.Description = &v
+		case "category":
+			patch.Category = &v
+		case "image_url":
+			patch.ImageURL = &v
+		case "category_id":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return patch, line, &rowError{"invalid category_id"}
+			}
+			patch.CategoryID = &n
+		case "price":
+			price = v
+		case "currency":
+			currency = v
+		case "available":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return patch, line, &rowError{"invalid available"}
+			}
+			patch.Available = &b
+		case "stock_quantity":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return patch, line, &rowError{"invalid stock_quantity"}
+			}
+			patch.StockQuantity = &n
+		}
+	}
+
+	// A price without a currency is in the product's base currency
+	if currency != "" && price == "" {
+		return patch, line, &rowError{"currency needs a price"}
+	}
+	if price != "" {
+		m, err := money.Parse(price, currency)
+		if err != nil {
+			return patch, line, &rowError{"invalid price or currency"}
+		}
+		patch.Price = &m
+	}
+	return patch, line, nil
+}
+
+type jsonlSource struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newJSONLSource(body io.Reader) *jsonlSource {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxJSONLLine)
+	return &jsonlSource{scanner: scanner}
+}
+
+func (s *jsonlSource) next() (ProductPatch, int, error) {
+	var patch ProductPatch
+	for s.scanner.Scan() {
+		s.line++
+		text := strings.TrimSpace(s.scanner.Text())
+		if text == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(text), &patch); err != nil {
+			return patch, s.line, &rowError{"invalid JSON: " + err.Error()}
+		}
+		return patch, s.line, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return patch, s.line + 1, err
+	}
+	return patch, 0, io.EOF
+}
+
+// catalogFormat picks csv or jsonl from ?format= or the Content-Type header.
+func catalogFormat(r *http.Request) string {
+	if f := strings.ToLower(r.URL.Query().Get("format")); f != "" {
+		return f
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return "csv"
+	case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+		return "jsonl"
+	}
+	return ""
+}
+
+// importHandler serves POST /products/import?format=csv|jsonl&dry_run=true.
+// Rows are upserted by slug; a bad row is reported and skipped without
+// affecting the others. A dry run validates everything and writes nothing.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	report := ImportReport{Format: catalogFormat(r), DryRun: dryRun, Errors: []ImportRowError{}}
+	var src importSource
+	switch report.Format {
+	case "csv":
+		s, err := newCSVSource(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		src = s
+	case "jsonl":
+		src = newJSONLSource(body)
+	default:
+		http.Error(w, "Unsupported format, use csv or jsonl", http.StatusBadRequest)
+		return
+	}
+
+	if err := importProducts(src, &report, requestActor(r)); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Import too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Println("❌ Import failed:", err)
+		http.Error(w, "Import failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("📦 Imported %d rows (%d created, %d updated, %d failed, dry run %t)\n",
+		report.Rows, report.Created, report.Updated, report.Failed, report.DryRun)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// importProducts streams src into one transaction, isolating each row in a
+// savepoint. Index and sync events ride the outbox, which the relay delivers
+// to OpenSearch in bulk batches once the import commits.
+func importProducts(src importSource, report *ImportReport, actor string) error {
+	categories, err := loadCategorySlugs()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for {
+		patch, line, err := src.next()
+		if err == io.EOF {
+			break
+		}
+		var rowErr *rowError
+		if errors.As(err, &rowErr) {
+			report.Rows++
+			report.fail(line, "", err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		report.Rows++
+
+		slug, created, err := upsertImportRow(tx, patch, categories, actor)
+		switch {
+		case err != nil:
+			report.fail(line, slug, err)
+		case created:
+			report.Created++
+		default:
+			report.Updated++
+		}
+	}
+
+	if report.DryRun {
+		return nil
+	}
+	return tx.Commit()
+}
+
+// upsertImportRow applies patch to the product with the row's slug, creating
+// it when absent. It reports the slug used and whether a product was created.
+func upsertImportRow(tx *sql.Tx, patch ProductPatch, categories map[string]int, actor string) (string, bool, error) {
+	var slug string
+	switch {
+	case patch.Slug != nil:
+		slug = slugify(*patch.Slug)
+	case patch.Name != nil:
+		slug = slugify(*patch.Name)
+	}
+	if slug == "" {
+		return "", false, errors.New("row needs a slug or name")
+	}
+
+	if _, err := tx.Exec("SAVEPOINT import_row"); err != nil {
+		return slug, false, err
+	}
+	created, err := applyImportRow(tx, slug, patch, categories, actor)
+	if err != nil {
+		if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT import_row"); rbErr != nil {
+			return slug, false, rbErr
+		}
+		return slug, false, describeImportError(err)
+	}
+	_, err = tx.Exec("RELEASE SAVEPOINT import_row")
+	return slug, created, err
+}
+
+func applyImportRow(tx *sql.Tx, slug string, patch ProductPatch, categories map[string]int, actor string) (bool, error) {
+	p, err := scanProduct(tx.QueryRow(productSelect+" WHERE p.slug = $1 FOR UPDATE OF p", slug))
+	created := err == sql.ErrNoRows
+	if created {
+		p = Product{Available: true, LowStockThreshold: defaultLowStockThreshold}
+	} else if err != nil {
+		return false, err
+	}
+	patch.apply(&p)
+	p.Slug = slug
+
+	if err := validateProduct(p); err != nil {
+		return false, err
+	}
+	if p.CategoryID == 0 {
+		id, ok := categories[p.Category]
+		if !ok {
+			if p.Category == "" {
+				return false, errMissingCategory
+			}
+			return false, errCategoryNotFound
+		}
+		p.CategoryID = id
+	} else if err := resolveCategory(&p); err != nil {
+		return false, err
+	}
+
+	if created {
+		return true, insertProductRow(tx, &p, actor)
+	}
+	return false, updateProductRow(tx, &p, actor)
+}
+
+func describeImportError(err error) error {
+	switch {
+	case isUniqueViolation(err):
+		return errors.New("name already used by another product")
+	case isCheckViolation(err):
+		return errors.New("stock_quantity below reserved units")
+	}
+	return err
+}
+
+func loadCategorySlugs() (map[string]int, error) {
+	rows, err := db.Query("SELECT id, slug FROM categories")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	slugs := map[string]int{}
+	for rows.Next() {
+		var id int
+		var slug string
+		if err := rows.Scan(&id, &slug); err != nil {
+			return nil, err
+		}
+		slugs[slug] = id
+	}
+	return slugs, rows.Err()
+}
+
+// exportHandler streams the whole catalog as GET /products/export?format=csv|jsonl.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := catalogFormat(r)
+	if format == "" {
+		format = "jsonl"
+	}
+	if format != "csv" && format != "jsonl" {
+		http.Error(w, "Unsupported format, use csv or jsonl", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(productSelect+" WHERE p.status <> $1 ORDER BY p.id", ProductDeleted)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="products.%s"`, format))
+
+	flusher, _ := w.(http.Flusher)
+	csvWriter := csv.NewWriter(w)
+	encoder := json.NewEncoder(w)
+	if format == "csv" {
+		csvWriter.Write(catalogColumns)
+	}
+
+	// Headers are gone once streaming starts, so failures can only be logged
+	for n := 1; rows.Next(); n++ {
+		p, err := scanProduct(rows)
+		if err != nil {
+			log.Println("❌ Export scan error:", err)
+			return
+		}
+		if format == "csv" {
+			err = csvWriter.Write([]string{
+				strconv.Itoa(p.ID), p.Slug, p.Name, p.Description, p.Category,
+				p.Price.Decimal(), p.BaseCurrency, strconv.FormatBool(p.Available),
+				p.ImageURL, strconv.Itoa(p.StockQuantity),
+			})
+		} else {
+			err = encoder.Encode(p)
+		}
+		if err != nil {
+			log.Println("❌ Export write error:", err)
+			return
+		}
+		if n%500 == 0 {
+			csvWriter.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	csvWriter.Flush()
+	if err := rows.Err(); err != nil {
+		log.Println("❌ Export read error:", err)
+	}
+}
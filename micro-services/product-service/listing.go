@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// ProductPage is the envelope returned by GET /products.
+type ProductPage struct {
+	Items      []Product `json:"items"`
+	Total      int       `json:"total"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// productSort describes one ?sort= option. column is also the keyset the
+// cursor resumes from, with p.id as the tie-breaker.
+type productSort struct {
+	column string
+	desc   bool
+	value  func(Product) string
+}
+
+// pivotPrice is what a shopper pays now, normalised to DefaultCurrency so
+// products in different currencies sort and filter together. The fixed scale
+// lets a cursor carry the exact value back.
+const pivotPrice = "ROUND(COALESCE(p.sale_price, p.price) / COALESCE(r.rate, 1), 6)"
+
+var productSorts = map[string]productSort{
+	"newest":  {"p.id", true, func(p Product) string { return strconv.Itoa(p.ID) }},
+	"price":   {pivotPrice, false, func(p Product) string { return p.pivotPrice }},
+	"-price":  {pivotPrice, true, func(p Product) string { return p.pivotPrice }},
+	"name":    {"p.name", false, func(p Product) string { return p.Name }},
+	"-name":   {"p.name", true, func(p Product) string { return p.Name }},
+	"rating":  {"p.rating_average", false, func(p Product) string { return formatRating(p.RatingAverage) }},
+	"-rating": {"p.rating_average", true, func(p Product) string { return formatRating(p.RatingAverage) }},
+}
+
+// pageCursor is the position after the last row of a page.
+type pageCursor struct {
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+func (c pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// productQuery is a parsed GET /products request.
+type productQuery struct {
+	where  []string
+	args   []any
+	sort   productSort
+	limit  int
+	offset int
+	cursor *pageCursor
+}
+
+func (q *productQuery) filter(cond string, arg any) {
+	q.args = append(q.args, arg)
+	q.where = append(q.where, fmt.Sprintf(cond, len(q.args)))
+}
+
+func (q *productQuery) whereClause() string {
+	if len(q.where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.where, " AND ")
+}
+
+// parseProductQuery understands status (active unless given), category,
+// available, in_stock, stock_state, min_price, max_price, attr.* filters, q, sort, limit, offset and cursor. Price bounds are read in the
+// currency of view.
+func parseProductQuery(v url.Values, view priceView) (*productQuery, error) {
+	q := &productQuery{limit: defaultPageSize}
+
+	status := v.Get("status")
+	if status == "" {
+		status = ProductActive
+	}
+	if !validProductStatus(status) {
+		return nil, errProductStatus
+	}
+	q.filter("p.status = $%d", status)
+
+	if s := v.Get("category"); s != "" {
+		q.filter("c.slug = $%d", s)
+	}
+	if s := v.Get("available"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid available")
+		}
+		q.filter("p.available = $%d", b)
+	}
+	if s := v.Get("in_stock"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid in_stock")
+		}
+		q.filter("(COALESCE(i.quantity, 0) > 0) = $%d", b)
+	}
+	if s := v.Get("stock_state"); s != "" {
+		switch s {
+		case StockInStock, StockLow, StockOutOfStock:
+		default:
+			return nil, fmt.Errorf("invalid stock_state")
+		}
+		q.filter("COALESCE(i.stock_state, 'out_of_stock') = $%d", s)
+	}
+	if s := v.Get("min_price"); s != "" {
+		bound, err := view.pivotBound(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min_price")
+		}
+		q.filter(pivotPrice+" >= $%d", bound)
+	}
+	if s := v.Get("max_price"); s != "" {
+		bound, err := view.pivotBound(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_price")
+		}
+		q.filter(pivotPrice+" <= $%d", bound)
+	}
+	if err := filterAttributes(q, v); err != nil {
+		return nil, err
+	}
+	if s := strings.TrimSpace(v.Get("q")); s != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+		q.filter("p.name ILIKE '%%' || $%d || '%%'", escaped)
+	}
+
+	sortKey := v.Get("sort")
+	if sortKey == "" {
+		sortKey = "newest"
+	}
+	sort, ok := productSorts[sortKey]
+	if !ok {
+		return nil, fmt.Errorf("invalid sort")
+	}
+	q.sort = sort
+
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid limit")
+		}
+		q.limit = min(n, maxPageSize)
+	}
+	if s := v.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid offset")
+		}
+		q.offset = n
+	}
+	if s := v.Get("cursor"); s != "" {
+		c, err := decodeCursor(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		q.cursor = &c
+	}
+	return q, nil
+}
+
+func listProducts(w http.ResponseWriter, r *http.Request) {
+	view, err := newPriceView(r)
+	if err != nil {
+		writeCurrencyError(w, err)
+		return
+	}
+	q, err := parseProductQuery(r.URL.Query(), view)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var page ProductPage
+	if err := db.QueryRow("SELECT COUNT(*)"+productFrom+q.whereClause(), q.args...).Scan(&page.Total); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// The cursor narrows the page but not the total
+	if q.cursor != nil {
+		op := ">"
+		if q.sort.desc {
+			op = "<"
+		}
+		if q.sort.column == "p.id" {
+			q.filter("p.id "+op+" $%d", q.cursor.ID)
+		} else {
+			q.args = append(q.args, q.cursor.Value, q.cursor.ID)
+			q.where = append(q.where, fmt.Sprintf("(%s, p.id) %s ($%d, $%d)",
+				q.sort.column, op, len(q.args)-1, len(q.args)))
+		}
+	}
+
+	dir := "ASC"
+	if q.sort.desc {
+		dir = "DESC"
+	}
+	order := fmt.Sprintf(" ORDER BY %s %s", q.sort.column, dir)
+	if q.sort.column != "p.id" {
+		order += ", p.id " + dir
+	}
+
+	// Fetch one extra row to learn whether another page follows
+	args := append(q.args, q.limit+1, q.offset)
+	rows, err := db.Query(
+		productSelect+q.whereClause()+order+fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args)),
+		args...,
+	)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page.Items = []Product{}
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err := view.product(&p); err != nil {
+			writeCurrencyError(w, err)
+			return
+		}
+		page.Items = append(page.Items, p)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if len(page.Items) > q.limit {
+		page.Items = page.Items[:q.limit]
+		last := page.Items[len(page.Items)-1]
+		page.NextCursor = pageCursor{Value: q.sort.value(last), ID: last.ID}.encode()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
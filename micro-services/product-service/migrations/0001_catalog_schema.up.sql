@@ -0,0 +1,29 @@
+-- Catalog schema as first shipped in init.sql. Tables are created only
+-- when missing, so a database bootstrapped from that script takes this as
+-- applied and picks up every later change from the migrations after it.
+
+-- Create categories table
+CREATE TABLE IF NOT EXISTS categories (
+    id SERIAL PRIMARY KEY,
+    name TEXT UNIQUE NOT NULL,
+    slug TEXT UNIQUE NOT NULL
+);
+
+-- Create products table
+CREATE TABLE IF NOT EXISTS products (
+    id SERIAL PRIMARY KEY,
+    name TEXT UNIQUE NOT NULL,
+    slug TEXT UNIQUE NOT NULL,
+    category_id INTEGER NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+    price DECIMAL(10,2) NOT NULL,
+    available BOOLEAN NOT NULL DEFAULT TRUE,
+    description TEXT,
+    imageURL TEXT
+);
+
+-- Create inventory table
+CREATE TABLE IF NOT EXISTS inventories (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER UNIQUE NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL DEFAULT 0
+);
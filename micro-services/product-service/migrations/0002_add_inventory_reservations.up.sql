@@ -0,0 +1,22 @@
+-- Units held by open reservations; the rest of quantity is free to sell
+ALTER TABLE inventories
+    ADD COLUMN IF NOT EXISTS reserved INTEGER NOT NULL DEFAULT 0 CHECK (reserved >= 0 AND reserved <= quantity);
+
+-- Create stock reservation tables
+CREATE TABLE IF NOT EXISTS reservations (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER UNIQUE NOT NULL,
+    status TEXT NOT NULL DEFAULT 'held',
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS reservations_held_expiry_idx ON reservations (expires_at) WHERE status = 'held';
+
+CREATE TABLE IF NOT EXISTS reservation_items (
+    id SERIAL PRIMARY KEY,
+    reservation_id INTEGER NOT NULL REFERENCES reservations(id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products(id),
+    quantity INTEGER NOT NULL CHECK (quantity > 0)
+);
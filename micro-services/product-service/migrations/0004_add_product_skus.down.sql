@@ -0,0 +1,3 @@
+ALTER TABLE reservation_items DROP COLUMN IF EXISTS sku_id;
+DROP TABLE IF EXISTS skus;
+DROP TABLE IF EXISTS product_options;
@@ -0,0 +1,25 @@
+-- Create variant tables: option axes per product and one SKU per combination
+CREATE TABLE IF NOT EXISTS product_options (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    choices TEXT[] NOT NULL DEFAULT '{}',
+    position INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (product_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS skus (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    code TEXT UNIQUE NOT NULL,
+    options JSONB NOT NULL DEFAULT '{}',
+    price DECIMAL(10,2),
+    available BOOLEAN NOT NULL DEFAULT TRUE,
+    quantity INTEGER NOT NULL DEFAULT 0,
+    reserved INTEGER NOT NULL DEFAULT 0,
+    CHECK (reserved >= 0 AND reserved <= quantity),
+    UNIQUE (product_id, options)
+);
+
+-- Reservations hold stock of a SKU when one is given
+ALTER TABLE reservation_items ADD COLUMN IF NOT EXISTS sku_id INTEGER REFERENCES skus(id);
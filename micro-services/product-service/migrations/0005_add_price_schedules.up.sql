@@ -0,0 +1,30 @@
+-- Set by the price scheduler while a sale runs
+ALTER TABLE products ADD COLUMN IF NOT EXISTS sale_price DECIMAL(10,2);
+
+-- Create pricing tables: every regular or sale price a product has carried,
+-- and future changes waiting for the scheduler
+CREATE TABLE IF NOT EXISTS price_history (
+    id BIGSERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    price DECIMAL(10,2) NOT NULL,
+    sale_price DECIMAL(10,2),
+    source TEXT NOT NULL,
+    schedule_id INTEGER,
+    changed_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS price_history_product_idx ON price_history (product_id, changed_at);
+
+CREATE TABLE IF NOT EXISTS price_schedules (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL CHECK (kind IN ('change', 'sale')),
+    price DECIMAL(10,2) NOT NULL CHECK (price >= 0),
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP,
+    status TEXT NOT NULL DEFAULT 'scheduled',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CHECK (kind = 'change' OR ends_at > starts_at)
+);
+
+CREATE INDEX IF NOT EXISTS price_schedules_due_idx ON price_schedules (starts_at) WHERE status IN ('scheduled', 'active');
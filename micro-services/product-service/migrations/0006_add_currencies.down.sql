@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS exchange_rates;
+ALTER TABLE price_schedules DROP COLUMN IF EXISTS currency;
+ALTER TABLE price_history DROP COLUMN IF EXISTS currency;
+ALTER TABLE products DROP COLUMN IF EXISTS currency;
@@ -0,0 +1,25 @@
+-- Base currency of every price of a product; prices so far were in USD
+ALTER TABLE products ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'USD';
+
+-- Recorded and scheduled prices carry the currency they are in. The
+-- default only fills existing rows.
+ALTER TABLE price_history ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'USD';
+ALTER TABLE price_history ALTER COLUMN currency DROP DEFAULT;
+ALTER TABLE price_schedules ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'USD';
+ALTER TABLE price_schedules ALTER COLUMN currency DROP DEFAULT;
+
+-- Create exchange rate table: units of each currency per one USD, the
+-- pivot every conversion goes through
+CREATE TABLE IF NOT EXISTS exchange_rates (
+    currency TEXT PRIMARY KEY,
+    rate NUMERIC(20,10) NOT NULL CHECK (rate > 0),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Insert the pivot rate
+INSERT INTO exchange_rates (currency, rate) VALUES ('USD', 1) ON CONFLICT (currency) DO NOTHING;
+
+-- Record the opening prices of products that have none
+INSERT INTO price_history (product_id, price, currency, source)
+SELECT p.id, p.price, p.currency, 'initial' FROM products p
+WHERE NOT EXISTS (SELECT 1 FROM price_history h WHERE h.product_id = p.id);
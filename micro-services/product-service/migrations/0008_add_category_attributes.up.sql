@@ -0,0 +1,16 @@
+-- Create attribute schema table: the typed attributes products of a
+-- category carry, e.g. brand or screen_size
+CREATE TABLE IF NOT EXISTS category_attributes (
+    id SERIAL PRIMARY KEY,
+    category_id INTEGER NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    type TEXT NOT NULL CHECK (type IN ('text', 'enum', 'number', 'boolean')),
+    required BOOLEAN NOT NULL DEFAULT FALSE,
+    choices TEXT[] NOT NULL DEFAULT '{}',
+    unit TEXT NOT NULL DEFAULT '',
+    position INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (category_id, name)
+);
+
+-- Typed by the category's attribute schema
+ALTER TABLE products ADD COLUMN IF NOT EXISTS attributes JSONB NOT NULL DEFAULT '{}';
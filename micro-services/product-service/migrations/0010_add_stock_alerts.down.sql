@@ -0,0 +1,4 @@
+ALTER TABLE inventories
+    DROP COLUMN IF EXISTS disabled_by_stock,
+    DROP COLUMN IF EXISTS stock_state,
+    DROP COLUMN IF EXISTS low_stock_threshold;
@@ -0,0 +1,13 @@
+-- Last stock state alerted on; disabled_by_stock marks products taken off
+-- sale at zero
+ALTER TABLE inventories
+    ADD COLUMN IF NOT EXISTS low_stock_threshold INTEGER NOT NULL DEFAULT 5 CHECK (low_stock_threshold >= 0),
+    ADD COLUMN IF NOT EXISTS stock_state TEXT NOT NULL DEFAULT 'in_stock' CHECK (stock_state IN ('in_stock', 'low_stock', 'out_of_stock')),
+    ADD COLUMN IF NOT EXISTS disabled_by_stock BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Start existing stock in the state its quantity implies, without alerts
+UPDATE inventories SET stock_state = CASE
+    WHEN quantity = 0 THEN 'out_of_stock'
+    WHEN quantity < low_stock_threshold THEN 'low_stock'
+    ELSE 'in_stock'
+END;
@@ -0,0 +1,19 @@
+-- Products are archived or soft-deleted, never removed, so orders keep
+-- resolving them
+ALTER TABLE products
+    ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'archived', 'deleted'));
+
+-- Create audit log: who changed which product field from what to what.
+-- No foreign key, the trail must outlive the product.
+CREATE TABLE IF NOT EXISTS product_audit (
+    id BIGSERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL CHECK (action IN ('created', 'updated', 'archived', 'deleted', 'restored')),
+    field TEXT, -- NULL for the creation snapshot
+    old_value JSONB,
+    new_value JSONB,
+    changed_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS product_audit_product_idx ON product_audit (product_id, changed_at);
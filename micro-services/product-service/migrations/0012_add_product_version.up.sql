@@ -0,0 +1,2 @@
+-- Bumped on every write to the product, served as the ETag
+ALTER TABLE products ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
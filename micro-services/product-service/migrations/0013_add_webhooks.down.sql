@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS webhook_deliveries;
+ALTER TABLE outbox DROP COLUMN IF EXISTS subscription_id;
+DROP TABLE IF EXISTS webhook_subscriptions;
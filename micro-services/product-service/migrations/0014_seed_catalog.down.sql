@@ -0,0 +1,9 @@
+-- Remove the sample products, then any sample category left empty
+DELETE FROM products WHERE slug IN (
+    'iphone-15', 'nike-shoes', 'dell-laptop', 'wooden-dining-table',
+    'laptop', 'smartphone', 't-shirt', 'fiction-book'
+);
+
+DELETE FROM categories c
+WHERE c.slug IN ('electronics', 'clothing', 'books', 'furniture', 'fashion')
+  AND NOT EXISTS (SELECT 1 FROM products p WHERE p.category_id = c.id);
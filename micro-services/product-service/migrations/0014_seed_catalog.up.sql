@@ -0,0 +1,39 @@
+-- Sample catalog for development. Rows that already exist are left alone.
+
+-- Insert categories (with slugs)
+INSERT INTO categories (name, slug) VALUES
+('Electronics', 'electronics'),
+('Clothing', 'clothing'),
+('Books', 'books'),
+('Furniture', 'furniture'),
+('Fashion', 'fashion')
+ON CONFLICT DO NOTHING;
+
+-- Insert products using category IDs
+INSERT INTO products (name, slug, category_id, price, available, description, imageURL)
+VALUES
+('iPhone 15', 'iphone-15', (SELECT id FROM categories WHERE name = 'Electronics'), 999.99, TRUE, 'Latest Apple iPhone.', 'https://example.com/iphone15.jpg'),
+('Nike Shoes', 'nike-shoes', (SELECT id FROM categories WHERE name = 'Fashion'), 120.00, FALSE, 'Trendy running shoes.', 'https://example.com/nikeshoes.jpg'),
+('Dell Laptop', 'dell-laptop', (SELECT id FROM categories WHERE name = 'Electronics'), 850.50, TRUE, 'High performance laptop.', 'https://example.com/dell.jpg'),
+('Wooden Dining Table', 'wooden-dining-table', (SELECT id FROM categories WHERE name = 'Furniture'), 550.00, FALSE, 'Elegant wood table.', 'https://example.com/diningtable.jpg'),
+('Laptop', 'laptop', (SELECT id FROM categories WHERE name = 'Electronics'), 999.99, TRUE, 'Basic business laptop.', 'https://example.com/laptop.jpg'),
+('Smartphone', 'smartphone', (SELECT id FROM categories WHERE name = 'Electronics'), 699.99, TRUE, 'Android smartphone.', 'https://example.com/smartphone.jpg'),
+('T-Shirt', 't-shirt', (SELECT id FROM categories WHERE name = 'Clothing'), 19.99, TRUE, 'Comfortable cotton shirt.', 'https://example.com/tshirt.jpg'),
+('Fiction Book', 'fiction-book', (SELECT id FROM categories WHERE name = 'Books'), 12.99, FALSE, 'Bestselling fiction novel.', 'https://example.com/book.jpg')
+ON CONFLICT DO NOTHING;
+
+-- Record the opening prices of products that have none
+INSERT INTO price_history (product_id, price, currency, source)
+SELECT p.id, p.price, p.currency, 'initial' FROM products p
+WHERE NOT EXISTS (SELECT 1 FROM price_history h WHERE h.product_id = p.id);
+
+-- Insert inventory (with example stock quantities), starting each in the
+-- state its quantity implies so no alerts fire
+INSERT INTO inventories (product_id, quantity, stock_state)
+SELECT id, quantity, CASE
+    WHEN quantity = 0 THEN 'out_of_stock'
+    WHEN quantity < 5 THEN 'low_stock'
+    ELSE 'in_stock'
+END
+FROM (SELECT id, FLOOR(RANDOM() * 100)::INT AS quantity FROM products) seeded
+ON CONFLICT (product_id) DO NOTHING;
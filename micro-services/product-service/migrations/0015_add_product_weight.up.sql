@@ -0,0 +1,3 @@
+-- Shipping weight of one unit, which the cart's weight-based shipping
+-- rates are charged on. SKUs share their product's weight.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS weight_grams INTEGER NOT NULL DEFAULT 0 CHECK (weight_grams >= 0);
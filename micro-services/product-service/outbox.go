@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Outbox entry status values
+const (
+	OutboxPending   = "pending"
+	OutboxDelivered = "delivered"
+	OutboxDead      = "dead"
+)
+
+// Outbox destinations
+const (
+	DestSearch       = "opensearch"
+	DestNotification = "notification"
+	DestAnalytics    = "analytics"
+	DestWebhook      = "webhook" // one entry per subscription, see webhook.go
+)
+
+// Product event types
+const (
+	EventProductCreated = "product.created"
+	EventProductUpdated = "product.updated"
+	EventProductDeleted = "product.deleted"
+)
+
+const (
+	outboxBatchSize   = 50
+	outboxMaxAttempts = 10
+	outboxBaseBackoff = 5 * time.Second
+	outboxMaxBackoff  = 30 * time.Minute
+
+	// Longer than a batch of deliveries at syncClient's timeout can take
+	outboxClaimLease = 15 * time.Minute
+)
+
+var productDestinations = []string{DestSearch}
+
+var syncClient = &http.Client{Timeout: 10 * time.Second}
+
+type OutboxEntry struct {
+	ID             int64           `json:"id"`
+	AggregateID    int             `json:"aggregate_id"`
+	EventType      string          `json:"event_type"`
+	Destination    string          `json:"destination"`
+	SubscriptionID *int            `json:"subscription_id,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"last_error,omitempty"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// enqueueProductEvent records event for the search index and every webhook
+// subscribed to it. It must run inside the transaction that changes the
+// product.
+func enqueueProductEvent(tx execer, event string, p Product) error {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	for _, dest := range productDestinations {
+		if _, err := tx.Exec(`
+            INSERT INTO outbox (aggregate_id, event_type, destination, payload)
+            VALUES ($1, $2, $3, $4)
+        `, p.ID, event, dest, payload); err != nil {
+			return err
+		}
+	}
+	return enqueueWebhookEvent(tx, event, p.ID, p)
+}
+
+// enqueueProductRefresh queues an update event carrying the product as tx
+// currently sees it, for changes made outside the products row itself.
+func enqueueProductRefresh(tx *sql.Tx, productID int) error {
+	p, err := scanProduct(tx.QueryRow(productSelect+" WHERE p.id = $1", productID))
+	if err != nil {
+		return err
+	}
+	return enqueueProductEvent(tx, EventProductUpdated, p)
+}
+
+// runOutboxRelay drains due outbox entries every interval.
+func runOutboxRelay(interval time.Duration) {
+	for range time.Tick(interval) {
+		for {
+			n, err := relayOutboxBatch()
+			if err != nil {
+				log.Println("❌ Outbox relay error:", err)
+				break
+			}
+			if n < outboxBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// relayOutboxBatch delivers up to outboxBatchSize due entries. The batch is
+// claimed and committed first, and delivered with no transaction or row
+// lock held; each outcome is recorded afterwards.
+func relayOutboxBatch() (int, error) {
+	entries, err := claimOutboxBatch()
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	// Search entries go out as a single bulk request, the rest one by one
+	results := make(map[int64]error, len(entries))
+	var search []OutboxEntry
+	for _, e := range entries {
+		if e.Destination == DestSearch {
+			search = append(search, e)
+			continue
+		}
+		results[e.ID] = deliverOutboxEntry(e)
+	}
+	for id, err := range deliverSearchBatch(search) {
+		results[id] = err
+	}
+
+	var recordErr error
+	for _, e := range entries {
+		if err := recordOutboxResult(e, results[e.ID]); err != nil {
+			// The entry is retried once its claim runs out
+			log.Printf("❌ Failed to record outbox entry %d: %v", e.ID, err)
+			recordErr = err
+		}
+	}
+	return len(entries), recordErr
+}
+
+// claimOutboxBatch claims up to outboxBatchSize due entries by moving their
+// next attempt outboxClaimLease ahead, so other relays skip them while they
+// are delivered; a relay that dies mid-batch leaves them to be retried when
+// the lease runs out. Rows are picked with SKIP LOCKED so several replicas
+// can claim side by side, and an entry waits while an older one for the same
+// product and destination (and subscription, for webhooks) is still pending
+// so deliveries never arrive out of order. Entries for paused subscriptions
+// stay queued until the subscription is resumed.
+func claimOutboxBatch() ([]OutboxEntry, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+        SELECT o.id, o.aggregate_id, o.event_type, o.destination, o.subscription_id,
+               o.payload, o.attempts, o.created_at
+        FROM outbox o
+        LEFT JOIN webhook_subscriptions s ON s.id = o.subscription_id
+        WHERE o.status = $1 AND o.next_attempt_at <= NOW()
+          AND (o.subscription_id IS NULL OR s.active)
+          AND NOT EXISTS (
+              SELECT 1 FROM outbox prev
+              WHERE prev.aggregate_id = o.aggregate_id AND prev.destination = o.destination
+                AND prev.subscription_id IS NOT DISTINCT FROM o.subscription_id
+                AND prev.status = $1 AND prev.id < o.id
+          )
+        ORDER BY o.id
+        LIMIT $2
+        FOR UPDATE OF o SKIP LOCKED
+    `, OutboxPending, outboxBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	var entries []OutboxEntry
+	var ids []int64
+	for rows.Next() {
+		var e OutboxEntry
+		var subscriptionID sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.AggregateID, &e.EventType, &e.Destination, &subscriptionID,
+			&e.Payload, &e.Attempts, &e.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e.SubscriptionID = nullIntPtr(subscriptionID)
+		entries = append(entries, e)
+		ids = append(ids, e.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(entries) == 0 {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`
+        UPDATE outbox SET next_attempt_at = NOW() + $1 * INTERVAL '1 millisecond'
+        WHERE id = ANY($2)
+    `, outboxClaimLease.Milliseconds(), pq.Array(ids)); err != nil {
+		return nil, err
+	}
+	return entries, tx.Commit()
+}
+
+// recordOutboxResult stores the outcome of delivering e. A failed attempt
+// is retried with backoff and dead-lettered after outboxMaxAttempts; an
+// entry whose subscription was paused after it was claimed goes back to the
+// queue without counting an attempt.
+func recordOutboxResult(e OutboxEntry, deliveryErr error) error {
+	var err error
+	switch {
+	case errors.Is(deliveryErr, errSubscriptionPaused):
+		_, err = db.Exec("UPDATE outbox SET next_attempt_at = NOW() WHERE id = $1", e.ID)
+	case deliveryErr != nil:
+		e.Attempts++
+		status := OutboxPending
+		if e.Attempts >= outboxMaxAttempts {
+			status = OutboxDead
+			log.Printf("☠️ Outbox entry %d (%s → %s) moved to dead letter: %v", e.ID, e.EventType, e.Destination, deliveryErr)
+		}
+		_, err = db.Exec(`
+            UPDATE outbox SET status = $1, attempts = $2, last_error = $3,
+                next_attempt_at = NOW() + $4 * INTERVAL '1 millisecond'
+            WHERE id = $5
+        `, status, e.Attempts, deliveryErr.Error(), outboxBackoff(e.Attempts).Milliseconds(), e.ID)
+	default:
+		_, err = db.Exec(`
+            UPDATE outbox SET status = $1, attempts = $2, last_error = NULL, delivered_at = NOW()
+            WHERE id = $3
+        `, OutboxDelivered, e.Attempts+1, e.ID)
+	}
+	return err
+}
+
+// outboxBackoff doubles the wait after every failed attempt.
+func outboxBackoff(attempts int) time.Duration {
+	d := outboxBaseBackoff << (attempts - 1)
+	if d <= 0 || d > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return d
+}
+
+// deliverSearchBatch applies search entries with one bulk request and
+// returns the outcome per entry id. The batch query yields at most one entry
+// per product, so the actions cannot race each other.
+func deliverSearchBatch(entries []OutboxEntry) map[int64]error {
+	out := make(map[int64]error, len(entries))
+	if len(entries) == 0 {
+		return out
+	}
+
+	var buf bytes.Buffer
+	var sent []OutboxEntry
+	for _, e := range entries {
+		if e.EventType == EventProductDeleted || !listedPayload(e.Payload) {
+			fmt.Fprintf(&buf, `{"delete":{"_id":"%d"}}`+"\n", e.AggregateID)
+			sent = append(sent, e)
+			continue
+		}
+		var doc bytes.Buffer
+		if err := json.Compact(&doc, e.Payload); err != nil {
+			out[e.ID] = err
+			continue
+		}
+		fmt.Fprintf(&buf, `{"index":{"_id":"%d"}}`+"\n", e.AggregateID)
+		buf.Write(doc.Bytes())
+		buf.WriteByte('\n')
+		sent = append(sent, e)
+	}
+	if len(sent) == 0 {
+		return out
+	}
+
+	results, err := doBulk(context.Background(), productIndexAlias, buf.Bytes())
+	for i, e := range sent {
+		switch {
+		case err != nil:
+			out[e.ID] = err
+		case i >= len(results):
+			out[e.ID] = fmt.Errorf("no bulk result for product %d", e.AggregateID)
+		case len(results[i].Error) > 0:
+			out[e.ID] = fmt.Errorf("opensearch: %s", results[i].Error)
+		default:
+			out[e.ID] = nil
+		}
+	}
+	if err == nil {
+		log.Printf("✅ Indexed %d outbox entries in OpenSearch\n", len(sent))
+	}
+	return out
+}
+
+// listedPayload reports whether a product event describes a product the
+// catalog lists; archived and deleted products are dropped from search.
+func listedPayload(payload []byte) bool {
+	var p struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return true
+	}
+	return p.Status == "" || p.Status == ProductActive
+}
+
+func deliverOutboxEntry(e OutboxEntry) error {
+	switch e.Destination {
+	case DestWebhook:
+		return deliverWebhook(e)
+	case DestNotification:
+		return notifyStockAlert(e.Payload)
+	case DestAnalytics:
+		return trackStockAlert(e.Payload)
+	default:
+		return fmt.Errorf("unknown destination %q", e.Destination)
+	}
+}
+
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
+
+// outboxHandler lists entries, e.g. GET /outbox?status=dead.
+func outboxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = OutboxDead
+	}
+
+	rows, err := db.Query(`
+        SELECT id, aggregate_id, event_type, destination, subscription_id, payload, status, attempts,
+               COALESCE(last_error, ''), next_attempt_at, created_at
+        FROM outbox WHERE status = $1 ORDER BY id DESC LIMIT 100
+    `, status)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []OutboxEntry{}
+	for rows.Next() {
+		var e OutboxEntry
+		var subscriptionID sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.AggregateID, &e.EventType, &e.Destination, &subscriptionID, &e.Payload,
+			&e.Status, &e.Attempts, &e.LastError, &e.NextAttemptAt, &e.CreatedAt); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		e.SubscriptionID = nullIntPtr(subscriptionID)
+		entries = append(entries, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// outboxRetryHandler puts a dead-lettered entry back in the queue.
+func outboxRetryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid outbox ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res, err := db.Exec(`
+        UPDATE outbox SET status = $1, attempts = 0, next_attempt_at = NOW()
+        WHERE id = $2 AND status = $3
+    `, OutboxPending, id, OutboxDead)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Dead outbox entry not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
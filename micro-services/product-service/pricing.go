@@ -0,0 +1,506 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mallhive/shared/money"
+)
+
+// Price schedule kinds: a change replaces the regular price for good, a sale
+// overrides it between StartsAt and EndsAt.
+const (
+	PriceChange = "change"
+	PriceSale   = "sale"
+)
+
+// Price schedule status values
+const (
+	PriceScheduled = "scheduled"
+	PriceActive    = "active" // sale currently running
+	PriceApplied   = "applied"
+	PriceEnded     = "ended"
+	PriceCancelled = "cancelled"
+)
+
+// Price history sources
+const (
+	PriceSourceInitial   = "initial"
+	PriceSourceManual    = "manual"
+	PriceSourceSchedule  = "schedule"
+	PriceSourceSaleStart = "sale_start"
+	PriceSourceSaleEnd   = "sale_end"
+)
+
+const priceHistoryLimit = 200
+
+// PriceHistoryEntry is the price state a product had from ChangedAt on.
+type PriceHistoryEntry struct {
+	Price      money.Money  `json:"price"`
+	SalePrice  *money.Money `json:"sale_price,omitempty"`
+	Source     string       `json:"source"`
+	ScheduleID *int         `json:"schedule_id,omitempty"`
+	ChangedAt  time.Time    `json:"changed_at"`
+}
+
+type PriceSchedule struct {
+	ID        int         `json:"id"`
+	ProductID int         `json:"product_id"`
+	Kind      string      `json:"kind"`
+	Price     money.Money `json:"price"`
+	StartsAt  time.Time   `json:"starts_at"`
+	EndsAt    *time.Time  `json:"ends_at,omitempty"`
+	Status    string      `json:"status"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+const priceScheduleColumns = "id, product_id, kind, currency, price::text, starts_at, ends_at, status, created_at"
+
+const priceScheduleSelect = "SELECT " + priceScheduleColumns + " FROM price_schedules"
+
+func scanPriceSchedule(row rowScanner) (PriceSchedule, error) {
+	var s PriceSchedule
+	var currency, price string
+	var endsAt sql.NullTime
+	err := row.Scan(&s.ID, &s.ProductID, &s.Kind, &currency, &price, &s.StartsAt, &endsAt, &s.Status, &s.CreatedAt)
+	if err != nil {
+		return s, err
+	}
+	if endsAt.Valid {
+		s.EndsAt = &endsAt.Time
+	}
+	s.Price, err = money.Parse(price, currency)
+	return s, err
+}
+
+var errSaleOverlap = errors.New("sale overlaps another sale for this product")
+
+// recordPrice appends the product's current regular and sale price to its
+// history and, unless it is the opening price, announces the change to
+// webhooks. scheduleID is 0 for changes not made by the scheduler.
+func recordPrice(tx *sql.Tx, productID int, source string, scheduleID int) error {
+	if _, err := tx.Exec(`
+        INSERT INTO price_history (product_id, currency, price, sale_price, source, schedule_id)
+        SELECT id, currency, price, sale_price, $2, NULLIF($3, 0) FROM products WHERE id = $1
+    `, productID, source, scheduleID); err != nil {
+		return err
+	}
+	if source == PriceSourceInitial {
+		return nil
+	}
+	return enqueuePriceChanged(tx, productID, source, scheduleID)
+}
+
+// priceHistoryHandler serves GET /products/{id}/prices, newest first.
+func priceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !productExists(w, productID) {
+		return
+	}
+
+	rows, err := db.Query(`
+        SELECT currency, price::text, sale_price::text, source, schedule_id, changed_at FROM price_history
+        WHERE product_id = $1 ORDER BY changed_at DESC, id DESC LIMIT $2
+    `, productID, priceHistoryLimit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := []PriceHistoryEntry{}
+	for rows.Next() {
+		var e PriceHistoryEntry
+		var currency, price string
+		var sale sql.NullString
+		var scheduleID sql.NullInt64
+		if err := rows.Scan(&currency, &price, &sale, &e.Source, &scheduleID, &e.ChangedAt); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if e.Price, err = money.Parse(price, currency); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if e.SalePrice, err = parseNullMoney(sale, currency); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if scheduleID.Valid {
+			id := int(scheduleID.Int64)
+			e.ScheduleID = &id
+		}
+		history = append(history, e)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// priceSchedulesHandler lists and creates a product's scheduled price changes
+// and sales. The scheduler applies them once they fall due.
+func priceSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	if !productExists(w, productID) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query(priceScheduleSelect+" WHERE product_id = $1 ORDER BY starts_at, id", productID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		schedules := []PriceSchedule{}
+		for rows.Next() {
+			s, err := scanPriceSchedule(rows)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			schedules = append(schedules, s)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(schedules)
+
+	case http.MethodPost:
+		var s PriceSchedule
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		s.ProductID = productID
+		// The columns hold UTC wall-clock time, as NOW() does on the server
+		s.StartsAt = s.StartsAt.UTC()
+		if s.EndsAt != nil {
+			endsAt := s.EndsAt.UTC()
+			s.EndsAt = &endsAt
+		}
+		if err := validatePriceSchedule(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		created, err := createPriceSchedule(s)
+		var mismatch *scheduleCurrencyError
+		if err == errSaleOverlap {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if errors.As(err, &mismatch) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Database insert failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// priceScheduleItemHandler reads or cancels one schedule. Cancelling a running
+// sale ends it immediately.
+func priceScheduleItemHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	scheduleID, err := strconv.Atoi(r.PathValue("schedule_id"))
+	if err != nil {
+		http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s, err := scanPriceSchedule(db.QueryRow(
+			priceScheduleSelect+" WHERE id = $1 AND product_id = $2", scheduleID, productID,
+		))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Price schedule not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+
+	case http.MethodDelete:
+		err := cancelPriceSchedule(productID, scheduleID, requestActor(r))
+		switch {
+		case err == sql.ErrNoRows:
+			http.Error(w, "Price schedule not found", http.StatusNotFound)
+		case err == errScheduleClosed:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+var errScheduleClosed = errors.New("price schedule already applied or ended")
+
+// scheduleCurrencyError rejects a schedule priced in another currency than
+// its product.
+type scheduleCurrencyError struct {
+	Currency string
+}
+
+func (e *scheduleCurrencyError) Error() string {
+	return "price must be in " + e.Currency
+}
+
+func validatePriceSchedule(s PriceSchedule) error {
+	switch {
+	case s.Kind != PriceChange && s.Kind != PriceSale:
+		return errors.New("kind must be change or sale")
+	case s.Price.Amount < 0:
+		return errors.New("price must not be negative")
+	case s.StartsAt.IsZero():
+		return errors.New("missing starts_at")
+	case s.Kind == PriceChange && s.EndsAt != nil:
+		return errors.New("ends_at only applies to sales")
+	case s.Kind == PriceSale && s.EndsAt == nil:
+		return errors.New("missing ends_at")
+	case s.Kind == PriceSale && !s.EndsAt.After(s.StartsAt):
+		return errors.New("ends_at must be after starts_at")
+	case s.Kind == PriceSale && !s.EndsAt.After(time.Now()):
+		return errors.New("ends_at must be in the future")
+	}
+	return nil
+}
+
+// createPriceSchedule stores s. Sales for one product may not overlap, so
+// the product row is locked while the check and insert run.
+func createPriceSchedule(s PriceSchedule) (PriceSchedule, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return s, err
+	}
+	defer tx.Rollback()
+
+	// The price is stored in the product's currency, which cannot change
+	// while the schedule is pending
+	var currency string
+	if err := tx.QueryRow("SELECT currency FROM products WHERE id = $1 FOR UPDATE", s.ProductID).Scan(&currency); err != nil {
+		return s, err
+	}
+	if s.Price = s.Price.In(currency); s.Price.Currency != currency {
+		return s, &scheduleCurrencyError{currency}
+	}
+	if s.Kind == PriceSale {
+		var overlap bool
+		if err := tx.QueryRow(`
+            SELECT EXISTS (
+                SELECT 1 FROM price_schedules
+                WHERE product_id = $1 AND kind = $2 AND status IN ($3, $4)
+                  AND starts_at < $6 AND ends_at > $5
+            )
+        `, s.ProductID, PriceSale, PriceScheduled, PriceActive, s.StartsAt, *s.EndsAt).Scan(&overlap); err != nil {
+			return s, err
+		}
+		if overlap {
+			return s, errSaleOverlap
+		}
+	}
+
+	var endsAt sql.NullTime
+	if s.EndsAt != nil {
+		endsAt = sql.NullTime{Time: *s.EndsAt, Valid: true}
+	}
+	created, err := scanPriceSchedule(tx.QueryRow(`
+        INSERT INTO price_schedules (product_id, kind, currency, price, starts_at, ends_at, status)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING `+priceScheduleColumns,
+		s.ProductID, s.Kind, currency, s.Price, s.StartsAt, endsAt, PriceScheduled))
+	if err != nil {
+		return s, err
+	}
+	return created, tx.Commit()
+}
+
+// cancelPriceSchedule withdraws a pending schedule, or ends a running sale
+// and restores the regular price.
+func cancelPriceSchedule(productID, scheduleID int, actor string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	s, err := scanPriceSchedule(tx.QueryRow(
+		priceScheduleSelect+" WHERE id = $1 AND product_id = $2 FOR UPDATE", scheduleID, productID,
+	))
+	if err != nil {
+		return err
+	}
+	switch s.Status {
+	case PriceScheduled:
+	case PriceActive:
+		before, err := scanProduct(tx.QueryRow(productSelect+" WHERE p.id = $1 FOR UPDATE OF p", s.ProductID))
+		if err != nil {
+			return err
+		}
+		if err := endSale(tx, s); err != nil {
+			return err
+		}
+		if err := enqueueAuditedRefresh(tx, actor, before); err != nil {
+			return err
+		}
+	default:
+		return errScheduleClosed
+	}
+	if _, err := tx.Exec(
+		"UPDATE price_schedules SET status = $1 WHERE id = $2", PriceCancelled, scheduleID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runPriceScheduler applies due price changes and starts and ends sales every
+// interval. Each schedule is advanced in its own transaction.
+func runPriceScheduler(interval time.Duration) {
+	for range time.Tick(interval) {
+		// Finished sales are handled before new ones start
+		rows, err := db.Query(`
+            SELECT id FROM price_schedules
+            WHERE (status = $1 AND starts_at <= NOW()) OR (status = $2 AND ends_at <= NOW())
+            ORDER BY status = $1, starts_at, id
+        `, PriceScheduled, PriceActive)
+		if err != nil {
+			log.Println("❌ Price schedule query failed:", err)
+			continue
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if rows.Scan(&id) == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+
+		for _, id := range ids {
+			if err := advancePriceSchedule(id); err != nil {
+				log.Printf("❌ Failed to apply price schedule %d: %v", id, err)
+			}
+		}
+		if len(ids) > 0 {
+			log.Printf("🏷️ Advanced %d price schedules\n", len(ids))
+		}
+	}
+}
+
+// advancePriceSchedule moves one schedule to its next state. The schedule is
+// re-read under lock, so a cancel that raced the scheduler wins.
+func advancePriceSchedule(id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	s, err := scanPriceSchedule(tx.QueryRow(priceScheduleSelect+" WHERE id = $1 FOR UPDATE", id))
+	if err != nil {
+		return err
+	}
+	before, err := scanProduct(tx.QueryRow(productSelect+" WHERE p.id = $1 FOR UPDATE OF p", s.ProductID))
+	if err != nil {
+		return err
+	}
+	var started, ended bool
+	if err := tx.QueryRow(
+		"SELECT starts_at <= NOW(), COALESCE(ends_at <= NOW(), FALSE) FROM price_schedules WHERE id = $1", id,
+	).Scan(&started, &ended); err != nil {
+		return err
+	}
+
+	next := ""
+	switch {
+	case s.Status == PriceScheduled && !started:
+		return nil
+	case s.Status == PriceScheduled && s.Kind == PriceChange:
+		if _, err := tx.Exec("UPDATE products SET price = $1, version = version + 1 WHERE id = $2", s.Price, s.ProductID); err != nil {
+			return err
+		}
+		if err := recordPrice(tx, s.ProductID, PriceSourceSchedule, s.ID); err != nil {
+			return err
+		}
+		next = PriceApplied
+	case s.Status == PriceScheduled && ended:
+		// The whole window passed while the scheduler was down
+		next = PriceEnded
+	case s.Status == PriceScheduled:
+		if _, err := tx.Exec("UPDATE products SET sale_price = $1, version = version + 1 WHERE id = $2", s.Price, s.ProductID); err != nil {
+			return err
+		}
+		if err := recordPrice(tx, s.ProductID, PriceSourceSaleStart, s.ID); err != nil {
+			return err
+		}
+		next = PriceActive
+	case s.Status == PriceActive && ended:
+		if err := endSale(tx, s); err != nil {
+			return err
+		}
+		next = PriceEnded
+	default:
+		return nil
+	}
+
+	if _, err := tx.Exec("UPDATE price_schedules SET status = $1 WHERE id = $2", next, s.ID); err != nil {
+		return err
+	}
+	// A sale skipped outright never touched the product
+	if next != PriceEnded || s.Status == PriceActive {
+		if err := enqueueAuditedRefresh(tx, ActorScheduler, before); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// endSale clears the running sale price of s's product and records the
+// restored price.
+func endSale(tx *sql.Tx, s PriceSchedule) error {
+	if _, err := tx.Exec("UPDATE products SET sale_price = NULL, version = version + 1 WHERE id = $1", s.ProductID); err != nil {
+		return err
+	}
+	return recordPrice(tx, s.ProductID, PriceSourceSaleEnd, s.ID)
+}
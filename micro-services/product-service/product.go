@@ -5,23 +5,207 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/opensearch-project/opensearch-go"
+	"mallhive/shared/migrate"
+	"mallhive/shared/money"
 )
 
 type Product struct {
-	ID          int     `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Category    string  `json:"category"`
-	Price       float64 `json:"price"`
-	Available   bool    `json:"available"`
+	ID            int         `json:"id"`
+	Name          string      `json:"name"`
+	Slug          string      `json:"slug"`
+	Description   string      `json:"description"`
+	CategoryID    int         `json:"category_id"`
+	Category      string      `json:"category"` // category slug
+	Price         money.Money `json:"price"`    // regular price
+	Available     bool        `json:"available"`
+	ImageURL      string      `json:"image_url"`
+	StockQuantity int         `json:"stock_quantity"`
+	WeightGrams   int         `json:"weight_grams"` // shipping weight of one unit
+
+	// Stock alerts fire when the quantity drops below the threshold;
+	// StockState is read-only
+	LowStockThreshold int    `json:"low_stock_threshold"`
+	StockState        string `json:"stock_state"`
+
+	// active, archived or deleted; only active products are listed and
+	// can be available
+	Status string `json:"status"`
+
+	// Read-only: bumped by every write to the row, served as the ETag.
+	// ifMatch carries a write's If-Match header down to updateProductRow.
+	Version int `json:"version"`
+	ifMatch string
+
+	// Read-only: the price to charge now and, during a sale, the regular
+	// price it is discounted from
+	EffectivePrice money.Money  `json:"effective_price"`
+	WasPrice       *money.Money `json:"was_price,omitempty"`
+
+	// Currency the prices are stored in; reads may convert them with
+	// ?currency=
+	BaseCurrency string `json:"base_currency"`
+
+	// Typed values defined by the category's attribute schema
+	Attributes map[string]any `json:"attributes"`
+
+	// Read-only: aggregated from the product's reviews
+	RatingAverage float64 `json:"rating_average"`
+	RatingCount   int     `json:"rating_count"`
+
+	// Effective price in DefaultCurrency as the listing sorts on it
+	pivotPrice string
+
+	// Variants are only loaded for single-product reads
+	Options []ProductOption `json:"options,omitempty"`
+	SKUs    []SKU           `json:"skus,omitempty"`
+	Images  []ProductImage  `json:"images,omitempty"`
+}
+
+// ProductPatch carries a partial update; nil fields are left untouched.
+type ProductPatch struct {
+	Name          *string      `json:"name"`
+	Slug          *string      `json:"slug"`
+	Description   *string      `json:"description"`
+	CategoryID    *int         `json:"category_id"`
+	Category      *string      `json:"category"`
+	Price         *money.Money `json:"price"`
+	Available     *bool        `json:"available"`
+	ImageURL      *string      `json:"image_url"`
+	StockQuantity *int         `json:"stock_quantity"`
+	WeightGrams   *int         `json:"weight_grams"`
+
+	LowStockThreshold *int    `json:"low_stock_threshold"`
+	Status            *string `json:"status"`
+
+	// Replaces the whole attribute set
+	Attributes *map[string]any `json:"attributes"`
+}
+
+func (patch ProductPatch) apply(p *Product) {
+	if patch.Name != nil {
+		p.Name = *patch.Name
+	}
+	if patch.Slug != nil {
+		p.Slug = *patch.Slug
+	}
+	if patch.Description != nil {
+		p.Description = *patch.Description
+	}
+	if patch.Category != nil {
+		// Re-resolve by slug unless an id is supplied alongside it
+		p.Category = *patch.Category
+		p.CategoryID = 0
+	}
+	if patch.CategoryID != nil {
+		p.CategoryID = *patch.CategoryID
+	}
+	if patch.Price != nil {
+		p.Price = *patch.Price
+	}
+	if patch.Available != nil {
+		p.Available = *patch.Available
+	}
+	if patch.ImageURL != nil {
+		p.ImageURL = *patch.ImageURL
+	}
+	if patch.StockQuantity != nil {
+		p.StockQuantity = *patch.StockQuantity
+	}
+	if patch.WeightGrams != nil {
+		p.WeightGrams = *patch.WeightGrams
+	}
+	if patch.LowStockThreshold != nil {
+		p.LowStockThreshold = *patch.LowStockThreshold
+	}
+	if patch.Status != nil {
+		p.Status = *patch.Status
+	}
+	if patch.Attributes != nil {
+		p.Attributes = *patch.Attributes
+	}
+}
+
+// productFrom joins a product with its category, inventory row and the rate
+// of its base currency.
+const productFrom = `
+    FROM products p
+    JOIN categories c ON c.id = p.category_id
+    LEFT JOIN inventories i ON i.product_id = p.id
+    LEFT JOIN exchange_rates r ON r.currency = p.currency`
+
+// productSelect reads a Product joined with its category slug and stock level.
+// Prices are read as text and parsed in the product's currency.
+const productSelect = `
+    SELECT p.id, p.name, p.slug, COALESCE(p.description, ''), p.category_id, c.slug,
+           p.currency, p.price::text, p.sale_price::text, ` + pivotPrice + `::text,
+           p.attributes, p.rating_average, p.rating_count, p.status, p.version, p.weight_grams,
+           p.available, COALESCE(p.imageURL, ''), COALESCE(i.quantity, 0),
+           COALESCE(i.low_stock_threshold, 0), COALESCE(i.stock_state, 'out_of_stock')` + productFrom
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanProduct(row rowScanner) (Product, error) {
+	var p Product
+	var price string
+	var sale sql.NullString
+	var attributes []byte
+	err := row.Scan(&p.ID, &p.Name, &p.Slug, &p.Description, &p.CategoryID, &p.Category,
+		&p.BaseCurrency, &price, &sale, &p.pivotPrice, &attributes, &p.RatingAverage, &p.RatingCount,
+		&p.Status, &p.Version, &p.WeightGrams, &p.Available, &p.ImageURL, &p.StockQuantity, &p.LowStockThreshold, &p.StockState)
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(attributes, &p.Attributes); err != nil {
+		return p, err
+	}
+	if p.Price, err = money.Parse(price, p.BaseCurrency); err != nil {
+		return p, err
+	}
+	p.EffectivePrice = p.Price
+	if sale.Valid {
+		if p.EffectivePrice, err = money.Parse(sale.String, p.BaseCurrency); err != nil {
+			return p, err
+		}
+		was := p.Price
+		p.WasPrice = &was
+	}
+	return p, nil
+}
+
+// settleCurrency fixes the currency p is stored in: the price's own currency
+// when one was given, else the product's base currency, else DefaultCurrency.
+func (p *Product) settleCurrency() {
+	base := p.BaseCurrency
+	if base == "" {
+		base = money.DefaultCurrency
+	}
+	p.Price = p.Price.In(base)
+	p.BaseCurrency = p.Price.Currency
+}
+
+// reloadProduct replaces *p with the stored row as tx currently sees it, so
+// responses and events carry computed fields such as the effective price.
+func reloadProduct(tx *sql.Tx, p *Product) error {
+	fresh, err := scanProduct(tx.QueryRow(productSelect+" WHERE p.id = $1", p.ID))
+	if err != nil {
+		return err
+	}
+	*p = fresh
+	return nil
 }
 
 var db *sql.DB
@@ -47,6 +231,23 @@ func main() {
 		log.Fatal("❌ Database connection error:", err)
 	}
 
+	// Schema migrations run on their own, without the rest of the setup
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Run(db, migrationFiles, os.Args[2:]); err != nil {
+			log.Fatal("❌ Migration failed:", err)
+		}
+		return
+	}
+	if migrate.OnStart() {
+		applied, err := migrate.Up(db, migrationFiles)
+		if err != nil {
+			log.Fatal("❌ Migration failed:", err)
+		}
+		for _, m := range applied {
+			log.Printf("🗄️ Applied migration %04d_%s\n", m.Version, m.Name)
+		}
+	}
+
 	// Connect to OpenSearch
 	searchClient, err = opensearch.NewClient(opensearch.Config{
 		Addresses: []string{os.Getenv("OPENSEARCH_URL")},
@@ -55,8 +256,88 @@ func main() {
 		log.Fatal("❌ OpenSearch connection error:", err)
 	}
 
-	// REST routes
-	http.HandleFunc("/products", productHandler)
+	// Seed exchange rates from a local file when one is configured
+	if path := os.Getenv("EXCHANGE_RATES_FILE"); path != "" {
+		n, err := loadRateFile(path)
+		if err != nil {
+			log.Fatal("❌ Failed to load exchange rates:", err)
+		}
+		log.Printf("💱 Loaded %d exchange rates from %s\n", n, path)
+	}
+
+	// Image files go to the configured object store
+	imageStore, err = newObjectStore()
+	if err != nil {
+		log.Fatal("❌ Image storage error:", err)
+	}
+
+	// Catalog writes need a verified token
+	verifier, err = newTokenVerifier()
+	if err != nil {
+		log.Fatal("❌ Auth configuration error:", err)
+	}
+	if verifier == nil {
+		log.Println("⚠️ AUTH_DISABLED is set in development, every endpoint is open to anyone")
+	}
+
+	// One-off maintenance commands run instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		if _, err := reindexProducts(context.Background()); err != nil {
+			log.Fatal("❌ Reindex failed:", err)
+		}
+		return
+	}
+
+	// REST routes. Catalog reads are public; writes need the merchandiser
+	// role, schema and operations endpoints admin. Review writes need a
+	// signed-in shopper and reservations the service role order-service
+	// holds.
+	http.HandleFunc("/products", guardWrites(RoleMerchandiser, productHandler))
+	http.HandleFunc("/products/{id}", guardWrites(RoleMerchandiser, productItemHandler))
+	http.HandleFunc("/products/import", requireRole(RoleMerchandiser, importHandler))
+	http.HandleFunc("/products/export", requireRole(RoleReadOnly, exportHandler))
+	http.HandleFunc("/products/facets", facetsHandler)
+	http.HandleFunc("/products/{id}/options", guardWrites(RoleMerchandiser, productOptionsHandler))
+	http.HandleFunc("/products/{id}/skus", guardWrites(RoleMerchandiser, productSKUsHandler))
+	http.HandleFunc("/products/{id}/skus/{sku_id}", guardWrites(RoleMerchandiser, productSKUItemHandler))
+	http.HandleFunc("/products/{id}/prices", priceHistoryHandler)
+	http.HandleFunc("/products/{id}/price-schedules", guardWrites(RoleMerchandiser, priceSchedulesHandler))
+	http.HandleFunc("/products/{id}/price-schedules/{schedule_id}", guardWrites(RoleMerchandiser, priceScheduleItemHandler))
+	http.HandleFunc("/products/{id}/images", guardWrites(RoleMerchandiser, productImagesHandler))
+	http.HandleFunc("/products/{id}/images/order", guardWrites(RoleMerchandiser, productImageOrderHandler))
+	http.HandleFunc("/products/{id}/images/{image_id}", guardWrites(RoleMerchandiser, productImageItemHandler))
+	http.HandleFunc("/products/{id}/reviews", guardUserWrites(reviewsHandler))
+	http.HandleFunc("/products/{id}/reviews/{review_id}", guardUserWrites(reviewItemHandler))
+	http.HandleFunc("/products/{id}/history", requireRole(RoleReadOnly, productHistoryHandler))
+	http.HandleFunc("/skus/{code}", skuByCodeHandler)
+	http.HandleFunc("/categories", guardWrites(RoleMerchandiser, categoryHandler))
+	http.HandleFunc("/categories/{id}", guardWrites(RoleMerchandiser, categoryItemHandler))
+	http.HandleFunc("/categories/{id}/attributes", guardWrites(RoleAdmin, categoryAttributesHandler))
+	http.HandleFunc("/reservations", requireRole(RoleService, reservationHandler))
+	http.HandleFunc("/reservations/{id}", requireRole(RoleService, reservationItemHandler))
+	http.HandleFunc("/reservations/{id}/{action}", requireRole(RoleService, reservationActionHandler))
+	http.HandleFunc("/webhooks", requireRole(RoleAdmin, webhooksHandler))
+	http.HandleFunc("/webhooks/{id}", requireRole(RoleAdmin, webhookItemHandler))
+	http.HandleFunc("/webhooks/{id}/deliveries", requireRole(RoleAdmin, webhookDeliveriesHandler))
+	http.HandleFunc("/webhooks/{id}/replay", requireRole(RoleAdmin, webhookReplayHandler))
+	http.HandleFunc("/outbox", requireRole(RoleReadOnly, outboxHandler))
+	http.HandleFunc("/outbox/{id}/retry", requireRole(RoleAdmin, outboxRetryHandler))
+	http.HandleFunc("/admin/reindex", requireRole(RoleAdmin, reindexHandler))
+	http.HandleFunc("/admin/exchange-rates", guardWrites(RoleAdmin, exchangeRatesHandler))
+
+	// Serve locally stored images unless they live on another host
+	if local, ok := imageStore.(*localStore); ok && strings.HasPrefix(local.baseURL, "/") {
+		http.Handle(local.baseURL+"/", local.Handler())
+	}
+
+	// Hand back stock held by abandoned checkouts
+	go expireReservations(time.Minute)
+
+	// Deliver queued index, alert and webhook events
+	go runOutboxRelay(5 * time.Second)
+
+	// Apply scheduled price changes and start or end sales
+	go runPriceScheduler(30 * time.Second)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -70,76 +351,449 @@ func main() {
 func productHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		rows, err := db.Query("SELECT id, name, description, category, price, available FROM products")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		listProducts(w, r)
+
+	case http.MethodPost:
+		p := Product{LowStockThreshold: defaultLowStockThreshold}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		if err := validateProduct(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := resolveCategory(&p); err != nil {
+			writeCategoryError(w, err)
 			return
 		}
-		defer rows.Close()
 
-		var products []Product
-		for rows.Next() {
-			var p Product
-			rows.Scan(&p.ID, &p.Name, &p.Description, &p.Category, &p.Price, &p.Available)
-			products = append(products, p)
+		base := p.Slug
+		if base == "" {
+			base = p.Name
+		}
+		slug, err := uniqueSlug("products", slugify(base))
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
 		}
-		json.NewEncoder(w).Encode(products)
+		p.Slug = slug
 
-	case http.MethodPost:
-		var p Product
-		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
-			http.Error(w, "Invalid input", http.StatusBadRequest)
+		// The outbox relay indexes and notifies other services
+		if err := insertProduct(&p, requestActor(r)); err != nil {
+			switch {
+			case isUniqueViolation(err):
+				http.Error(w, "Product already exists", http.StatusConflict)
+			case errors.Is(err, errUnsupportedCurrency), errors.Is(err, errCurrencyPrecision), errors.Is(err, errAttributes):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			default:
+				http.Error(w, "Database insert failed", http.StatusInternalServerError)
+			}
 			return
 		}
 
-		err := db.QueryRow(`
-            INSERT INTO products (name, description, category, price, available)
-            VALUES ($1, $2, $3, $4, $5) RETURNING id
-        `, p.Name, p.Description, p.Category, p.Price, p.Available).Scan(&p.ID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(p)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
 
+func productItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		view, err := newPriceView(r)
 		if err != nil {
-			http.Error(w, "Database insert failed", http.StatusInternalServerError)
+			writeCurrencyError(w, err)
 			return
 		}
+		p, err := getProduct(id)
+		if err == nil && !visibleTo(r, p.Status) {
+			err = sql.ErrNoRows
+		}
+		if err == sql.ErrNoRows {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if p.Options, err = getProductOptions(db, id); err == nil {
+			p.SKUs, err = getProductSKUs(id)
+		}
+		if err == nil {
+			p.Images, err = getProductImages(db, id)
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err := view.product(&p); err != nil {
+			writeCurrencyError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag(p.Version))
+		json.NewEncoder(w).Encode(p)
 
-		// Send to OpenSearch
-		IndexToOpenSearch(p)
+	case http.MethodPut:
+		p := Product{LowStockThreshold: defaultLowStockThreshold}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		existing, err := getProduct(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		p.ID = id
+		p.ifMatch = r.Header.Get("If-Match")
+		if p.Slug == "" {
+			p.Slug = existing.Slug
+		}
+		if p.BaseCurrency == "" {
+			p.BaseCurrency = existing.BaseCurrency
+		}
+		saveProductUpdate(w, p, requestActor(r))
 
-		// Notify other services
-		NotifyExternalServices(p)
+	case http.MethodPatch:
+		var patch ProductPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		p, err := getProduct(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		patch.apply(&p)
+		p.ifMatch = r.Header.Get("If-Match")
+		saveProductUpdate(w, p, requestActor(r))
 
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(p)
+	case http.MethodDelete:
+		p, err := getProduct(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		p.ifMatch = r.Header.Get("If-Match")
+		if err := deleteProduct(p, requestActor(r)); err == errVersionConflict {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		} else if err != nil {
+			http.Error(w, "Database delete failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func IndexToOpenSearch(p Product) {
+func getProduct(id int) (Product, error) {
+	return scanProduct(db.QueryRow(productSelect+" WHERE p.id = $1", id))
+}
+
+// validateProduct checks the fields the schema cannot.
+func validateProduct(p Product) error {
+	switch {
+	case strings.TrimSpace(p.Name) == "":
+		return errors.New("missing name")
+	case p.Price.Amount < 0:
+		return errors.New("price must not be negative")
+	case p.StockQuantity < 0:
+		return errors.New("stock_quantity must not be negative")
+	case p.WeightGrams < 0:
+		return errors.New("weight_grams must not be negative")
+	case p.LowStockThreshold < 0:
+		return errors.New("low_stock_threshold must not be negative")
+	case p.Status != "" && !validProductStatus(p.Status):
+		return errProductStatus
+	}
+	return nil
+}
+
+// insertProduct stores p and its starting stock level in one transaction.
+func insertProduct(p *Product, actor string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertProductRow(tx, p, actor); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertProductRow inserts p with its inventory row and opening price,
+// records actor as its creator and queues the create event on tx.
+func insertProductRow(tx *sql.Tx, p *Product, actor string) error {
+	if p.Status == "" {
+		p.Status = ProductActive
+	}
+	if p.Status != ProductActive {
+		p.Available = false
+	}
+	p.settleCurrency()
+	if err := storableCurrency(tx, p.BaseCurrency); err != nil {
+		return err
+	}
+	if err := checkAttributes(tx, p); err != nil {
+		return err
+	}
+	attributes, _ := json.Marshal(p.Attributes)
+	err := tx.QueryRow(`
+        INSERT INTO products (name, slug, description, category_id, price, currency, attributes, status, available, imageURL, weight_grams)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id
+    `, p.Name, p.Slug, p.Description, p.CategoryID, p.Price, p.BaseCurrency, attributes, p.Status, p.Available, p.ImageURL, p.WeightGrams).Scan(&p.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO inventories (product_id, quantity, low_stock_threshold) VALUES ($1, $2, $3)",
+		p.ID, p.StockQuantity, p.LowStockThreshold,
+	); err != nil {
+		return err
+	}
+	if err := recordPrice(tx, p.ID, PriceSourceInitial, 0); err != nil {
+		return err
+	}
+	if err := reloadProduct(tx, p); err != nil {
+		return err
+	}
+	if err := auditCreate(tx, actor, *p); err != nil {
+		return err
+	}
+	if err := checkStockLevel(tx, p.ID); err != nil {
+		return err
+	}
+	if err := reloadProduct(tx, p); err != nil {
+		return err
+	}
+	return enqueueProductEvent(tx, EventProductCreated, *p)
+}
+
+// updateProductRow overwrites the stored product and stock level with p,
+// records a regular price change in the history, audits the changed fields
+// under actor and queues the update event on tx. It returns sql.ErrNoRows
+// when p.ID is unknown and errVersionConflict when p.ifMatch names another
+// version. On success *p is reloaded from the stored row.
+func updateProductRow(tx *sql.Tx, p *Product, actor string) error {
+	old, err := scanProduct(tx.QueryRow(productSelect+" WHERE p.id = $1 FOR UPDATE OF p", p.ID))
+	if err != nil {
+		return err
+	}
+	if !etagMatches(p.ifMatch, old.Version) {
+		return errVersionConflict
+	}
+	if p.BaseCurrency == "" {
+		p.BaseCurrency = old.BaseCurrency
+	}
+	if p.Status == "" {
+		p.Status = old.Status
+	}
+	// Only active products are on sale
+	if p.Status != ProductActive {
+		p.Available = false
+	}
+	p.settleCurrency()
+	if p.BaseCurrency != old.BaseCurrency {
+		if err := checkCurrencyChange(tx, p.ID); err != nil {
+			return err
+		}
+	}
+	if err := storableCurrency(tx, p.BaseCurrency); err != nil {
+		return err
+	}
+	if err := checkAttributes(tx, p); err != nil {
+		return err
+	}
+	attributes, _ := json.Marshal(p.Attributes)
+	if _, err := tx.Exec(`
+        UPDATE products SET name = $1, slug = $2, description = $3, category_id = $4,
+            price = $5, currency = $6, attributes = $7, status = $8, available = $9, imageURL = $10,
+            weight_grams = $11, version = version + 1
+        WHERE id = $12
+    `, p.Name, p.Slug, p.Description, p.CategoryID, p.Price, p.BaseCurrency, attributes, p.Status, p.Available, p.ImageURL, p.WeightGrams, p.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+        INSERT INTO inventories (product_id, quantity, low_stock_threshold) VALUES ($1, $2, $3)
+        ON CONFLICT (product_id) DO UPDATE
+        SET quantity = EXCLUDED.quantity, low_stock_threshold = EXCLUDED.low_stock_threshold
+    `, p.ID, p.StockQuantity, p.LowStockThreshold); err != nil {
+		return err
+	}
+	if old.Price != p.Price {
+		if err := recordPrice(tx, p.ID, PriceSourceManual, 0); err != nil {
+			return err
+		}
+	}
+	if err := reloadProduct(tx, p); err != nil {
+		return err
+	}
+	if err := auditChanges(tx, actor, old, *p); err != nil {
+		return err
+	}
+	if err := checkStockLevel(tx, p.ID); err != nil {
+		return err
+	}
+	if old.StockQuantity != p.StockQuantity || old.LowStockThreshold != p.LowStockThreshold {
+		if err := enqueueStockChanged(tx, p.ID); err != nil {
+			return err
+		}
+	}
+	if err := reloadProduct(tx, p); err != nil {
+		return err
+	}
+	event := EventProductUpdated
+	if p.Status == ProductDeleted {
+		event = EventProductDeleted
+	}
+	return enqueueProductEvent(tx, event, *p)
+}
+
+// deleteProduct soft-deletes p: the row stays so orders placed for it still
+// resolve, but it leaves the catalog and downstream caches.
+func deleteProduct(p Product, actor string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	p.Status = ProductDeleted
+	if err := updateProductRow(tx, &p, actor); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// saveProductUpdate writes p over the stored row and propagates the change.
+func saveProductUpdate(w http.ResponseWriter, p Product, actor string) {
+	if err := validateProduct(p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := resolveCategory(&p); err != nil {
+		writeCategoryError(w, err)
+		return
+	}
+	p.Slug = slugify(p.Slug)
+	if p.Slug == "" {
+		http.Error(w, "Invalid slug", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = updateProductRow(tx, &p, actor)
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	case isUniqueViolation(err):
+		http.Error(w, "Product name or slug already in use", http.StatusConflict)
+		return
+	case isCheckViolation(err):
+		http.Error(w, "Stock quantity below reserved units", http.StatusConflict)
+		return
+	case errors.Is(err, errUnsupportedCurrency), errors.Is(err, errCurrencyPrecision), errors.Is(err, errAttributes):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err == errCurrencyLocked:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err == errVersionConflict:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	case err != nil:
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(p.Version))
+	json.NewEncoder(w).Encode(p)
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func isCheckViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23514"
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+func IndexToOpenSearch(p Product) error {
 	data, _ := json.Marshal(p)
 	res, err := searchClient.Index(
-		"products",
+		productIndexAlias,
 		bytes.NewReader(data),
 		searchClient.Index.WithDocumentID(fmt.Sprint(p.ID)),
 		searchClient.Index.WithContext(context.Background()),
 	)
 	if err != nil {
-		log.Println("❌ OpenSearch index error:", err)
-		return
+		return err
 	}
 	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("opensearch index: %s", res.Status())
+	}
 	log.Println("✅ Product indexed in OpenSearch")
+	return nil
 }
 
-func NotifyExternalServices(p Product) {
-	cartURL := os.Getenv("CART_SERVICE_URL")
-	orderURL := os.Getenv("ORDER_SERVICE_URL")
-
-	payload, _ := json.Marshal(p)
-	// Notify Shopping Cart
-	http.Post(cartURL+"/products/sync", "application/json", bytes.NewReader(payload))
-	// Notify Order Service
-	http.Post(orderURL+"/products/sync", "application/json", bytes.NewReader(payload))
-
-	log.Println("📡 Product sync notifications sent")
+func RemoveFromOpenSearch(id int) error {
+	res, err := searchClient.Delete(
+		productIndexAlias,
+		fmt.Sprint(id),
+		searchClient.Delete.WithContext(context.Background()),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// Already gone counts as removed
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("opensearch delete: %s", res.Status())
+	}
+	log.Println("✅ Product removed from OpenSearch")
+	return nil
 }
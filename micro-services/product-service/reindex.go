@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opensearch-project/opensearch-go/opensearchapi"
+)
+
+// productIndexAlias is the name every reader and writer uses; it points at
+// exactly one versioned index such as products_v20250101120000.
+const productIndexAlias = "products"
+
+const reindexBatchSize = 500
+
+// productIndexMapping is applied to each freshly built index. Changing it and
+// running a reindex is how analyzers and field types evolve.
+const productIndexMapping = `{
+  "settings": {
+    "number_of_shards": 1,
+    "analysis": {
+      "analyzer": {
+        "product_text": {
+          "type": "custom",
+          "tokenizer": "standard",
+          "filter": ["lowercase", "asciifolding"]
+        }
+      }
+    }
+  },
+  "mappings": {
+    "dynamic_templates": [
+      { "attribute_integers": { "path_match": "attributes.*", "match_mapping_type": "long", "mapping": { "type": "double" } } },
+      { "attribute_numbers": { "path_match": "attributes.*", "match_mapping_type": "double", "mapping": { "type": "double" } } },
+      { "attribute_keywords": { "path_match": "attributes.*", "match_mapping_type": "string", "mapping": { "type": "keyword" } } }
+    ],
+    "properties": {
+      "id":             { "type": "integer" },
+      "name":           { "type": "text", "analyzer": "product_text", "fields": { "keyword": { "type": "keyword" } } },
+      "slug":           { "type": "keyword" },
+      "description":    { "type": "text", "analyzer": "product_text" },
+      "category_id":    { "type": "integer" },
+      "category":       { "type": "keyword" },
+      "price":          { "properties": { "amount": { "type": "long" }, "currency": { "type": "keyword" } } },
+      "effective_price": { "properties": { "amount": { "type": "long" }, "currency": { "type": "keyword" } } },
+      "was_price":      { "properties": { "amount": { "type": "long" }, "currency": { "type": "keyword" } } },
+      "base_currency":  { "type": "keyword" },
+      "attributes":     { "type": "object" },
+      "rating_average": { "type": "float" },
+      "rating_count":   { "type": "integer" },
+      "status":         { "type": "keyword" },
+      "available":      { "type": "boolean" },
+      "image_url":      { "type": "keyword", "index": false },
+      "stock_quantity": { "type": "integer" },
+      "low_stock_threshold": { "type": "integer" },
+      "stock_state":    { "type": "keyword" }
+    }
+  }
+}`
+
+// ReindexReport summarises a completed reindex.
+type ReindexReport struct {
+	Index         string   `json:"index"`
+	Documents     int      `json:"documents"`
+	Replaced      []string `json:"replaced"`
+	CaughtUp      int      `json:"caught_up"`
+	DurationMilli int64    `json:"duration_ms"`
+}
+
+var reindexMu sync.Mutex
+
+// reindexHandler serves POST /admin/reindex.
+func reindexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !reindexMu.TryLock() {
+		http.Error(w, "Reindex already running", http.StatusConflict)
+		return
+	}
+	defer reindexMu.Unlock()
+
+	report, err := reindexProducts(r.Context())
+	if err != nil {
+		log.Println("❌ Reindex failed:", err)
+		http.Error(w, "Reindex failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// reindexProducts builds a new versioned index from Postgres, checks the
+// document count and atomically points the alias at it. The previous index
+// is kept for rollback.
+func reindexProducts(ctx context.Context) (ReindexReport, error) {
+	start := time.Now()
+	report := ReindexReport{Index: fmt.Sprintf("%s_v%s", productIndexAlias, start.UTC().Format("20060102150405"))}
+
+	// Changes committed from here on may miss the snapshot and are replayed after the swap
+	var since time.Time
+	if err := db.QueryRowContext(ctx, "SELECT NOW()").Scan(&since); err != nil {
+		return report, err
+	}
+
+	res, err := searchClient.Indices.Create(
+		report.Index,
+		searchClient.Indices.Create.WithBody(strings.NewReader(productIndexMapping)),
+		searchClient.Indices.Create.WithContext(ctx),
+	)
+	if err := checkSearchResponse(res, err, "create index"); err != nil {
+		return report, err
+	}
+	res.Body.Close()
+
+	n, err := bulkIndexAllProducts(ctx, report.Index)
+	if err == nil {
+		report.Documents = n
+		err = verifyIndexCount(ctx, report.Index, n)
+	}
+	if err == nil {
+		report.Replaced, err = swapProductAlias(ctx, report.Index)
+	}
+	if err != nil {
+		dropIndex(report.Index)
+		return report, err
+	}
+
+	report.CaughtUp = catchUpIndex(ctx, since)
+	report.DurationMilli = time.Since(start).Milliseconds()
+	log.Printf("✅ Reindexed %d products into %s\n", report.Documents, report.Index)
+	return report, nil
+}
+
+// bulkIndexAllProducts streams the catalog into index in bulk batches.
+func bulkIndexAllProducts(ctx context.Context, index string) (int, error) {
+	rows, err := db.QueryContext(ctx, productSelect+" WHERE p.status = $1 ORDER BY p.id", ProductActive)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var buf bytes.Buffer
+	total, batch := 0, 0
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return total, err
+		}
+		if err := appendBulkIndex(&buf, p); err != nil {
+			return total, err
+		}
+		batch++
+		if batch == reindexBatchSize {
+			if err := sendBulk(ctx, index, &buf); err != nil {
+				return total, err
+			}
+			total += batch
+			batch = 0
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return total, err
+	}
+	if batch > 0 {
+		if err := sendBulk(ctx, index, &buf); err != nil {
+			return total, err
+		}
+		total += batch
+	}
+	return total, nil
+}
+
+// appendBulkIndex writes the action and source lines for p.
+func appendBulkIndex(buf *bytes.Buffer, p Product) error {
+	fmt.Fprintf(buf, `{"index":{"_id":"%d"}}`+"\n", p.ID)
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	buf.WriteByte('\n')
+	return nil
+}
+
+// bulkItemResult is the outcome of one action in a bulk request.
+type bulkItemResult struct {
+	ID     string          `json:"_id"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// doBulk submits an NDJSON bulk body against index and returns the result of
+// each action in request order.
+func doBulk(ctx context.Context, index string, body []byte) ([]bulkItemResult, error) {
+	res, err := searchClient.Bulk(
+		bytes.NewReader(body),
+		searchClient.Bulk.WithIndex(index),
+		searchClient.Bulk.WithContext(ctx),
+	)
+	if err := checkSearchResponse(res, err, "bulk"); err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var parsed struct {
+		Items []map[string]bulkItemResult `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return nil, err
+	}
+	results := make([]bulkItemResult, 0, len(parsed.Items))
+	for _, item := range parsed.Items {
+		for _, result := range item {
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// sendBulk submits buf to the bulk API, fails on any item error and resets buf.
+func sendBulk(ctx context.Context, index string, buf *bytes.Buffer) error {
+	defer buf.Reset()
+	results, err := doBulk(ctx, index, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if len(result.Error) > 0 {
+			return fmt.Errorf("bulk item %s: %s", result.ID, result.Error)
+		}
+	}
+	return nil
+}
+
+func verifyIndexCount(ctx context.Context, index string, want int) error {
+	res, err := searchClient.Indices.Refresh(
+		searchClient.Indices.Refresh.WithIndex(index),
+		searchClient.Indices.Refresh.WithContext(ctx),
+	)
+	if err := checkSearchResponse(res, err, "refresh"); err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	res, err = searchClient.Count(
+		searchClient.Count.WithIndex(index),
+		searchClient.Count.WithContext(ctx),
+	)
+	if err := checkSearchResponse(res, err, "count"); err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		Count int `json:"count"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return err
+	}
+	if body.Count != want {
+		return fmt.Errorf("index %s holds %d documents, expected %d", index, body.Count, want)
+	}
+	return nil
+}
+
+// swapProductAlias moves the alias onto index in a single _aliases call and
+// returns the indices it was taken from. A legacy concrete index named like
+// the alias is removed in the same call so the alias can take its place.
+func swapProductAlias(ctx context.Context, index string) ([]string, error) {
+	var replaced []string
+	var actions []map[string]any
+
+	res, err := searchClient.Indices.GetAlias(
+		searchClient.Indices.GetAlias.WithName(productIndexAlias),
+		searchClient.Indices.GetAlias.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		var current map[string]json.RawMessage
+		if err := json.NewDecoder(res.Body).Decode(&current); err != nil {
+			return nil, err
+		}
+		for old := range current {
+			replaced = append(replaced, old)
+			actions = append(actions, map[string]any{
+				"remove": map[string]string{"index": old, "alias": productIndexAlias},
+			})
+		}
+	case http.StatusNotFound:
+		exists, err := searchClient.Indices.Exists([]string{productIndexAlias})
+		if err != nil {
+			return nil, err
+		}
+		exists.Body.Close()
+		if exists.StatusCode == http.StatusOK {
+			replaced = append(replaced, productIndexAlias)
+			actions = append(actions, map[string]any{
+				"remove_index": map[string]string{"index": productIndexAlias},
+			})
+		}
+	default:
+		return nil, fmt.Errorf("get alias: %s", res.Status())
+	}
+
+	actions = append(actions, map[string]any{
+		"add": map[string]string{"index": index, "alias": productIndexAlias},
+	})
+	body, _ := json.Marshal(map[string]any{"actions": actions})
+
+	res, err = searchClient.Indices.UpdateAliases(
+		bytes.NewReader(body),
+		searchClient.Indices.UpdateAliases.WithContext(ctx),
+	)
+	if err := checkSearchResponse(res, err, "update aliases"); err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return replaced, nil
+}
+
+// catchUpIndex re-indexes products whose search events were queued after
+// since, so edits made while the snapshot streamed are not lost.
+func catchUpIndex(ctx context.Context, since time.Time) int {
+	rows, err := db.QueryContext(ctx,
+		"SELECT DISTINCT aggregate_id FROM outbox WHERE destination = $1 AND created_at >= $2",
+		DestSearch, since,
+	)
+	if err != nil {
+		log.Println("❌ Reindex catch-up query failed:", err)
+		return 0
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		p, err := getProduct(id)
+		if err == nil && p.Status == ProductActive {
+			err = IndexToOpenSearch(p)
+		} else {
+			err = RemoveFromOpenSearch(id)
+		}
+		if err != nil {
+			log.Printf("❌ Reindex catch-up failed for product %d: %v", id, err)
+		}
+	}
+	return len(ids)
+}
+
+func dropIndex(index string) {
+	res, err := searchClient.Indices.Delete([]string{index})
+	if err != nil {
+		log.Println("❌ Failed to drop index", index, err)
+		return
+	}
+	res.Body.Close()
+}
+
+// checkSearchResponse folds transport and HTTP errors into one error. The
+// body of an error response is consumed and closed.
+func checkSearchResponse(res *opensearchapi.Response, err error, op string) error {
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if res.IsError() {
+		defer res.Body.Close()
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s %s", op, res.Status(), detail)
+	}
+	return nil
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Reservation status values
+const (
+	ReservationHeld      = "held"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+	ReservationExpired   = "expired"
+)
+
+const (
+	defaultReservationTTL = 15 * time.Minute
+	maxReservationTTL     = 2 * time.Hour
+)
+
+// ReservationItem holds units of a product, or of one of its SKUs when
+// SKUID is set.
+type ReservationItem struct {
+	ProductID int `json:"product_id"`
+	SKUID     int `json:"sku_id,omitempty"`
+	Quantity  int `json:"quantity"`
+}
+
+type Reservation struct {
+	ID         int               `json:"id"`
+	OrderID    int               `json:"order_id"`
+	Status     string            `json:"status"`
+	Items      []ReservationItem `json:"items"`
+	TTLSeconds int               `json:"ttl_seconds,omitempty"`
+	ExpiresAt  time.Time         `json:"expires_at"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// StockShortage reports a line that could not be reserved.
+type StockShortage struct {
+	ProductID int `json:"product_id"`
+	SKUID     int `json:"sku_id,omitempty"`
+	Requested int `json:"requested"`
+	Available int `json:"available"`
+}
+
+type shortageError struct {
+	Shortages []StockShortage
+}
+
+func (e *shortageError) Error() string { return "insufficient stock" }
+
+var (
+	errReservationNotFound = errors.New("reservation not found")
+	errReservationClosed   = errors.New("reservation is no longer held")
+	errSKUMismatch         = errors.New("sku does not belong to product")
+	errProductInactive     = errors.New("product is not on sale")
+)
+
+func reservationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var res Reservation
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if res.OrderID == 0 || len(res.Items) == 0 {
+		http.Error(w, "Missing order_id or items", http.StatusBadRequest)
+		return
+	}
+	for _, item := range res.Items {
+		if (item.ProductID == 0 && item.SKUID == 0) || item.Quantity <= 0 {
+			http.Error(w, "Invalid reservation item", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ttl := reservationTTL()
+	if res.TTLSeconds > 0 {
+		ttl = min(time.Duration(res.TTLSeconds)*time.Second, maxReservationTTL)
+	}
+
+	err := reserveStock(&res, ttl)
+	var shortage *shortageError
+	if errors.As(err, &shortage) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":     shortage.Error(),
+			"shortages": shortage.Shortages,
+		})
+		return
+	} else if isUniqueViolation(err) {
+		http.Error(w, "Order already has a reservation", http.StatusConflict)
+		return
+	} else if errors.Is(err, errSKUMismatch) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, errProductInactive) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("❌ Reservation failed:", err)
+		http.Error(w, "Reservation failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+
+func reservationItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid reservation ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res, err := getReservation(db, id)
+	if err == errReservationNotFound {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// reservationActionHandler serves POST /reservations/{id}/{action} where
+// action is commit (payment succeeded) or release (payment failed).
+func reservationActionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid reservation ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var status string
+	switch r.PathValue("action") {
+	case "commit":
+		status = ReservationCommitted
+	case "release":
+		status = ReservationReleased
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	res, err := finishReservation(id, status)
+	var shortage *shortageError
+	switch {
+	case errors.As(err, &shortage):
+		// Committing after expiry found the stock gone
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":     "reservation expired and " + shortage.Error(),
+			"shortages": shortage.Shortages,
+		})
+		return
+	case err == errReservationNotFound:
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	case err == errReservationClosed && res.Status == status:
+		// Repeated callbacks are harmless
+	case err == errReservationClosed:
+		http.Error(w, "Reservation is already "+res.Status, http.StatusConflict)
+		return
+	case err != nil:
+		log.Println("❌ Reservation update failed:", err)
+		http.Error(w, "Reservation update failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func reservationTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("RESERVATION_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultReservationTTL
+}
+
+// reserveStock holds res.Items against the reserved counters of inventories
+// (product lines) and skus (SKU lines). Rows are locked inventories first,
+// then skus, each in id order, so concurrent checkouts serialise per stock
+// row and cannot deadlock each other.
+func reserveStock(res *Reservation, ttl time.Duration) error {
+	// Collapse duplicate lines for the same product or SKU
+	type stockKey struct{ productID, skuID int }
+	wanted := map[stockKey]int{}
+	for _, item := range res.Items {
+		wanted[stockKey{item.ProductID, item.SKUID}] += item.Quantity
+	}
+	res.Items = res.Items[:0]
+	var productIDs, skuIDs []int64
+	for key, qty := range wanted {
+		res.Items = append(res.Items, ReservationItem{ProductID: key.productID, SKUID: key.skuID, Quantity: qty})
+		if key.skuID != 0 {
+			skuIDs = append(skuIDs, int64(key.skuID))
+		} else {
+			productIDs = append(productIDs, int64(key.productID))
+		}
+	}
+	sort.Slice(res.Items, func(i, j int) bool {
+		if res.Items[i].ProductID != res.Items[j].ProductID {
+			return res.Items[i].ProductID < res.Items[j].ProductID
+		}
+		return res.Items[i].SKUID < res.Items[j].SKUID
+	})
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	freeProducts, _, err := lockStock(tx, lockInventories, productIDs)
+	if err != nil {
+		return err
+	}
+	freeSKUs, skuProducts, err := lockStock(tx, lockSKUs, skuIDs)
+	if err != nil {
+		return err
+	}
+
+	var shortages []StockShortage
+	for i, item := range res.Items {
+		free := freeProducts[item.ProductID]
+		if item.SKUID != 0 {
+			owner, ok := skuProducts[item.SKUID]
+			if ok && item.ProductID != 0 && item.ProductID != owner {
+				return fmt.Errorf("%w: sku %d", errSKUMismatch, item.SKUID)
+			}
+			res.Items[i].ProductID = owner
+			free = freeSKUs[item.SKUID]
+		}
+		if free < item.Quantity {
+			shortages = append(shortages, StockShortage{
+				ProductID: res.Items[i].ProductID,
+				SKUID:     item.SKUID,
+				Requested: item.Quantity,
+				Available: free,
+			})
+		}
+	}
+	if err := checkProductsActive(tx, res.Items); err != nil {
+		return err
+	}
+	if len(shortages) > 0 {
+		return &shortageError{Shortages: shortages}
+	}
+
+	for _, item := range res.Items {
+		if _, err := tx.Exec(stockTable(item)+" SET reserved = reserved + $1 WHERE "+stockMatch(item),
+			item.Quantity, stockID(item)); err != nil {
+			return err
+		}
+	}
+
+	res.Status = ReservationHeld
+	err = tx.QueryRow(`
+        INSERT INTO reservations (order_id, status, expires_at)
+        VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second')
+        RETURNING id, expires_at, created_at
+    `, res.OrderID, res.Status, int(ttl.Seconds())).Scan(&res.ID, &res.ExpiresAt, &res.CreatedAt)
+	if err != nil {
+		return err
+	}
+	for _, item := range res.Items {
+		if _, err := tx.Exec(
+			"INSERT INTO reservation_items (reservation_id, product_id, sku_id, quantity) VALUES ($1, $2, $3, $4)",
+			res.ID, item.ProductID, sql.NullInt64{Int64: int64(item.SKUID), Valid: item.SKUID != 0}, item.Quantity,
+		); err != nil {
+			return err
+		}
+	}
+	res.TTLSeconds = 0
+	return tx.Commit()
+}
+
+// checkProductsActive refuses items whose product was archived or deleted;
+// only products on sale can be held.
+func checkProductsActive(tx *sql.Tx, items []ReservationItem) error {
+	ids := make([]int64, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, int64(item.ProductID))
+	}
+	var id int
+	err := tx.QueryRow(
+		"SELECT id FROM products WHERE id = ANY($1) AND status <> $2 ORDER BY id LIMIT 1",
+		pq.Array(ids), ProductActive,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: product %d", errProductInactive, id)
+}
+
+// lockInventories and lockSKUs lock stock rows for lockStock. Inventories
+// are always locked before skus.
+const (
+	lockInventories = `
+        SELECT product_id, product_id, quantity - reserved FROM inventories
+        WHERE product_id = ANY($1) ORDER BY product_id FOR UPDATE
+    `
+	lockSKUs = `
+        SELECT id, product_id, quantity - reserved FROM skus
+        WHERE id = ANY($1) ORDER BY id FOR UPDATE
+    `
+)
+
+// lockStock runs a locking query returning (stock id, product id, free units)
+// and maps stock id to free units and to its product.
+func lockStock(tx *sql.Tx, query string, ids []int64) (map[int]int, map[int]int, error) {
+	free, owners := map[int]int{}, map[int]int{}
+	if len(ids) == 0 {
+		return free, owners, nil
+	}
+	rows, err := tx.Query(query, pq.Array(ids))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, productID, n int
+		if err := rows.Scan(&id, &productID, &n); err != nil {
+			return nil, nil, err
+		}
+		free[id] = n
+		owners[id] = productID
+	}
+	return free, owners, rows.Err()
+}
+
+// stockTable, stockMatch and stockID address the row holding item's units.
+func stockTable(item ReservationItem) string {
+	if item.SKUID != 0 {
+		return "UPDATE skus"
+	}
+	return "UPDATE inventories"
+}
+
+func stockMatch(item ReservationItem) string {
+	if item.SKUID != 0 {
+		return "id = $2"
+	}
+	return "product_id = $2"
+}
+
+func stockID(item ReservationItem) int {
+	if item.SKUID != 0 {
+		return item.SKUID
+	}
+	return item.ProductID
+}
+
+// finishReservation moves a held reservation to status. Committing takes the
+// held units out of stock; releasing or expiring hands them back. When the
+// reservation is not held it returns errReservationClosed with the stored
+// reservation so callers can tell a repeat from a conflict.
+//
+// A payment can land after the sweep expired its reservation. Committing an
+// expired reservation takes the units again if they are still free, in the
+// same transaction, and otherwise fails with a *shortageError so the order
+// is not confirmed against stock someone else now holds.
+func finishReservation(id int, status string) (Reservation, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Reservation{}, err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow("SELECT status FROM reservations WHERE id = $1 FOR UPDATE", id).Scan(&current)
+	if err == sql.ErrNoRows {
+		return Reservation{}, errReservationNotFound
+	} else if err != nil {
+		return Reservation{}, err
+	}
+
+	res, err := getReservation(tx, id)
+	if err != nil {
+		return Reservation{}, err
+	}
+	reclaim := current == ReservationExpired && status == ReservationCommitted
+	if current != ReservationHeld && !reclaim {
+		return res, errReservationClosed
+	}
+	if reclaim {
+		shortages, err := lockFreeStock(tx, res.Items)
+		if err != nil {
+			return Reservation{}, err
+		}
+		if len(shortages) > 0 {
+			return res, &shortageError{Shortages: shortages}
+		}
+	}
+
+	// Lock stock rows in the same order reserveStock does
+	sort.Slice(res.Items, func(i, j int) bool {
+		a, b := res.Items[i], res.Items[j]
+		if (a.SKUID == 0) != (b.SKUID == 0) {
+			return a.SKUID == 0
+		}
+		return stockID(a) < stockID(b)
+	})
+	for _, item := range res.Items {
+		set := " SET reserved = reserved - $1 WHERE "
+		if reclaim {
+			// Expiry already took the units off reserved
+			set = " SET quantity = quantity - $1 WHERE "
+		} else if status == ReservationCommitted {
+			set = " SET quantity = quantity - $1, reserved = reserved - $1 WHERE "
+		}
+		if _, err := tx.Exec(stockTable(item)+set+stockMatch(item), item.Quantity, stockID(item)); err != nil {
+			return Reservation{}, err
+		}
+	}
+	if _, err := tx.Exec(
+		"UPDATE reservations SET status = $1, updated_at = NOW() WHERE id = $2", status, id,
+	); err != nil {
+		return Reservation{}, err
+	}
+
+	// Committed units leave stock, so the indexed quantity and possibly the
+	// stock state change
+	if status == ReservationCommitted {
+		refreshed := map[int]bool{}
+		for _, item := range res.Items {
+			if refreshed[item.ProductID] {
+				continue
+			}
+			refreshed[item.ProductID] = true
+			if err := checkStockLevel(tx, item.ProductID); err != nil {
+				return Reservation{}, err
+			}
+			if err := enqueueStockChanged(tx, item.ProductID); err != nil {
+				return Reservation{}, err
+			}
+			if err := enqueueProductRefresh(tx, item.ProductID); err != nil {
+				return Reservation{}, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return Reservation{}, err
+	}
+	res.Status = status
+	return res, nil
+}
+
+// lockFreeStock locks the stock rows of items in reserveStock's order and
+// reports the lines that no longer have enough free units.
+func lockFreeStock(tx *sql.Tx, items []ReservationItem) ([]StockShortage, error) {
+	var productIDs, skuIDs []int64
+	for _, item := range items {
+		if item.SKUID != 0 {
+			skuIDs = append(skuIDs, int64(item.SKUID))
+		} else {
+			productIDs = append(productIDs, int64(item.ProductID))
+		}
+	}
+	freeProducts, _, err := lockStock(tx, lockInventories, productIDs)
+	if err != nil {
+		return nil, err
+	}
+	freeSKUs, _, err := lockStock(tx, lockSKUs, skuIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var shortages []StockShortage
+	for _, item := range items {
+		free := freeProducts[item.ProductID]
+		if item.SKUID != 0 {
+			free = freeSKUs[item.SKUID]
+		}
+		if free < item.Quantity {
+			shortages = append(shortages, StockShortage{
+				ProductID: item.ProductID,
+				SKUID:     item.SKUID,
+				Requested: item.Quantity,
+				Available: free,
+			})
+		}
+	}
+	return shortages, nil
+}
+
+type querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func getReservation(q querier, id int) (Reservation, error) {
+	var res Reservation
+	err := q.QueryRow(
+		"SELECT id, order_id, status, expires_at, created_at FROM reservations WHERE id = $1", id,
+	).Scan(&res.ID, &res.OrderID, &res.Status, &res.ExpiresAt, &res.CreatedAt)
+	if err == sql.ErrNoRows {
+		return res, errReservationNotFound
+	} else if err != nil {
+		return res, err
+	}
+
+	rows, err := q.Query(`
+        SELECT product_id, COALESCE(sku_id, 0), quantity FROM reservation_items
+        WHERE reservation_id = $1 ORDER BY product_id, sku_id
+    `, id)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item ReservationItem
+		if err := rows.Scan(&item.ProductID, &item.SKUID, &item.Quantity); err != nil {
+			return res, err
+		}
+		res.Items = append(res.Items, item)
+	}
+	return res, rows.Err()
+}
+
+// expireReservations releases held reservations whose TTL has passed.
+func expireReservations(interval time.Duration) {
+	for range time.Tick(interval) {
+		rows, err := db.Query(
+			"SELECT id FROM reservations WHERE status = $1 AND expires_at < NOW()", ReservationHeld,
+		)
+		if err != nil {
+			log.Println("❌ Reservation expiry query failed:", err)
+			continue
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if rows.Scan(&id) == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+
+		for _, id := range ids {
+			// A commit that raced the sweep wins; the row is simply skipped
+			if _, err := finishReservation(id, ReservationExpired); err != nil && err != errReservationClosed {
+				log.Printf("❌ Failed to expire reservation %d: %v", id, err)
+			}
+		}
+		if len(ids) > 0 {
+			log.Printf("⏰ Expired %d stale reservations\n", len(ids))
+		}
+	}
+}
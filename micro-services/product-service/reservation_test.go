@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"mallhive/shared/migrate"
+)
+
+// useTestDatabase points db at a throwaway schema of TEST_DATABASE_URL with
+// every migration applied, e.g.
+// postgres://postgres@localhost/test?sslmode=disable. Without one the test
+// is skipped.
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	schema := "product_test_" + hex.EncodeToString(buf)
+
+	admin, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	conn, err := sql.Open("postgres", url+sep+"search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := migrate.Up(conn, migrationFiles); err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = conn
+	t.Cleanup(func() { db = saved })
+}
+
+// TestCommitSKUReservationStockLevel commits SKU reservations down to the
+// product's low-stock threshold and then out of stock; the alerts and the
+// availability follow the SKUs' stock.
+func TestCommitSKUReservationStockLevel(t *testing.T) {
+	useTestDatabase(t)
+	var productID, skuID int
+	err := db.QueryRow(`
+        INSERT INTO products (name, slug, category_id, price)
+        VALUES ('Test Tee', 'test-tee', (SELECT id FROM categories WHERE slug = 'clothing'), 10)
+        RETURNING id
+    `).Scan(&productID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The inventory row itself holds nothing; the SKU does
+	if _, err := db.Exec(`
+        INSERT INTO inventories (product_id, quantity, low_stock_threshold, stock_state)
+        VALUES ($1, 0, 5, 'in_stock')
+    `, productID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(
+		"INSERT INTO skus (product_id, code, quantity) VALUES ($1, 'TEST-TEE-M', 8) RETURNING id", productID,
+	).Scan(&skuID); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		quantity  int
+		state     string
+		event     string
+		available bool
+	}{
+		{4, StockLow, EventStockLow, true},         // 4 left, under the threshold of 5
+		{4, StockOutOfStock, EventStockOut, false}, // none left
+	}
+	for i, step := range steps {
+		res := Reservation{OrderID: 1000 + i, Items: []ReservationItem{{SKUID: skuID, Quantity: step.quantity}}}
+		if err := reserveStock(&res, time.Minute); err != nil {
+			t.Fatalf("step %d: reserve: %v", i, err)
+		}
+		if _, err := finishReservation(res.ID, ReservationCommitted); err != nil {
+			t.Fatalf("step %d: commit: %v", i, err)
+		}
+
+		var state string
+		var available bool
+		if err := db.QueryRow(`
+            SELECT i.stock_state, p.available FROM inventories i JOIN products p ON p.id = i.product_id
+            WHERE i.product_id = $1
+        `, productID).Scan(&state, &available); err != nil {
+			t.Fatal(err)
+		}
+		if state != step.state || available != step.available {
+			t.Errorf("step %d: stock %s, available %v, want %s and %v", i, state, available, step.state, step.available)
+		}
+		var alerts int
+		if err := db.QueryRow(
+			"SELECT COUNT(*) FROM outbox WHERE aggregate_id = $1 AND event_type = $2", productID, step.event,
+		).Scan(&alerts); err != nil {
+			t.Fatal(err)
+		}
+		if alerts == 0 {
+			t.Errorf("step %d: no %s event queued", i, step.event)
+		}
+	}
+}
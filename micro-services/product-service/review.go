@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reviewableStatuses are the order states that count as a completed
+// purchase in order-service.
+var reviewableStatuses = []string{"paid", "completed"}
+
+const reviewListLimit = 200
+
+// Review is one buyer's rating of a product. A user reviews a product at
+// most once and edits that review afterwards.
+type Review struct {
+	ID        int       `json:"id"`
+	ProductID int       `json:"product_id"`
+	UserID    int       `json:"user_id"`
+	Rating    int       `json:"rating"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const reviewColumns = "id, product_id, user_id, rating, title, body, created_at, updated_at"
+
+const reviewSelect = "SELECT " + reviewColumns + " FROM reviews"
+
+func scanReview(row rowScanner) (Review, error) {
+	var rv Review
+	err := row.Scan(&rv.ID, &rv.ProductID, &rv.UserID, &rv.Rating, &rv.Title, &rv.Body, &rv.CreatedAt, &rv.UpdatedAt)
+	return rv, err
+}
+
+var (
+	errNotPurchased   = errors.New("only buyers with a completed order can review this product")
+	errReviewExists   = errors.New("user has already reviewed this product")
+	errNotReviewOwner = errors.New("review belongs to another user")
+)
+
+func validateReview(rv Review) error {
+	if rv.Rating < 1 || rv.Rating > 5 {
+		return errors.New("rating must be between 1 and 5")
+	}
+	return nil
+}
+
+// reviewerID is the user a review request acts for: the subject of the
+// token requireUser checked, which for shoppers is their numeric user id.
+// It is never taken from the request body or query.
+func reviewerID(r *http.Request) (int, error) {
+	p, ok := requestPrincipal(r)
+	if !ok {
+		return 0, errMissingToken
+	}
+	id, err := strconv.Atoi(p.Subject)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%w: subject is not a user id", errInvalidToken)
+	}
+	return id, nil
+}
+
+// formatRating renders an average with the two decimals it is stored with.
+func formatRating(avg float64) string {
+	return strconv.FormatFloat(avg, 'f', 2, 64)
+}
+
+// reviewsHandler lists a product's reviews, newest first, and creates new
+// ones for verified buyers.
+func reviewsHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	if !productExists(w, productID) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query(
+			reviewSelect+" WHERE product_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2",
+			productID, reviewListLimit,
+		)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		reviews := []Review{}
+		for rows.Next() {
+			rv, err := scanReview(rows)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			reviews = append(reviews, rv)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reviews)
+
+	case http.MethodPost:
+		userID, err := reviewerID(r)
+		if err != nil {
+			writeUnauthorized(w)
+			return
+		}
+		var rv Review
+		if err := json.NewDecoder(r.Body).Decode(&rv); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		rv.ProductID = productID
+		rv.UserID = userID
+		if err := validateReview(rv); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		purchased, err := hasCompletedOrder(rv.UserID, productID)
+		if err != nil {
+			http.Error(w, "Could not verify purchase", http.StatusBadGateway)
+			return
+		}
+		if !purchased {
+			http.Error(w, errNotPurchased.Error(), http.StatusForbidden)
+			return
+		}
+
+		created, err := saveReview(rv)
+		if err == errReviewExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Database insert failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// reviewItemHandler reads, edits or deletes one review. Only the review's
+// author may edit or delete it.
+func reviewItemHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	reviewID, err := strconv.Atoi(r.PathValue("review_id"))
+	if err != nil {
+		http.Error(w, "Invalid review ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rv, err := scanReview(db.QueryRow(reviewSelect+" WHERE id = $1 AND product_id = $2", reviewID, productID))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Review not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rv)
+
+	case http.MethodPut:
+		userID, err := reviewerID(r)
+		if err != nil {
+			writeUnauthorized(w)
+			return
+		}
+		var rv Review
+		if err := json.NewDecoder(r.Body).Decode(&rv); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		rv.ID = reviewID
+		rv.ProductID = productID
+		rv.UserID = userID
+		if err := validateReview(rv); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		updated, err := saveReview(rv)
+		writeReviewResult(w, err, func() {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(updated)
+		})
+
+	case http.MethodDelete:
+		userID, err := reviewerID(r)
+		if err != nil {
+			writeUnauthorized(w)
+			return
+		}
+		err = deleteReview(productID, reviewID, userID)
+		writeReviewResult(w, err, func() { w.WriteHeader(http.StatusNoContent) })
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeReviewResult maps the outcome of an edit or delete to a response,
+// calling ok when there was no error.
+func writeReviewResult(w http.ResponseWriter, err error, ok func()) {
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Review not found", http.StatusNotFound)
+	case err == errNotReviewOwner:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case err != nil:
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+	default:
+		ok()
+	}
+}
+
+// hasCompletedOrder asks order-service, whose base URL is
+// ORDER_SERVICE_URL, whether userID has a paid or completed order
+// containing productID.
+func hasCompletedOrder(userID, productID int) (bool, error) {
+	q := url.Values{}
+	q.Set("user_id", strconv.Itoa(userID))
+	q.Set("product_id", strconv.Itoa(productID))
+	q.Set("status", strings.Join(reviewableStatuses, ","))
+
+	base := strings.TrimSuffix(os.Getenv("ORDER_SERVICE_URL"), "/")
+	resp, err := syncClient.Get(base + "/orders/?" + q.Encode())
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("order service returned %s", resp.Status)
+	}
+
+	var orders []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+		return false, err
+	}
+	return len(orders) > 0, nil
+}
+
+// saveReview creates rv, or updates it when rv.ID is set, and refreshes the
+// product's rating in the same transaction.
+func saveReview(rv Review) (Review, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return rv, err
+	}
+	defer tx.Rollback()
+
+	// The product row serialises rating updates for the product
+	if _, err := tx.Exec("SELECT 1 FROM products WHERE id = $1 FOR UPDATE", rv.ProductID); err != nil {
+		return rv, err
+	}
+
+	var saved Review
+	if rv.ID == 0 {
+		saved, err = scanReview(tx.QueryRow(`
+            INSERT INTO reviews (product_id, user_id, rating, title, body)
+            VALUES ($1, $2, $3, $4, $5)
+            RETURNING `+reviewColumns,
+			rv.ProductID, rv.UserID, rv.Rating, rv.Title, rv.Body))
+		if isUniqueViolation(err) {
+			return rv, errReviewExists
+		}
+	} else {
+		if err := checkReviewOwner(tx, rv.ProductID, rv.ID, rv.UserID); err != nil {
+			return rv, err
+		}
+		saved, err = scanReview(tx.QueryRow(`
+            UPDATE reviews SET rating = $1, title = $2, body = $3, updated_at = NOW()
+            WHERE id = $4
+            RETURNING `+reviewColumns,
+			rv.Rating, rv.Title, rv.Body, rv.ID))
+	}
+	if err != nil {
+		return rv, err
+	}
+
+	if err := refreshRating(tx, rv.ProductID); err != nil {
+		return rv, err
+	}
+	return saved, tx.Commit()
+}
+
+func deleteReview(productID, reviewID, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT 1 FROM products WHERE id = $1 FOR UPDATE", productID); err != nil {
+		return err
+	}
+	if err := checkReviewOwner(tx, productID, reviewID, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM reviews WHERE id = $1", reviewID); err != nil {
+		return err
+	}
+	if err := refreshRating(tx, productID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkReviewOwner returns sql.ErrNoRows when the review does not exist for
+// the product and errNotReviewOwner when userID did not write it.
+func checkReviewOwner(tx *sql.Tx, productID, reviewID, userID int) error {
+	var owner int
+	err := tx.QueryRow(
+		"SELECT user_id FROM reviews WHERE id = $1 AND product_id = $2", reviewID, productID,
+	).Scan(&owner)
+	if err != nil {
+		return err
+	}
+	if owner != userID {
+		return errNotReviewOwner
+	}
+	return nil
+}
+
+// refreshRating recomputes the product's average and count from its reviews
+// and queues the product for reindexing.
+func refreshRating(tx *sql.Tx, productID int) error {
+	if _, err := tx.Exec(`
+        UPDATE products SET
+            rating_average = COALESCE((SELECT ROUND(AVG(rating), 2) FROM reviews WHERE product_id = $1), 0),
+            rating_count = (SELECT COUNT(*) FROM reviews WHERE product_id = $1),
+            version = version + 1
+        WHERE id = $1
+    `, productID); err != nil {
+		return err
+	}
+	return enqueueProductRefresh(tx, productID)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHasCompletedOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    func(url string) string
+		orders  string
+		want    bool
+		wantErr bool
+	}{
+		{"has an order", func(u string) string { return u }, `[{"id": 3}]`, true, false},
+		{"no orders", func(u string) string { return u }, `null`, false, false},
+		{"trailing slash", func(u string) string { return u + "/" }, `[{"id": 3}]`, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Routed like order-service, which only serves /orders/
+			mux := http.NewServeMux()
+			mux.HandleFunc("/orders/", func(w http.ResponseWriter, r *http.Request) {
+				q := r.URL.Query()
+				if r.URL.Path != "/orders/" || q.Get("user_id") != "42" || q.Get("product_id") != "7" || q.Get("status") != "paid,completed" {
+					t.Errorf("order-service asked for %s", r.URL)
+				}
+				w.Write([]byte(tt.orders))
+			})
+			orders := httptest.NewServer(mux)
+			defer orders.Close()
+			t.Setenv("ORDER_SERVICE_URL", tt.base(orders.URL))
+
+			got, err := hasCompletedOrder(42, 7)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("hasCompletedOrder = %v, %v, want %v and error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
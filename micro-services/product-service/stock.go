@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Stock states kept on each inventory row so alerts fire on transitions only
+const (
+	StockInStock    = "in_stock"
+	StockLow        = "low_stock"
+	StockOutOfStock = "out_of_stock"
+)
+
+// Stock event types
+const (
+	EventStockLow       = "stock.low"
+	EventStockOut       = "stock.out"
+	EventStockRestocked = "stock.restocked"
+)
+
+const defaultLowStockThreshold = 5
+
+var stockDestinations = []string{DestNotification, DestAnalytics}
+
+// StockAlert is the payload of a stock event.
+type StockAlert struct {
+	Event     string    `json:"event"`
+	ProductID int       `json:"product_id"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	Category  string    `json:"category"`
+	State     string    `json:"state"`
+	Previous  string    `json:"previous_state"`
+	Quantity  int       `json:"quantity"`
+	Threshold int       `json:"low_stock_threshold"`
+	At        time.Time `json:"at"`
+}
+
+// stockState classifies quantity against the product's threshold.
+func stockState(quantity, threshold int) string {
+	switch {
+	case quantity <= 0:
+		return StockOutOfStock
+	case quantity < threshold:
+		return StockLow
+	default:
+		return StockInStock
+	}
+}
+
+// stockEvent names the transition from previous to state.
+func stockEvent(previous, state string) string {
+	switch {
+	case state == StockOutOfStock:
+		return EventStockOut
+	case state == StockLow && previous == StockInStock:
+		return EventStockLow
+	default:
+		return EventStockRestocked
+	}
+}
+
+// checkStockLevel compares the product's inventory with its threshold and,
+// when the stock state changed, records the new state and queues an alert.
+// A product with SKUs is stocked by them, so their summed quantity counts
+// instead of the inventory row's.
+// A product running out is taken off sale; it is put back on restock only
+// if it was this check that took it off. It must run in the transaction
+// that changed the quantity and before the product event is built, so the
+// event carries the new availability.
+func checkStockLevel(tx *sql.Tx, productID int) error {
+	var alert StockAlert
+	var status string
+	var available, disabled bool
+	err := tx.QueryRow(`
+        SELECT p.slug, p.name, c.slug, p.status, p.available,
+               COALESCE((SELECT SUM(s.quantity) FROM skus s WHERE s.product_id = i.product_id), i.quantity),
+               i.low_stock_threshold, i.stock_state, i.disabled_by_stock
+        FROM inventories i
+        JOIN products p ON p.id = i.product_id
+        JOIN categories c ON c.id = p.category_id
+        WHERE i.product_id = $1
+        FOR UPDATE OF i
+    `, productID).Scan(&alert.Slug, &alert.Name, &alert.Category, &status, &available,
+		&alert.Quantity, &alert.Threshold, &alert.Previous, &disabled)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	alert.State = stockState(alert.Quantity, alert.Threshold)
+	if alert.State == alert.Previous {
+		return nil
+	}
+
+	switch {
+	case alert.State == StockOutOfStock && available:
+		if err := setStockAvailability(tx, productID, false); err != nil {
+			return err
+		}
+		disabled = true
+	case alert.Previous == StockOutOfStock && disabled && status == ProductActive:
+		if err := setStockAvailability(tx, productID, true); err != nil {
+			return err
+		}
+		disabled = false
+	}
+	if _, err := tx.Exec(
+		"UPDATE inventories SET stock_state = $1, disabled_by_stock = $2 WHERE product_id = $3",
+		alert.State, disabled, productID,
+	); err != nil {
+		return err
+	}
+
+	alert.Event = stockEvent(alert.Previous, alert.State)
+	alert.ProductID = productID
+	alert.At = time.Now().UTC()
+	return enqueueStockEvent(tx, alert)
+}
+
+// setStockAvailability flips the product on or off sale on behalf of the
+// stock check and audits the change.
+func setStockAvailability(tx *sql.Tx, productID int, available bool) error {
+	if _, err := tx.Exec("UPDATE products SET available = $1, version = version + 1 WHERE id = $2", available, productID); err != nil {
+		return err
+	}
+	return insertAudit(tx, AuditEntry{
+		ProductID: productID, Actor: ActorStock, Action: AuditUpdated, Field: "available",
+		OldValue: json.RawMessage(strconv.FormatBool(!available)), NewValue: json.RawMessage(strconv.FormatBool(available)),
+	})
+}
+
+// enqueueStockEvent records alert for the notification and analytics
+// services.
+func enqueueStockEvent(tx execer, alert StockAlert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	for _, dest := range stockDestinations {
+		if _, err := tx.Exec(`
+            INSERT INTO outbox (aggregate_id, event_type, destination, payload)
+            VALUES ($1, $2, $3, $4)
+        `, alert.ProductID, alert.Event, dest, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyStockAlert emails STOCK_ALERT_EMAIL through the notification
+// service.
+func notifyStockAlert(payload []byte) error {
+	var alert StockAlert
+	if err := json.Unmarshal(payload, &alert); err != nil {
+		return err
+	}
+	to := os.Getenv("STOCK_ALERT_EMAIL")
+	if to == "" {
+		return fmt.Errorf("STOCK_ALERT_EMAIL is not set")
+	}
+
+	var subject string
+	switch alert.Event {
+	case EventStockOut:
+		subject = fmt.Sprintf("Out of stock: %s", alert.Name)
+	case EventStockLow:
+		subject = fmt.Sprintf("Low stock: %s", alert.Name)
+	default:
+		subject = fmt.Sprintf("Back in stock: %s", alert.Name)
+	}
+	body, _ := json.Marshal(map[string]string{
+		"to":      to,
+		"subject": subject,
+		"message": fmt.Sprintf("%s (product %d, %s) has %d units left; the low-stock threshold is %d.",
+			alert.Name, alert.ProductID, alert.Slug, alert.Quantity, alert.Threshold),
+	})
+	return postJSON(os.Getenv("NOTIFICATION_SERVICE_URL")+"/notify/email", "", body)
+}
+
+// trackStockAlert records alert as a system metric in the analytics
+// service. Stock events have no user, so the service itself is named.
+func trackStockAlert(payload []byte) error {
+	var alert StockAlert
+	if err := json.Unmarshal(payload, &alert); err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]any{
+		"user_id":        "product-service",
+		"event_type":     "system_metric",
+		"event_subtype":  alert.Event,
+		"source_service": "product-service",
+		"product_id":     strconv.Itoa(alert.ProductID),
+		"category":       alert.Category,
+		"value":          alert.Quantity,
+	})
+	return postJSON(os.Getenv("ANALYTICS_SERVICE_URL")+"/events", os.Getenv("ANALYTICS_API_KEY"), body)
+}
+
+// postJSON sends body to url, with a bearer token when one is given.
+func postJSON(url, token string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := syncClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("post to %s returned %s", url, resp.Status)
+	}
+	log.Println("📡 Stock alert sent to", url)
+	return nil
+}
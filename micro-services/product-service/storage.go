@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ObjectStore keeps uploaded files under slash-separated keys such as
+// products/12/3f9c.../original.jpg. The local filesystem store serves
+// laptop setups; an S3 bucket is another implementation of the same
+// interface.
+type ObjectStore interface {
+	Put(ctx context.Context, key, contentType string, r io.Reader) error
+	Delete(ctx context.Context, key string) error
+	// URL is where clients fetch the object from.
+	URL(key string) string
+}
+
+var imageStore ObjectStore
+
+// newObjectStore builds the store named by IMAGE_STORAGE. Only "local" is
+// built in; IMAGE_DIR and IMAGE_BASE_URL configure it.
+func newObjectStore() (ObjectStore, error) {
+	switch kind := os.Getenv("IMAGE_STORAGE"); kind {
+	case "", "local":
+		dir := os.Getenv("IMAGE_DIR")
+		if dir == "" {
+			dir = "images"
+		}
+		baseURL := os.Getenv("IMAGE_BASE_URL")
+		if baseURL == "" {
+			baseURL = "/images"
+		}
+		return newLocalStore(dir, baseURL)
+	default:
+		return nil, fmt.Errorf("unknown IMAGE_STORAGE %q", kind)
+	}
+}
+
+// localStore writes objects below dir and serves them under baseURL.
+type localStore struct {
+	dir     string
+	baseURL string
+}
+
+func newLocalStore(dir, baseURL string) (*localStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &localStore{dir: dir, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+func (s *localStore) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if clean == "." || filepath.IsAbs(clean) || strings.HasPrefix(clean, "..") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.dir, clean), nil
+}
+
+// Put writes to a temporary file first so a reader never sees half an
+// object.
+func (s *localStore) Put(_ context.Context, key, _ string, r io.Reader) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localStore) Delete(_ context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localStore) URL(key string) string {
+	return s.baseURL + "/" + key
+}
+
+// Handler serves the stored files, for setups without a separate web
+// server in front of dir.
+func (s *localStore) Handler() http.Handler {
+	return http.StripPrefix(s.baseURL+"/", http.FileServer(http.Dir(s.dir)))
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"mallhive/shared/money"
+)
+
+// ProductOption is one variant axis, e.g. size with choices 40, 41, 42.
+// An empty Choices list accepts any value.
+type ProductOption struct {
+	Name    string   `json:"name"`
+	Choices []string `json:"choices"`
+}
+
+// SKU is a sellable variant of a product with its own stock and optional
+// price override.
+type SKU struct {
+	ID            int               `json:"id"`
+	ProductID     int               `json:"product_id"`
+	Code          string            `json:"code"`
+	Options       map[string]string `json:"options"`
+	PriceOverride *money.Money      `json:"price_override"`
+	Price         money.Money       `json:"price"` // effective price
+	WasPrice      *money.Money      `json:"was_price,omitempty"`
+	Available     bool              `json:"available"`
+	StockQuantity int               `json:"stock_quantity"`
+	WeightGrams   int               `json:"weight_grams"` // the product's
+	Category      string            `json:"category"`     // the product's category slug
+	Status        string            `json:"status"`       // the product's
+}
+
+// skuSelect reads a SKU with its effective price and availability. A running
+// product sale applies to SKUs without their own price. Prices are in the
+// product's currency.
+const skuSelect = `
+    SELECT s.id, s.product_id, s.code, s.options, p.currency, s.price::text,
+           COALESCE(s.price, p.sale_price, p.price)::text,
+           CASE WHEN s.price IS NULL AND p.sale_price IS NOT NULL THEN p.price END::text,
+           s.available AND p.available, s.quantity, p.weight_grams, c.slug, p.status
+    FROM skus s
+    JOIN products p ON p.id = s.product_id
+    JOIN categories c ON c.id = p.category_id`
+
+func scanSKU(row rowScanner) (SKU, error) {
+	var s SKU
+	var options []byte
+	var currency, price string
+	var override, was sql.NullString
+	if err := row.Scan(&s.ID, &s.ProductID, &s.Code, &options, &currency, &override, &price, &was,
+		&s.Available, &s.StockQuantity, &s.WeightGrams, &s.Category, &s.Status); err != nil {
+		return s, err
+	}
+	var err error
+	if s.Price, err = money.Parse(price, currency); err != nil {
+		return s, err
+	}
+	if s.PriceOverride, err = parseNullMoney(override, currency); err != nil {
+		return s, err
+	}
+	if s.WasPrice, err = parseNullMoney(was, currency); err != nil {
+		return s, err
+	}
+	return s, json.Unmarshal(options, &s.Options)
+}
+
+// parseNullMoney parses an optional price column read as text.
+func parseNullMoney(s sql.NullString, currency string) (*money.Money, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	m, err := money.Parse(s.String, currency)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+var errSKUOptions = errors.New("invalid sku options")
+
+func productOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	if !productExists(w, productID) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		options, err := getProductOptions(db, productID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(options)
+
+	case http.MethodPut:
+		var options []ProductOption
+		if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		seen := map[string]bool{}
+		for i := range options {
+			options[i].Name = strings.ToLower(strings.TrimSpace(options[i].Name))
+			if options[i].Name == "" || seen[options[i].Name] {
+				http.Error(w, "Option names must be unique and non-empty", http.StatusBadRequest)
+				return
+			}
+			seen[options[i].Name] = true
+			if options[i].Choices == nil {
+				options[i].Choices = []string{}
+			}
+		}
+
+		err := replaceProductOptions(productID, options)
+		if errors.Is(err, errSKUOptions) {
+			http.Error(w, "Existing SKUs do not fit the new options: "+err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(options)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func productSKUsHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	if !productExists(w, productID) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		view, err := newPriceView(r)
+		if err != nil {
+			writeCurrencyError(w, err)
+			return
+		}
+		skus, err := getProductSKUs(productID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		for i := range skus {
+			if err := view.sku(&skus[i]); err != nil {
+				writeCurrencyError(w, err)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(skus)
+
+	case http.MethodPost:
+		s := SKU{Available: true}
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		s.ProductID = productID
+		saveSKU(w, s, http.StatusCreated)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func productSKUItemHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	skuID, err := strconv.Atoi(r.PathValue("sku_id"))
+	if err != nil {
+		http.Error(w, "Invalid SKU ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		view, err := newPriceView(r)
+		if err != nil {
+			writeCurrencyError(w, err)
+			return
+		}
+		s, err := scanSKU(db.QueryRow(skuSelect+" WHERE s.id = $1 AND s.product_id = $2", skuID, productID))
+		if err == nil && !visibleTo(r, s.Status) {
+			err = sql.ErrNoRows
+		}
+		if err == sql.ErrNoRows {
+			http.Error(w, "SKU not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err := view.sku(&s); err != nil {
+			writeCurrencyError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+
+	case http.MethodPut:
+		s := SKU{Available: true}
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		s.ID = skuID
+		s.ProductID = productID
+		saveSKU(w, s, http.StatusOK)
+
+	case http.MethodDelete:
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		res, err := tx.Exec("DELETE FROM skus WHERE id = $1 AND product_id = $2", skuID, productID)
+		if isForeignKeyViolation(err) {
+			http.Error(w, "SKU is referenced by reservations", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Database delete failed", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "SKU not found", http.StatusNotFound)
+			return
+		}
+		if err := checkStockLevel(tx, productID); err != nil {
+			http.Error(w, "Database delete failed", http.StatusInternalServerError)
+			return
+		}
+		if err := enqueueProductRefresh(tx, productID); err != nil {
+			http.Error(w, "Database delete failed", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database delete failed", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// skuByCodeHandler serves GET /skus/{code}.
+func skuByCodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	view, err := newPriceView(r)
+	if err != nil {
+		writeCurrencyError(w, err)
+		return
+	}
+	s, err := scanSKU(db.QueryRow(skuSelect+" WHERE s.code = $1", strings.ToUpper(r.PathValue("code"))))
+	if err == nil && !visibleTo(r, s.Status) {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "SKU not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := view.sku(&s); err != nil {
+		writeCurrencyError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// productExists writes a 404 or 500 and returns false when productID
+// cannot be used.
+func productExists(w http.ResponseWriter, productID int) bool {
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)", productID).Scan(&exists); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if !exists {
+		http.Error(w, "Product not found", http.StatusNotFound)
+	}
+	return exists
+}
+
+func getProductOptions(q querier, productID int) ([]ProductOption, error) {
+	rows, err := q.Query(
+		"SELECT name, choices FROM product_options WHERE product_id = $1 ORDER BY position", productID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	options := []ProductOption{}
+	for rows.Next() {
+		var o ProductOption
+		if err := rows.Scan(&o.Name, pq.Array(&o.Choices)); err != nil {
+			return nil, err
+		}
+		options = append(options, o)
+	}
+	return options, rows.Err()
+}
+
+func getProductSKUs(productID int) ([]SKU, error) {
+	rows, err := db.Query(skuSelect+" WHERE s.product_id = $1 ORDER BY s.id", productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	skus := []SKU{}
+	for rows.Next() {
+		s, err := scanSKU(rows)
+		if err != nil {
+			return nil, err
+		}
+		skus = append(skus, s)
+	}
+	return skus, rows.Err()
+}
+
+// replaceProductOptions swaps the option axes, refusing when an existing
+// SKU would no longer match them.
+func replaceProductOptions(productID int, options []ProductOption) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM product_options WHERE product_id = $1", productID); err != nil {
+		return err
+	}
+	for i, o := range options {
+		if _, err := tx.Exec(
+			"INSERT INTO product_options (product_id, name, choices, position) VALUES ($1, $2, $3, $4)",
+			productID, o.Name, pq.Array(o.Choices), i,
+		); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(skuSelect+" WHERE s.product_id = $1 FOR UPDATE OF s", productID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s, err := scanSKU(rows)
+		if err != nil {
+			return err
+		}
+		if err := validateSKUOptions(options, s.Options); err != nil {
+			return fmt.Errorf("%s: %w", s.Code, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// validateSKUOptions requires exactly one valid value per option axis.
+func validateSKUOptions(axes []ProductOption, values map[string]string) error {
+	if len(values) != len(axes) {
+		names := make([]string, len(axes))
+		for i, a := range axes {
+			names[i] = a.Name
+		}
+		return fmt.Errorf("%w: expected values for [%s]", errSKUOptions, strings.Join(names, ", "))
+	}
+	for _, a := range axes {
+		v, ok := values[a.Name]
+		if !ok {
+			return fmt.Errorf("%w: missing %s", errSKUOptions, a.Name)
+		}
+		if len(a.Choices) > 0 && !slices.Contains(a.Choices, v) {
+			return fmt.Errorf("%w: %q is not a valid %s", errSKUOptions, v, a.Name)
+		}
+	}
+	return nil
+}
+
+// saveSKU inserts s, or overwrites it when s.ID is set, and writes the
+// stored SKU back with status.
+func saveSKU(w http.ResponseWriter, s SKU, status int) {
+	if s.PriceOverride != nil && s.PriceOverride.Amount < 0 {
+		http.Error(w, "price_override must not be negative", http.StatusBadRequest)
+		return
+	}
+	if s.StockQuantity < 0 {
+		http.Error(w, "stock_quantity must not be negative", http.StatusBadRequest)
+		return
+	}
+	if s.Options == nil {
+		s.Options = map[string]string{}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	axes, err := getProductOptions(tx, s.ProductID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := validateSKUOptions(axes, s.Options); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The override is stored in the product's currency
+	var slug, currency string
+	if err := tx.QueryRow("SELECT slug, currency FROM products WHERE id = $1 FOR SHARE", s.ProductID).Scan(&slug, &currency); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if s.PriceOverride != nil {
+		override := s.PriceOverride.In(currency)
+		if override.Currency != currency {
+			http.Error(w, "price_override must be in "+currency, http.StatusBadRequest)
+			return
+		}
+		s.PriceOverride = &override
+	}
+	if s.Code == "" {
+		s.Code = skuCode(slug, axes, s.Options)
+	}
+	s.Code = strings.ToUpper(s.Code)
+
+	options, _ := json.Marshal(s.Options)
+
+	if s.ID == 0 {
+		err = tx.QueryRow(`
+            INSERT INTO skus (product_id, code, options, price, available, quantity)
+            VALUES ($1, $2, $3, $4, $5, $6) RETURNING id
+        `, s.ProductID, s.Code, options, s.PriceOverride, s.Available, s.StockQuantity).Scan(&s.ID)
+	} else {
+		var res sql.Result
+		res, err = tx.Exec(`
+            UPDATE skus SET code = $1, options = $2, price = $3, available = $4, quantity = $5
+            WHERE id = $6 AND product_id = $7
+        `, s.Code, options, s.PriceOverride, s.Available, s.StockQuantity, s.ID, s.ProductID)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "SKU not found", http.StatusNotFound)
+				return
+			}
+		}
+	}
+	switch {
+	case isUniqueViolation(err):
+		http.Error(w, "SKU code or option combination already exists", http.StatusConflict)
+		return
+	case isCheckViolation(err):
+		http.Error(w, "Stock quantity below reserved units", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Database write failed", http.StatusInternalServerError)
+		return
+	}
+
+	if err := checkStockLevel(tx, s.ProductID); err != nil {
+		http.Error(w, "Database write failed", http.StatusInternalServerError)
+		return
+	}
+	if err := enqueueProductRefresh(tx, s.ProductID); err != nil {
+		http.Error(w, "Database write failed", http.StatusInternalServerError)
+		return
+	}
+	stored, err := scanSKU(tx.QueryRow(skuSelect+" WHERE s.id = $1", s.ID))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database write failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(stored)
+}
+
+// skuCode derives a code from the product slug and option values in axis
+// order, e.g. NIKE-SHOES-42-RED.
+func skuCode(slug string, axes []ProductOption, values map[string]string) string {
+	parts := []string{slug}
+	for _, a := range axes {
+		parts = append(parts, slugify(values[a.Name]))
+	}
+	return strings.ToUpper(strings.Join(parts, "-"))
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"mallhive/shared/money"
+)
+
+// Events subscribers can register for besides the product lifecycle ones
+const (
+	EventPriceChanged = "price.changed"
+	EventStockChanged = "stock.changed"
+)
+
+var webhookEventTypes = []string{
+	EventProductCreated, EventProductUpdated, EventProductDeleted, EventPriceChanged, EventStockChanged,
+}
+
+const webhookDeliveryLimit = 200
+
+// errSubscriptionPaused means the subscription was paused after its entry
+// was claimed. Paused subscriptions keep their entries queued.
+var errSubscriptionPaused = errors.New("subscription is paused")
+
+// WebhookSubscription is a registered receiver. The secret signs every
+// delivery and is only returned when the subscription is created.
+type WebhookSubscription struct {
+	ID          int       `json:"id"`
+	URL         string    `json:"url"`
+	EventTypes  []string  `json:"event_types"`
+	Description string    `json:"description"`
+	Active      bool      `json:"active"`
+	Secret      string    `json:"secret,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// WebhookDelivery logs one attempt to deliver an outbox entry.
+type WebhookDelivery struct {
+	ID             int64     `json:"id"`
+	OutboxID       int64     `json:"outbox_id"`
+	EventType      string    `json:"event_type"`
+	Attempt        int       `json:"attempt"`
+	ResponseStatus int       `json:"response_status,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	DurationMilli  int64     `json:"duration_ms"`
+	EntryStatus    string    `json:"entry_status"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// PriceChangedEvent is the price.changed payload.
+type PriceChangedEvent struct {
+	ProductID      int          `json:"product_id"`
+	Slug           string       `json:"slug"`
+	Price          money.Money  `json:"price"`
+	SalePrice      *money.Money `json:"sale_price,omitempty"`
+	EffectivePrice money.Money  `json:"effective_price"`
+	Source         string       `json:"source"`
+	ScheduleID     int          `json:"schedule_id,omitempty"`
+	ChangedAt      time.Time    `json:"changed_at"`
+}
+
+// StockChangedEvent is the stock.changed payload.
+type StockChangedEvent struct {
+	ProductID         int       `json:"product_id"`
+	Slug              string    `json:"slug"`
+	Quantity          int       `json:"quantity"`
+	Reserved          int       `json:"reserved"`
+	LowStockThreshold int       `json:"low_stock_threshold"`
+	StockState        string    `json:"stock_state"`
+	Available         bool      `json:"available"`
+	ChangedAt         time.Time `json:"changed_at"`
+}
+
+const webhookColumns = "id, url, event_types, description, active, created_at"
+
+func scanWebhook(row rowScanner) (WebhookSubscription, error) {
+	var s WebhookSubscription
+	err := row.Scan(&s.ID, &s.URL, pq.Array(&s.EventTypes), &s.Description, &s.Active, &s.CreatedAt)
+	return s, err
+}
+
+func validateWebhook(s WebhookSubscription) error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if len(s.EventTypes) == 0 {
+		return errors.New("event_types must not be empty")
+	}
+	for _, t := range s.EventTypes {
+		if !contains(webhookEventTypes, t) {
+			return fmt.Errorf("unknown event type %q", t)
+		}
+	}
+	return nil
+}
+
+// enqueueWebhookEvent queues payload for every active subscription to
+// event, in the caller's transaction.
+func enqueueWebhookEvent(tx execer, event string, aggregateID int, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+        INSERT INTO outbox (aggregate_id, event_type, destination, subscription_id, payload)
+        SELECT $1, $2, $3, id, $4 FROM webhook_subscriptions
+        WHERE active AND $2 = ANY(event_types)
+    `, aggregateID, event, DestWebhook, data)
+	return err
+}
+
+// enqueuePriceChanged queues price.changed with the product's prices as tx
+// sees them.
+func enqueuePriceChanged(tx *sql.Tx, productID int, source string, scheduleID int) error {
+	ev := PriceChangedEvent{ProductID: productID, Source: source, ScheduleID: scheduleID, ChangedAt: time.Now().UTC()}
+	var currency, price string
+	var sale sql.NullString
+	err := tx.QueryRow(
+		"SELECT slug, currency, price::text, sale_price::text FROM products WHERE id = $1", productID,
+	).Scan(&ev.Slug, &currency, &price, &sale)
+	if err != nil {
+		return err
+	}
+	if ev.Price, err = money.Parse(price, currency); err != nil {
+		return err
+	}
+	if ev.SalePrice, err = parseNullMoney(sale, currency); err != nil {
+		return err
+	}
+	ev.EffectivePrice = ev.Price
+	if ev.SalePrice != nil {
+		ev.EffectivePrice = *ev.SalePrice
+	}
+	return enqueueWebhookEvent(tx, EventPriceChanged, productID, ev)
+}
+
+// enqueueStockChanged queues stock.changed with the product's inventory as
+// tx sees it. Call it after checkStockLevel so the state is current.
+func enqueueStockChanged(tx *sql.Tx, productID int) error {
+	ev := StockChangedEvent{ProductID: productID, ChangedAt: time.Now().UTC()}
+	err := tx.QueryRow(`
+        SELECT p.slug, i.quantity, i.reserved, i.low_stock_threshold, i.stock_state, p.available
+        FROM inventories i JOIN products p ON p.id = i.product_id
+        WHERE i.product_id = $1
+    `, productID).Scan(&ev.Slug, &ev.Quantity, &ev.Reserved, &ev.LowStockThreshold, &ev.StockState, &ev.Available)
+	if err != nil {
+		return err
+	}
+	return enqueueWebhookEvent(tx, EventStockChanged, productID, ev)
+}
+
+// signWebhook computes the X-Webhook-Signature value over the timestamp and
+// body, so a captured delivery cannot be replayed with a new timestamp.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook posts e to its subscription and logs the attempt. The body
+// wraps the stored payload in an envelope naming the event and delivery.
+func deliverWebhook(e OutboxEntry) error {
+	if e.SubscriptionID == nil {
+		return errors.New("webhook entry without subscription")
+	}
+	var target, secret string
+	var active bool
+	err := db.QueryRow(
+		"SELECT url, secret, active FROM webhook_subscriptions WHERE id = $1", *e.SubscriptionID,
+	).Scan(&target, &secret, &active)
+	if err != nil {
+		return fmt.Errorf("load subscription %d: %w", *e.SubscriptionID, err)
+	}
+	if !active {
+		return fmt.Errorf("%w: %d", errSubscriptionPaused, *e.SubscriptionID)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"id":         e.ID,
+		"event":      e.EventType,
+		"created_at": e.CreatedAt,
+		"data":       e.Payload,
+	})
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", e.EventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(e.ID, 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", signWebhook(secret, timestamp, body))
+
+	start := time.Now()
+	status := 0
+	resp, err := syncClient.Do(req)
+	if err == nil {
+		status = resp.StatusCode
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		if status < 200 || status >= 300 {
+			err = fmt.Errorf("webhook %d returned %s", *e.SubscriptionID, resp.Status)
+		}
+	}
+	logWebhookAttempt(e, status, err, time.Since(start))
+	return err
+}
+
+func logWebhookAttempt(e OutboxEntry, status int, deliveryErr error, took time.Duration) {
+	var errText sql.NullString
+	if deliveryErr != nil {
+		errText = sql.NullString{String: deliveryErr.Error(), Valid: true}
+	}
+	_, err := db.Exec(`
+        INSERT INTO webhook_deliveries (subscription_id, outbox_id, event_type, attempt, response_status, error, duration_ms)
+        VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6, $7)
+    `, *e.SubscriptionID, e.ID, e.EventType, e.Attempts+1, status, errText, took.Milliseconds())
+	if err != nil {
+		log.Printf("❌ Failed to log webhook delivery %d: %v", e.ID, err)
+	}
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// webhooksHandler lists and registers subscriptions.
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query("SELECT " + webhookColumns + " FROM webhook_subscriptions ORDER BY id")
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		subs := []WebhookSubscription{}
+		for rows.Next() {
+			s, err := scanWebhook(rows)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			subs = append(subs, s)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subs)
+
+	case http.MethodPost:
+		s := WebhookSubscription{Active: true}
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		if err := validateWebhook(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.Secret == "" {
+			secret, err := newWebhookSecret()
+			if err != nil {
+				http.Error(w, "Could not generate secret", http.StatusInternalServerError)
+				return
+			}
+			s.Secret = secret
+		}
+		secret := s.Secret
+		s, err := scanWebhook(db.QueryRow(`
+            INSERT INTO webhook_subscriptions (url, event_types, description, active, secret)
+            VALUES ($1, $2, $3, $4, $5)
+            RETURNING `+webhookColumns,
+			s.URL, pq.Array(s.EventTypes), s.Description, s.Active, s.Secret))
+		if err != nil {
+			http.Error(w, "Database insert failed", http.StatusInternalServerError)
+			return
+		}
+		s.Secret = secret
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookItemHandler reads, changes or removes one subscription. Removing
+// it drops its undelivered entries and delivery log.
+func webhookItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s, err := scanWebhook(db.QueryRow("SELECT "+webhookColumns+" FROM webhook_subscriptions WHERE id = $1", id))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+
+	case http.MethodPut:
+		var s WebhookSubscription
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		if err := validateWebhook(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The secret only changes when a new one is supplied
+		s, err = scanWebhook(db.QueryRow(`
+            UPDATE webhook_subscriptions
+            SET url = $1, event_types = $2, description = $3, active = $4, secret = COALESCE(NULLIF($5, ''), secret)
+            WHERE id = $6
+            RETURNING `+webhookColumns,
+			s.URL, pq.Array(s.EventTypes), s.Description, s.Active, s.Secret, id))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+
+	case http.MethodDelete:
+		res, err := db.Exec("DELETE FROM webhook_subscriptions WHERE id = $1", id)
+		if err != nil {
+			http.Error(w, "Database delete failed", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookDeliveriesHandler serves GET /webhooks/{id}/deliveries, the
+// attempt log newest first with each entry's current outbox status.
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.Query(`
+        SELECT d.id, d.outbox_id, d.event_type, d.attempt, COALESCE(d.response_status, 0),
+               COALESCE(d.error, ''), d.duration_ms, COALESCE(o.status, ''), d.created_at
+        FROM webhook_deliveries d
+        LEFT JOIN outbox o ON o.id = d.outbox_id
+        WHERE d.subscription_id = $1
+        ORDER BY d.id DESC LIMIT $2
+    `, id, webhookDeliveryLimit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.OutboxID, &d.EventType, &d.Attempt, &d.ResponseStatus,
+			&d.Error, &d.DurationMilli, &d.EntryStatus, &d.CreatedAt); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// webhookReplayHandler serves POST /webhooks/{id}/replay?outbox_id=N or
+// ?since=RFC3339. The matching entries of the subscription are queued
+// again as new deliveries, in their original order.
+func webhookReplayHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var filter string
+	var arg any
+	q := r.URL.Query()
+	switch {
+	case q.Get("outbox_id") != "":
+		outboxID, err := strconv.ParseInt(q.Get("outbox_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid outbox_id", http.StatusBadRequest)
+			return
+		}
+		filter, arg = "id = $3", outboxID
+	case q.Get("since") != "":
+		since, err := time.Parse(time.RFC3339, q.Get("since"))
+		if err != nil {
+			http.Error(w, "Invalid since, use RFC 3339", http.StatusBadRequest)
+			return
+		}
+		filter, arg = "created_at >= $3", since
+	default:
+		http.Error(w, "Give outbox_id or since", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec(`
+        INSERT INTO outbox (aggregate_id, event_type, destination, subscription_id, payload)
+        SELECT aggregate_id, event_type, destination, subscription_id, payload FROM outbox
+        WHERE destination = $1 AND subscription_id = $2 AND `+filter+`
+        ORDER BY id
+    `, DestWebhook, id, arg)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	n, _ := res.RowsAffected()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int64{"queued": n})
+}
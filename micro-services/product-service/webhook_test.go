@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/hmac"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receiverTolerance is how old a delivery a subscriber following the
+// documented scheme accepts.
+const receiverTolerance = 5 * time.Minute
+
+// verifyAsReceiver checks a delivery the way a subscriber would: the scheme,
+// the timestamp's age, then the signature over "<timestamp>.<body>".
+func verifyAsReceiver(secret string, timestamp int64, body []byte, signature string, now time.Time) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	if age := now.Sub(time.Unix(timestamp, 0)); age > receiverTolerance || age < -receiverTolerance {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(signWebhook(secret, timestamp, body)))
+}
+
+func TestSignWebhook(t *testing.T) {
+	// printf '1700000000.{"event":"product.updated"}' | openssl dgst -sha256 -hmac whsec_test
+	got := signWebhook("whsec_test", 1700000000, []byte(`{"event":"product.updated"}`))
+	want := "sha256=e210697de10d6520b5411bfdbe9674df1dfed36fc61cd35b5bda08d651a7a401"
+	if got != want {
+		t.Errorf("signWebhook = %s, want %s", got, want)
+	}
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	const secret = "whsec_test"
+	now := time.Unix(1700000000, 0)
+	ts := now.Unix()
+	body := []byte(`{"id":7,"event":"price.changed","data":{"product_id":3}}`)
+	sig := signWebhook(secret, ts, body)
+	flipped := []byte(sig)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp int64
+		body      string
+		signature string
+		want      bool
+	}{
+		{"valid", secret, ts, string(body), sig, true},
+		{"a minute old", secret, ts - 60, string(body), signWebhook(secret, ts-60, body), true},
+		{"expired", secret, ts - 600, string(body), signWebhook(secret, ts-600, body), false},
+		{"replayed with a new timestamp", secret, ts + 60, string(body), sig, false},
+		{"tampered body", secret, ts, strings.Replace(string(body), `"product_id":3`, `"product_id":4`, 1), sig, false},
+		{"tampered signature", secret, ts, string(body), string(flipped), false},
+		{"wrong secret", "whsec_other", ts, string(body), sig, false},
+		{"wrong algorithm", secret, ts, string(body), "sha1=" + strings.TrimPrefix(sig, "sha256="), false},
+		{"unsigned", secret, ts, string(body), "", false},
+	}
+	for _, tt := range tests {
+		if got := verifyAsReceiver(tt.secret, tt.timestamp, []byte(tt.body), tt.signature, now); got != tt.want {
+			t.Errorf("%s: verified = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
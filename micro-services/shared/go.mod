@@ -0,0 +1,5 @@
+module mallhive/shared
+
+go 1.22.2
+
+require github.com/lib/pq v1.10.9
@@ -0,0 +1,308 @@
+// Package migrate applies a service's schema migrations: SQL files named
+// NNNN_name.up.sql and NNNN_name.down.sql, usually embedded in the binary.
+// Applied versions are recorded in schema_migrations; each migration runs
+// in its own transaction together with its bookkeeping row.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Advisory lock held while migrating, so replicas starting together take
+// turns instead of racing each other.
+const migrationLockID = 720_384_111
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// State is one known or applied migration, for `migrate status`.
+type State struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	Unknown   bool // applied, but not shipped with this build
+}
+
+// Load reads the migrations at the root of files in version order. Every
+// version must have both an up and a down file.
+func Load(files fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		m := migrationName.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: name must be NNNN_name.up.sql or NNNN_name.down.sql", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		body, err := fs.ReadFile(files, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// withMigrationLock runs fn on a single connection holding the migration
+// lock, after making sure schema_migrations exists.
+func withMigrationLock(db *sql.DB, fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	if _, err := conn.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INTEGER PRIMARY KEY,
+            name TEXT NOT NULL,
+            applied_at TIMESTAMP NOT NULL DEFAULT NOW()
+        )
+    `); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func appliedVersions(conn *sql.Conn) (map[int]State, error) {
+	rows, err := conn.QueryContext(context.Background(), "SELECT version, name, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]State{}
+	for rows.Next() {
+		var s State
+		var at time.Time
+		if err := rows.Scan(&s.Version, &s.Name, &at); err != nil {
+			return nil, err
+		}
+		s.AppliedAt = &at
+		applied[s.Version] = s
+	}
+	return applied, rows.Err()
+}
+
+// runMigration applies or reverts m in one transaction.
+func runMigration(conn *sql.Conn, m Migration, up bool) error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	script, record := m.Down, "DELETE FROM schema_migrations WHERE version = $1"
+	if up {
+		script, record = m.Up, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)"
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+	}
+	args := []any{m.Version}
+	if up {
+		args = append(args, m.Name)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Up applies every pending migration in version order and returns the ones
+// it applied.
+func Up(db *sql.DB, files fs.FS) ([]Migration, error) {
+	migrations, err := Load(files)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	err = withMigrationLock(db, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := runMigration(conn, m, true); err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the latest steps applied migrations, newest first, and
+// returns the ones it reverted.
+func Down(db *sql.DB, files fs.FS, steps int) ([]Migration, error) {
+	migrations, err := Load(files)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	err = withMigrationLock(db, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		known := map[int]bool{}
+		for _, m := range migrations {
+			known[m.Version] = true
+		}
+		for v := range applied {
+			if !known[v] {
+				return fmt.Errorf("database has migration %d, which this build does not know how to revert", v)
+			}
+		}
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if err := runMigration(conn, m, false); err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status lists every migration in files, plus any the database has applied
+// that files lacks, in version order.
+func Status(db *sql.DB, files fs.FS) ([]State, error) {
+	migrations, err := Load(files)
+	if err != nil {
+		return nil, err
+	}
+	var states []State
+	err = withMigrationLock(db, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			s := State{Version: m.Version, Name: m.Name}
+			if a, ok := applied[m.Version]; ok {
+				s.AppliedAt = a.AppliedAt
+				delete(applied, m.Version)
+			}
+			states = append(states, s)
+		}
+		for _, a := range applied {
+			a.Unknown = true
+			states = append(states, a)
+		}
+		return nil
+	})
+	sort.Slice(states, func(i, j int) bool { return states[i].Version < states[j].Version })
+	return states, err
+}
+
+// Run handles `migrate up`, `migrate down [n]` and `migrate status`. Down
+// reverts one migration unless n says otherwise.
+func Run(db *sql.DB, files fs.FS, args []string) error {
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	switch cmd {
+	case "up":
+		done, err := Up(db, files)
+		for _, m := range done {
+			fmt.Printf("applied  %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("down takes a positive number of migrations, got %q", args[1])
+			}
+			steps = n
+		}
+		done, err := Down(db, files, steps)
+		for _, m := range done {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		states, err := Status(db, files)
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			switch {
+			case s.Unknown:
+				fmt.Printf("%04d_%s\tapplied %s, not in this build\n", s.Version, s.Name, s.AppliedAt.Format(time.RFC3339))
+			case s.AppliedAt != nil:
+				fmt.Printf("%04d_%s\tapplied %s\n", s.Version, s.Name, s.AppliedAt.Format(time.RFC3339))
+			default:
+				fmt.Printf("%04d_%s\tpending\n", s.Version, s.Name)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q, want up, down [n] or status", cmd)
+	}
+}
+
+// OnStart reports whether a server should apply pending migrations before
+// serving. Set MIGRATE_ON_START=false when migrations are run as a
+// separate deploy step.
+func OnStart() bool {
+	return os.Getenv("MIGRATE_ON_START") != "false"
+}
@@ -0,0 +1,203 @@
+package migrate
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/lib/pq"
+)
+
+// services are the migration sets shipped by the services using this
+// package, with the one-shot script each was bootstrapped from before.
+var services = []struct {
+	name     string
+	dir      string
+	baseline string
+}{
+	{"product-service", "../../product-service/migrations", "testdata/product_init.sql"},
+	{"order-service", "../../order-service/migrations", "testdata/order_schema.sql"},
+}
+
+func TestLoad(t *testing.T) {
+	files := fstest.MapFS{
+		"0002_add_b.up.sql":      {Data: []byte("ALTER TABLE a ADD COLUMN b INT;")},
+		"0002_add_b.down.sql":    {Data: []byte("ALTER TABLE a DROP COLUMN b;")},
+		"0001_create_a.up.sql":   {Data: []byte("CREATE TABLE a (id INT);")},
+		"0001_create_a.down.sql": {Data: []byte("DROP TABLE a;")},
+	}
+	migrations, err := Load(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != 1 || migrations[1].Name != "add_b" {
+		t.Fatalf("Load = %+v", migrations)
+	}
+	if migrations[0].Up != "CREATE TABLE a (id INT);" || migrations[0].Down != "DROP TABLE a;" {
+		t.Fatalf("0001 = %+v", migrations[0])
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"no down file": {
+			"0001_create_a.up.sql": {Data: []byte("CREATE TABLE a (id INT);")},
+		},
+		"two names": {
+			"0001_create_a.up.sql":   {Data: []byte("CREATE TABLE a (id INT);")},
+			"0001_create_b.down.sql": {Data: []byte("DROP TABLE a;")},
+		},
+		"bad name": {
+			"create_a.sql": {Data: []byte("CREATE TABLE a (id INT);")},
+		},
+	}
+	for name, files := range tests {
+		if _, err := Load(files); err == nil {
+			t.Errorf("%s: Load succeeded, want error", name)
+		}
+	}
+}
+
+func TestServiceMigrationsLoad(t *testing.T) {
+	for _, svc := range services {
+		migrations, err := Load(os.DirFS(svc.dir))
+		if err != nil {
+			t.Errorf("%s: %v", svc.name, err)
+			continue
+		}
+		for i, m := range migrations {
+			if m.Version != i+1 {
+				t.Errorf("%s: migration %d_%s out of sequence, want version %d", svc.name, m.Version, m.Name, i+1)
+			}
+		}
+	}
+}
+
+// TestServiceMigrations applies every service's migrations to an empty
+// database and to one bootstrapped from its old one-shot script, and checks
+// both end with the same schema. It needs TEST_DATABASE_URL, e.g.
+// postgres://postgres@localhost/test?sslmode=disable; each run works in
+// throwaway schemas.
+func TestServiceMigrations(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	for _, svc := range services {
+		t.Run(svc.name, func(t *testing.T) {
+			files := os.DirFS(svc.dir)
+			migrations, err := Load(files)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			empty, emptySchema := openSchema(t, url)
+			if applied, err := Up(empty, files); err != nil {
+				t.Fatalf("empty database: %v", err)
+			} else if len(applied) != len(migrations) {
+				t.Fatalf("empty database: applied %d of %d migrations", len(applied), len(migrations))
+			}
+
+			baseline, baselineSchema := openSchema(t, url)
+			script, err := os.ReadFile(svc.baseline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := baseline.Exec(string(script)); err != nil {
+				t.Fatalf("baseline script: %v", err)
+			}
+			if _, err := Up(baseline, files); err != nil {
+				t.Fatalf("baseline database: %v", err)
+			}
+
+			want, got := columns(t, empty, emptySchema), columns(t, baseline, baselineSchema)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("baseline database ends with columns\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+
+			if applied, err := Up(empty, files); err != nil || len(applied) != 0 {
+				t.Errorf("second Up applied %d migrations, %v", len(applied), err)
+			}
+			if reverted, err := Down(empty, files, len(migrations)); err != nil || len(reverted) != len(migrations) {
+				t.Fatalf("Down reverted %d of %d migrations, %v", len(reverted), len(migrations), err)
+			}
+			if left := columns(t, empty, emptySchema); len(left) != 0 {
+				t.Errorf("Down left columns behind:\n%s", strings.Join(left, "\n"))
+			}
+			states, err := Status(empty, files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range states {
+				if s.AppliedAt != nil {
+					t.Errorf("migration %d_%s still applied after Down", s.Version, s.Name)
+				}
+			}
+		})
+	}
+}
+
+// openSchema creates a throwaway schema, dropped when the test ends, and
+// opens a pool whose connections all work in it.
+func openSchema(t *testing.T, url string) (*sql.DB, string) {
+	t.Helper()
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	schema := "migrate_test_" + hex.EncodeToString(buf)
+
+	admin, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("postgres", url+sep+"search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, schema
+}
+
+// columns describes every column in schema except the bookkeeping table.
+func columns(t *testing.T, db *sql.DB, schema string) []string {
+	t.Helper()
+	rows, err := db.Query(`
+        SELECT table_name, column_name, data_type, is_nullable, COALESCE(column_default, '')
+        FROM information_schema.columns
+        WHERE table_schema = $1 AND table_name <> 'schema_migrations'
+        ORDER BY table_name, column_name
+    `, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var table, column, typ, nullable, def string
+		if err := rows.Scan(&table, &column, &typ, &nullable, &def); err != nil {
+			t.Fatal(err)
+		}
+		// Sequence defaults name the schema they live in
+		def = strings.ReplaceAll(def, schema+".", "")
+		out = append(out, fmt.Sprintf("%s.%s %s nullable=%s default=%s", table, column, typ, nullable, def))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
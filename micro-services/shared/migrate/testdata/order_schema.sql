@@ -1,7 +1,5 @@
-CREATE DATABASE orders_db;
-
-\c orders_db;
-
+-- order-service schema.sql as it shipped before migrations existed, minus
+-- its CREATE DATABASE and \c lines
 CREATE TABLE orders (
     id SERIAL PRIMARY KEY,
     user_id INT NOT NULL,
@@ -1,3 +1,4 @@
+-- product-service init.sql as it shipped before migrations existed
 -- Create categories table
 CREATE TABLE IF NOT EXISTS categories (
     id SERIAL PRIMARY KEY,
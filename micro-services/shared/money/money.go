@@ -0,0 +1,270 @@
+// Package money is the exact amount type product-service,
+// shoppingcart-service and order-service share, so all three agree on how
+// money is parsed, rounded and sent.
+package money
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact amount in the minor unit of an ISO 4217 currency, e.g.
+// {Amount: 1999, Currency: "USD"} for $19.99. Arithmetic stays in integers.
+// An empty Currency means the amount arrived without one and is held in
+// hundredths until In assigns it.
+//
+// Rounding only happens when a decimal has more fractional digits than the
+// currency allows, and is always half away from zero: "0.125" USD is 13
+// cents and "-0.125" is -13.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// DefaultCurrency applies to NUMERIC columns scanned without a currency and
+// to amounts whose owner has none either.
+const DefaultCurrency = "USD"
+
+// currencyExponents lists the currencies whose minor unit is not a hundredth.
+var currencyExponents = map[string]int{
+	"BHD": 3, "CLP": 0, "ISK": 0, "JOD": 3, "JPY": 0,
+	"KRW": 0, "KWD": 3, "OMR": 3, "TND": 3, "VND": 0,
+}
+
+// maxDigits keeps every parsed amount inside int64.
+const maxDigits = 18
+
+var (
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	ErrInvalidAmount    = errors.New("invalid amount")
+	ErrInvalidCurrency  = errors.New("invalid currency")
+)
+
+// Exponent is the number of decimal places in code's minor unit.
+func Exponent(code string) int {
+	if exp, ok := currencyExponents[code]; ok {
+		return exp
+	}
+	return 2
+}
+
+func ValidCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse reads a plain decimal such as "19.99", "-3" or "0.125" in
+// currency, rounding half away from zero to the minor unit. An empty
+// currency leaves the result unassigned.
+func Parse(s, currency string) (Money, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency != "" && !ValidCurrency(currency) {
+		return Money{}, ErrInvalidCurrency
+	}
+
+	s = strings.TrimSpace(s)
+	neg := false
+	switch {
+	case strings.HasPrefix(s, "-"):
+		neg, s = true, s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" || !allDigits(whole) || !allDigits(frac) {
+		return Money{}, ErrInvalidAmount
+	}
+
+	exp := Exponent(currency)
+	roundUp := false
+	if len(frac) > exp {
+		roundUp = frac[exp] >= '5'
+		frac = frac[:exp]
+	}
+	digits := strings.TrimLeft(whole+frac+strings.Repeat("0", exp-len(frac)), "0")
+	if len(digits) > maxDigits {
+		return Money{}, ErrInvalidAmount
+	}
+
+	var amount int64
+	if digits != "" {
+		amount, _ = strconv.ParseInt(digits, 10, 64)
+	}
+	if roundUp {
+		amount++
+	}
+	if neg {
+		amount = -amount
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Decimal formats m without its currency, e.g. "19.99" or "-0.05".
+func (m Money) Decimal() string {
+	exp := Exponent(m.Currency)
+	abs := m.Amount
+	sign := ""
+	if abs < 0 {
+		abs, sign = -abs, "-"
+	}
+	digits := strconv.FormatUint(uint64(abs), 10)
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+// In assigns currency to an amount that has none, rescaling it from
+// hundredths to the currency's minor unit (half away from zero). Amounts
+// that already carry a currency are returned unchanged.
+func (m Money) In(currency string) Money {
+	if m.Currency != "" {
+		return m
+	}
+	m.Currency = currency
+	exp := Exponent(currency)
+	for ; exp > 2; exp-- {
+		m.Amount *= 10
+	}
+	if exp < 2 {
+		div := int64(math.Pow10(2 - exp))
+		q, rem := m.Amount/div, m.Amount%div
+		if 2*rem >= div {
+			q++
+		} else if 2*rem <= -div {
+			q--
+		}
+		m.Amount = q
+	}
+	return m
+}
+
+// Add returns m + o. A zero Money without a currency takes o's, so it can be
+// used as the starting value of a sum.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency == "" && m.Amount == 0 {
+		m.Currency = o.Currency
+	}
+	if m.Currency != o.Currency {
+		return m, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	if (o.Amount > 0 && m.Amount > math.MaxInt64-o.Amount) || (o.Amount < 0 && m.Amount < math.MinInt64-o.Amount) {
+		return m, ErrInvalidAmount
+	}
+	m.Amount += o.Amount
+	return m, nil
+}
+
+// Sub returns m - o.
+func (m Money) Sub(o Money) (Money, error) {
+	o.Amount = -o.Amount
+	return m.Add(o)
+}
+
+// Mul returns m times a whole quantity, e.g. a unit price times a line's
+// quantity. No rounding is involved.
+func (m Money) Mul(n int) (Money, error) {
+	product := m.Amount * int64(n)
+	if n != 0 && product/int64(n) != m.Amount {
+		return m, ErrInvalidAmount
+	}
+	m.Amount = product
+	return m, nil
+}
+
+// UnmarshalJSON accepts {"amount": 1999, "currency": "USD"} as well as a bare
+// decimal number or string such as 19.99, which carries no currency. The
+// decimal is parsed from its text, never through float64.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		return nil
+	case len(data) > 0 && data[0] == '{':
+		type plain Money
+		var p plain
+		if err := json.Unmarshal(data, &p); err != nil {
+			return err
+		}
+		if p.Currency != "" && !ValidCurrency(p.Currency) {
+			return ErrInvalidCurrency
+		}
+		*m = Money(p)
+		return nil
+	case len(data) > 0 && data[0] == '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		data = []byte(s)
+	}
+	if bytes.ContainsAny(data, "eE") {
+		return ErrInvalidAmount
+	}
+	parsed, err := Parse(string(data), "")
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Scan reads a NUMERIC column. The currency set on m beforehand, or
+// DefaultCurrency, decides the minor unit.
+func (m *Money) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+	currency := m.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	parsed, err := Parse(s, currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Value writes m as a decimal string for a NUMERIC column.
+func (m Money) Value() (driver.Value, error) {
+	return m.Decimal(), nil
+}
@@ -0,0 +1,208 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency string
+		want     int64
+	}{
+		{"19.99", "USD", 1999},
+		{"0.1", "USD", 10},
+		{"12", "USD", 1200},
+		{".5", "USD", 50},
+		{"7.", "USD", 700},
+		{"+3.50", "USD", 350},
+		{"-0.05", "USD", -5},
+		{"0.125", "USD", 13}, // half away from zero
+		{"-0.125", "USD", -13},
+		{"0.1249", "USD", 12},
+		{"2.995", "USD", 300},
+		{"1000", "JPY", 1000},
+		{"999.5", "JPY", 1000},
+		{"1.2345", "KWD", 1235},
+		{"0000.01", "USD", 1},
+		{"19.99", "", 1999}, // no currency: hundredths
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in, tt.currency)
+		if err != nil {
+			t.Errorf("Parse(%q, %q): %v", tt.in, tt.currency, err)
+			continue
+		}
+		if got.Amount != tt.want {
+			t.Errorf("Parse(%q, %q) = %d, want %d", tt.in, tt.currency, got.Amount, tt.want)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, in := range []string{"", ".", "-", "abc", "1.2.3", "1,50", "1e3", "--1", "12345678901234567890"} {
+		if _, err := Parse(in, "USD"); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", in)
+		}
+	}
+	if _, err := Parse("1", "usdollar"); !errors.Is(err, ErrInvalidCurrency) {
+		t.Errorf("Parse with bad currency: got %v, want ErrInvalidCurrency", err)
+	}
+}
+
+func TestMoneyDecimal(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{Money{1999, "USD"}, "19.99"},
+		{Money{5, "USD"}, "0.05"},
+		{Money{-5, "USD"}, "-0.05"},
+		{Money{0, "USD"}, "0.00"},
+		{Money{1000, "JPY"}, "1000"},
+		{Money{1, "KWD"}, "0.001"},
+		{Money{math.MinInt64, "USD"}, "-92233720368547758.08"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Decimal(); got != tt.want {
+			t.Errorf("%#v.Decimal() = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+// TestMoneyTotals sums lines whose float64 total drifts and checks the
+// integer total is exact to the cent.
+func TestMoneyTotals(t *testing.T) {
+	lines := []struct {
+		price string
+		qty   int
+	}{
+		{"0.10", 3},
+		{"0.20", 1},
+		{"19.99", 3},
+		{"1.15", 7},
+		{"33.33", 3},
+	}
+
+	var total Money
+	for _, l := range lines {
+		price, err := Parse(l.price, "USD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := price.Mul(l.qty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total, err = total.Add(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 0.30 + 0.20 + 59.97 + 8.05 + 99.99
+	if total.Amount != 16851 || total.Decimal() != "168.51" || total.Currency != "USD" {
+		t.Fatalf("total = %s, want 168.51 USD", total)
+	}
+
+	// A cent added ten thousand times is exactly 100.00
+	total = Money{}
+	for i := 0; i < 10000; i++ {
+		total, _ = total.Add(Money{1, "USD"})
+	}
+	if total.Decimal() != "100.00" {
+		t.Fatalf("10000 cents = %s, want 100.00", total.Decimal())
+	}
+}
+
+func TestMoneyArithmeticErrors(t *testing.T) {
+	if _, err := (Money{100, "USD"}).Add(Money{100, "EUR"}); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("USD + EUR: got %v, want ErrCurrencyMismatch", err)
+	}
+	if _, err := (Money{math.MaxInt64, "USD"}).Add(Money{1, "USD"}); err == nil {
+		t.Error("overflowing Add succeeded")
+	}
+	if _, err := (Money{math.MaxInt64 / 2, "USD"}).Mul(3); err == nil {
+		t.Error("overflowing Mul succeeded")
+	}
+	diff, err := (Money{500, "USD"}).Sub(Money{1999, "USD"})
+	if err != nil || diff.Decimal() != "-14.99" {
+		t.Errorf("5.00 - 19.99 = %s, %v", diff.Decimal(), err)
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	data, err := json.Marshal(Money{1999, "USD"})
+	if err != nil || string(data) != `{"amount":1999,"currency":"USD"}` {
+		t.Fatalf("Marshal = %s, %v", data, err)
+	}
+
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{`{"amount":1999,"currency":"EUR"}`, Money{1999, "EUR"}},
+		{`{"amount":1999}`, Money{1999, ""}},
+		{`19.99`, Money{1999, ""}},
+		{`"19.99"`, Money{1999, ""}},
+		{`0.1`, Money{10, ""}},
+	}
+	for _, tt := range tests {
+		var m Money
+		if err := json.Unmarshal([]byte(tt.in), &m); err != nil {
+			t.Errorf("Unmarshal(%s): %v", tt.in, err)
+			continue
+		}
+		if m != tt.want {
+			t.Errorf("Unmarshal(%s) = %#v, want %#v", tt.in, m, tt.want)
+		}
+	}
+
+	for _, in := range []string{`1e2`, `"abc"`, `{"amount":1,"currency":"usd"}`, `true`} {
+		var m Money
+		if err := json.Unmarshal([]byte(in), &m); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded, want error", in)
+		}
+	}
+}
+
+func TestMoneyIn(t *testing.T) {
+	tests := []struct {
+		m        Money
+		currency string
+		want     Money
+	}{
+		{Money{1999, ""}, "EUR", Money{1999, "EUR"}},
+		{Money{120050, ""}, "JPY", Money{1201, "JPY"}},
+		{Money{-120050, ""}, "JPY", Money{-1201, "JPY"}},
+		{Money{120049, ""}, "JPY", Money{1200, "JPY"}},
+		{Money{1234, ""}, "KWD", Money{12340, "KWD"}},
+		{Money{1999, "USD"}, "EUR", Money{1999, "USD"}}, // already assigned
+	}
+	for _, tt := range tests {
+		if got := tt.m.In(tt.currency); got != tt.want {
+			t.Errorf("%#v.In(%s) = %#v, want %#v", tt.m, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyScanValue(t *testing.T) {
+	var m Money
+	if err := m.Scan([]byte("850.50")); err != nil || m != (Money{85050, DefaultCurrency}) {
+		t.Fatalf("Scan = %#v, %v", m, err)
+	}
+	jpy := Money{Currency: "JPY"}
+	if err := jpy.Scan([]byte("1200.00")); err != nil || jpy.Amount != 1200 {
+		t.Fatalf("Scan JPY = %#v, %v", jpy, err)
+	}
+	if err := m.Scan(1.5); err == nil {
+		t.Error("Scan(float64) succeeded, want error")
+	}
+
+	v, err := Money{85050, "USD"}.Value()
+	if err != nil || v != "850.50" {
+		t.Fatalf("Value = %v, %v", v, err)
+	}
+}
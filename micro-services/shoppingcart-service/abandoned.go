@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"mallhive/shared/money"
+)
+
+// Carts expire CART_TTL after they were last read or written. Every write
+// also records its time in the carts:modified sorted set, which a
+// background job scans for carts left alone longer than ABANDONED_CART_AFTER.
+const (
+	modifiedCartsKey   = "carts:modified"
+	EventCartAbandoned = "cart.abandoned"
+
+	defaultCartTTL           = 30 * 24 * time.Hour
+	defaultAbandonAfter      = 24 * time.Hour
+	defaultAbandonScanPeriod = 5 * time.Minute
+)
+
+var (
+	cartTTL           = defaultCartTTL
+	abandonAfter      = defaultAbandonAfter
+	abandonScanPeriod = defaultAbandonScanPeriod
+	eventClient       = &http.Client{Timeout: 5 * time.Second}
+)
+
+// CartAbandoned is the cart.abandoned event: a cart nobody changed for
+// abandonAfter, with its contents and value at the time it was detected.
+type CartAbandoned struct {
+	Type         string      `json:"type"` // the notification service dispatches on it
+	CartID       string      `json:"cart_id"`
+	UserID       string      `json:"user_id,omitempty"` // empty for guest carts
+	Currency     string      `json:"currency"`
+	Items        []CartItem  `json:"items"`
+	ItemCount    int         `json:"item_count"`
+	Total        money.Money `json:"total"`
+	LastModified time.Time   `json:"last_modified"`
+	DetectedAt   time.Time   `json:"detected_at"`
+}
+
+// loadCartLifecycle reads CART_TTL, ABANDONED_CART_AFTER and
+// ABANDONED_CART_SCAN_INTERVAL as Go durations, e.g. "720h".
+func loadCartLifecycle() error {
+	for _, d := range []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"CART_TTL", &cartTTL},
+		{"ABANDONED_CART_AFTER", &abandonAfter},
+		{"ABANDONED_CART_SCAN_INTERVAL", &abandonScanPeriod},
+	} {
+		v := os.Getenv(d.env)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("%s must be a positive duration, got %q", d.env, v)
+		}
+		*d.dst = parsed
+	}
+	if abandonAfter >= cartTTL {
+		return fmt.Errorf("ABANDONED_CART_AFTER (%s) must be shorter than CART_TTL (%s)", abandonAfter, cartTTL)
+	}
+	return nil
+}
+
+func abandonedKey(cartID string) string {
+	return fmt.Sprintf("cart:%s:abandoned", cartID)
+}
+
+// abandonedDeliveriesKey holds, per delivery of cart.abandoned, the write it
+// was last delivered for, so a retry repeats only the deliveries that failed.
+func abandonedDeliveriesKey(cartID string) string {
+	return fmt.Sprintf("cart:%s:abandoned:delivered", cartID)
+}
+
+const (
+	deliveryAnalytics    = "analytics"
+	deliveryNotification = "notification"
+)
+
+// abandonedDelivery is one place cart.abandoned is sent to.
+type abandonedDelivery struct {
+	name string
+	send func(CartAbandoned) error
+}
+
+// touchCart pushes back the expiry of every key of the cart. A write also
+// records when the cart was last modified; a cart whose lines are all gone
+// is dropped from carts:modified instead.
+func touchCart(cartID string, modified bool) error {
+	n, err := rdb.Exists(ctx, fmt.Sprintf("cart:%s", cartID)).Result()
+	if err != nil {
+		return err
+	}
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range cartKeys(cartID) {
+			pipe.Expire(ctx, key, cartTTL)
+		}
+		if n == 0 {
+			pipe.ZRem(ctx, modifiedCartsKey, cartID)
+		} else if modified {
+			pipe.ZAdd(ctx, modifiedCartsKey, &redis.Z{Score: float64(time.Now().Unix()), Member: cartID})
+		}
+		return nil
+	})
+	return err
+}
+
+// cartModifiedAt reads when cartID was last written, if it is tracked.
+func cartModifiedAt(cartID string) (*time.Time, error) {
+	score, err := rdb.ZScore(ctx, modifiedCartsKey, cartID).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	t := time.Unix(int64(score), 0).UTC()
+	return &t, nil
+}
+
+// statusRecorder remembers the status a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// trackCartActivity touches the cart of every successful cart request:
+// reads keep the cart alive, anything else also counts as a modification.
+func trackCartActivity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cartID := mux.Vars(r)["user_id"]
+		if cartID == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.status >= http.StatusBadRequest {
+			return
+		}
+		if err := touchCart(cartID, r.Method != http.MethodGet); err != nil {
+			log.Printf("Failed to touch cart %s: %v", cartID, err)
+		}
+	})
+}
+
+// watchAbandonedCarts scans for abandoned carts every abandonScanPeriod
+// for as long as the service runs.
+func watchAbandonedCarts() {
+	ticker := time.NewTicker(abandonScanPeriod)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if err := findAbandonedCarts(now); err != nil {
+			log.Printf("Abandoned cart scan failed: %v", err)
+		}
+	}
+}
+
+// findAbandonedCarts emits cart.abandoned once for every cart last modified
+// abandonAfter or longer before now. A cart modified again afterwards can
+// be abandoned again. Carts that expired or were emptied are forgotten.
+func findAbandonedCarts(now time.Time) error {
+	cutoff := now.Add(-abandonAfter).Unix()
+	idle, err := rdb.ZRangeByScoreWithScores(ctx, modifiedCartsKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(cutoff, 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, z := range idle {
+		cartID, _ := z.Member.(string)
+		modifiedAt := int64(z.Score)
+		n, err := rdb.Exists(ctx, fmt.Sprintf("cart:%s", cartID)).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			if err := rdb.ZRem(ctx, modifiedCartsKey, cartID).Err(); err != nil {
+				return err
+			}
+			continue
+		}
+		claimed, err := claimAbandonedCart(cartID, modifiedAt)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		if err := emitCartAbandoned(cartID, modifiedAt, now); err != nil {
+			log.Printf("Failed to emit %s for cart %s: %v", EventCartAbandoned, cartID, err)
+			// Let the next scan retry the deliveries that failed
+			if err := rdb.Del(ctx, abandonedKey(cartID)).Err(); err != nil {
+				log.Printf("Failed to unclaim cart %s, it is not reported again until it changes: %v", cartID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// claimAbandonedCart marks the cart as reported for the write at
+// modifiedAt. It reports false when the cart was reported already, has
+// been written since, or another instance claimed it first.
+func claimAbandonedCart(cartID string, modifiedAt int64) (bool, error) {
+	key := abandonedKey(cartID)
+	mark := strconv.FormatInt(modifiedAt, 10)
+	claimed := false
+	err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+		reported, err := tx.Get(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if reported == mark {
+			return nil
+		}
+		score, err := tx.ZScore(ctx, modifiedCartsKey, cartID).Result()
+		if err == redis.Nil || (err == nil && int64(score) != modifiedAt) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.Set(ctx, key, mark, cartTTL).Err()
+		})
+		claimed = err == nil
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return false, nil
+	}
+	return claimed, err
+}
+
+// emitCartAbandoned sends cart.abandoned for the write at modifiedAt to
+// analytics and, for user carts, to the reminder emails, skipping the
+// deliveries already made for that write.
+func emitCartAbandoned(cartID string, modifiedAt int64, now time.Time) error {
+	cart, err := loadCart(cartID)
+	if err != nil {
+		return err
+	}
+	event := CartAbandoned{
+		Type:         EventCartAbandoned,
+		CartID:       cartID,
+		Currency:     cart.Currency,
+		Items:        cart.Items,
+		ItemCount:    cart.ItemCount,
+		Total:        cart.Total,
+		LastModified: time.Unix(modifiedAt, 0).UTC(),
+		DetectedAt:   now.UTC(),
+	}
+	if !isGuestCart(cartID) {
+		event.UserID = cartID
+	}
+	deliveries := []abandonedDelivery{{deliveryAnalytics, trackCartAbandoned}}
+	// Guests have nobody to remind
+	if event.UserID != "" {
+		deliveries = append(deliveries, abandonedDelivery{deliveryNotification, notifyCartAbandoned})
+	}
+
+	key := abandonedDeliveriesKey(cartID)
+	mark := strconv.FormatInt(modifiedAt, 10)
+	delivered, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, d := range deliveries {
+		if delivered[d.name] == mark {
+			continue
+		}
+		if err := d.send(event); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.name, err))
+			continue
+		}
+		_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, d.name, mark)
+			pipe.Expire(ctx, key, cartTTL)
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s was delivered but not recorded: %w", d.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// trackCartAbandoned records the event with the analytics service, valued
+// at the cart total. Guest carts belong to no user; the analytics service
+// tracks them by session, the guest cart id.
+func trackCartAbandoned(event CartAbandoned) error {
+	value, _ := strconv.ParseFloat(event.Total.Decimal(), 64)
+	sessionID := ""
+	if event.UserID == "" {
+		sessionID = event.CartID
+	}
+	body, _ := json.Marshal(map[string]any{
+		"user_id":        event.UserID,
+		"session_id":     sessionID,
+		"event_type":     "user_behavior",
+		"event_subtype":  EventCartAbandoned,
+		"source_service": "shoppingcart-service",
+		"value":          value,
+	})
+	return postJSON(os.Getenv("ANALYTICS_SERVICE_URL")+"/events", os.Getenv("ANALYTICS_API_KEY"), body)
+}
+
+// notifyCartAbandoned publishes the event to CART_EVENTS_TOPIC_ARN, whose
+// queue the notification service reads to send reminder emails. Without
+// one, reminders are disabled and the event is only tracked.
+func notifyCartAbandoned(event CartAbandoned) error {
+	topic := os.Getenv("CART_EVENTS_TOPIC_ARN")
+	if topic == "" {
+		return nil
+	}
+	body, _ := json.Marshal(event)
+	_, err := snsClient.Publish(&sns.PublishInput{
+		Message:  aws.String(string(body)),
+		TopicArn: aws.String(topic),
+	})
+	return err
+}
+
+// postJSON sends body to url, with a bearer token when one is given.
+func postJSON(url, token string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := eventClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("post to %s returned %s", url, resp.Status)
+	}
+	return nil
+}
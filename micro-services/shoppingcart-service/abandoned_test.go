@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/go-redis/redis/v8"
+	"mallhive/shared/money"
+)
+
+func TestTrackCartAbandoned(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       CartAbandoned
+		wantUser    string
+		wantSession string
+	}{
+		{"user cart", CartAbandoned{CartID: "42", UserID: "42", Total: usd(2599)}, "42", ""},
+		{"guest cart", CartAbandoned{CartID: "guest-abc", Total: usd(2599)}, "", "guest-abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]any
+			analytics := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&got)
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer analytics.Close()
+			t.Setenv("ANALYTICS_SERVICE_URL", analytics.URL)
+
+			if err := trackCartAbandoned(tt.event); err != nil {
+				t.Fatal(err)
+			}
+			if got["user_id"] != tt.wantUser || got["session_id"] != tt.wantSession {
+				t.Errorf("user_id %q session_id %q, want %q and %q", got["user_id"], got["session_id"], tt.wantUser, tt.wantSession)
+			}
+			if got["value"] != 25.99 || got["event_subtype"] != EventCartAbandoned {
+				t.Errorf("value %v subtype %v, want 25.99 and %s", got["value"], got["event_subtype"], EventCartAbandoned)
+			}
+		})
+	}
+}
+
+// useTestSNS points snsClient at a fake SNS whose Publish calls fail while
+// *failing is set. It returns how many publishes it was sent.
+func useTestSNS(t *testing.T, failing *bool) *int {
+	t.Helper()
+	published := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		published++
+		if *failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`<ErrorResponse><Error><Code>InternalError</Code><Message>down</Message></Error></ErrorResponse>`))
+			return
+		}
+		w.Write([]byte(`<PublishResponse><PublishResult><MessageId>1</MessageId></PublishResult></PublishResponse>`))
+	}))
+	t.Cleanup(srv.Close)
+	saved := snsClient
+	snsClient = sns.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(srv.URL),
+		Credentials: credentials.NewStaticCredentials("test", "test", ""),
+		MaxRetries:  aws.Int(0),
+	})))
+	t.Cleanup(func() { snsClient = saved })
+	return &published
+}
+
+// TestFindAbandonedCartsRetries scans an abandoned cart while one of its
+// deliveries fails: later scans retry only that delivery, and only until
+// it succeeds.
+func TestFindAbandonedCartsRetries(t *testing.T) {
+	tests := []struct {
+		name          string
+		topic         string
+		wantPublished int // one failed attempt, then one that went through
+	}{
+		{"reminders failing once", "arn:aws:sns:us-east-1:000000000000:cart-events", 2},
+		{"reminders disabled", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestRedis(t)
+			tracked := 0
+			analytics := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tracked++
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer analytics.Close()
+			t.Setenv("ANALYTICS_SERVICE_URL", analytics.URL)
+			t.Setenv("CART_EVENTS_TOPIC_ARN", tt.topic)
+			failing := true
+			published := useTestSNS(t, &failing)
+
+			now := time.Now()
+			putCartLine(t, "42", CartItem{ProductID: "7", Quantity: 1, Version: 1, Price: money.Money{Amount: 1000, Currency: "USD"}})
+			modifiedAt := now.Add(-2 * abandonAfter).Unix()
+			rdb.ZAdd(ctx, modifiedCartsKey, &redis.Z{Score: float64(modifiedAt), Member: "42"})
+
+			for scan := 0; scan < 3; scan++ {
+				if err := findAbandonedCarts(now); err != nil {
+					t.Fatalf("scan %d: %v", scan, err)
+				}
+				failing = false
+			}
+			if tracked != 1 {
+				t.Errorf("tracked %d times, want once", tracked)
+			}
+			if *published != tt.wantPublished {
+				t.Errorf("published %d times, want %d", *published, tt.wantPublished)
+			}
+		})
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,26 +17,68 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/go-redis/redis/v8"
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
+	"mallhive/shared/money"
 )
 
 type CartItem struct {
-	ProductID string  `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	ID        string       `json:"id,omitempty"` // hash field, filled on read
+	ProductID string       `json:"product_id"`
+	SKUID     int          `json:"sku_id,omitempty"`
+	Quantity  int          `json:"quantity"`
+	Price     money.Money  `json:"price"`
+	WasPrice  *money.Money `json:"was_price,omitempty"` // regular price while on sale
+	Version   int          `json:"version"`             // bumped on every write, served as the ETag
+
+	UpdatedAt time.Time `json:"updated_at"` // last write, for merging carts
+
+	WeightGrams  int          `json:"weight_grams"`            // per unit, for shipping
+	Category     string       `json:"category,omitempty"`      // category slug, for coupon targeting
+	LineSubtotal *money.Money `json:"line_subtotal,omitempty"` // price times quantity, filled on read
 }
 
+// Cart is priced in a single currency, fixed by the first item added. The
+// summary fields are computed by priceCart on every read, and Total is
+// what the order service charges.
 type Cart struct {
-	UserID string     `json:"user_id"`
-	Items  []CartItem `json:"items"`
+	UserID   string     `json:"user_id"`
+	Currency string     `json:"currency"`
+	Region   string     `json:"region,omitempty"` // taxes are estimated for it
+	Items    []CartItem `json:"items"`
+
+	UpdatedAt *time.Time `json:"updated_at,omitempty"` // last write to the cart
+
+	ItemCount int             `json:"item_count"`
+	Subtotal  money.Money     `json:"subtotal"`
+	Coupons   []AppliedCoupon `json:"coupons,omitempty"`
+	Discount  money.Money     `json:"discount"` // sum of the coupon discounts
+	TaxRate   string          `json:"tax_rate"` // percent
+	Tax       money.Money     `json:"tax"`
+	Shipping  money.Money     `json:"shipping"`
+	Total     money.Money     `json:"total"`
+
+	coupons []Coupon // as applied, loaded with the cart
 }
 
+// Product is the pricing part of a product or SKU read. Products report the
+// price to charge as effective_price; SKUs report it as price.
 type Product struct {
-	ID    string  `json:"id"`
-	Price float64 `json:"price"`
+	ID             int          `json:"id"`
+	Price          money.Money  `json:"price"`
+	EffectivePrice *money.Money `json:"effective_price"`
+	WasPrice       *money.Money `json:"was_price"`
+	WeightGrams    int          `json:"weight_grams"`
+	Category       string       `json:"category"`
+}
+
+// chargePrice is what the shopper pays for one unit right now.
+func (p Product) chargePrice() money.Money {
+	if p.EffectivePrice != nil {
+		return *p.EffectivePrice
+	}
+	return p.Price
 }
 
 var (
@@ -48,13 +92,19 @@ var (
 
 func init() {
 	if err := godotenv.Load(); err != nil {
-		log.Fatalf("Error loading .env file")
+		log.Println("Error loading .env file:", err)
 	}
 	snsTopicARN = os.Getenv("SNS_TOPIC_ARN")
 	productSvcURL = os.Getenv("PRODUCT_SERVICE_URL")
 	orderSvcEndpoint = os.Getenv("ORDER_SERVICE_URL")
 	initRedis()
 	initSNS()
+	if err := loadPricingRules(); err != nil {
+		log.Fatalf("Error loading pricing rules: %v", err)
+	}
+	if err := loadCartLifecycle(); err != nil {
+		log.Fatalf("Error loading cart lifecycle settings: %v", err)
+	}
 }
 
 func initRedis() {
@@ -77,8 +127,15 @@ func getAllowedOrigins() []string {
 	return strings.Split(origins, ",")
 }
 
-func getProductDetails(productID string) (*Product, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/%s", productSvcURL, productID))
+// getProductDetails fetches the product, or one of its SKUs when skuID is
+// set, priced in currency; either way the response carries the price to
+// charge.
+func getProductDetails(productID string, skuID int, currency string) (*Product, error) {
+	url := fmt.Sprintf("%s/%s", productSvcURL, productID)
+	if skuID != 0 {
+		url = fmt.Sprintf("%s/skus/%d", url, skuID)
+	}
+	resp, err := http.Get(url + "?currency=" + currency)
 	if err != nil || resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("failed to fetch product: %s", productID)
 	}
@@ -87,77 +144,426 @@ func getProductDetails(productID string) (*Product, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&product); err != nil {
 		return nil, err
 	}
+	if product.chargePrice().Currency != currency {
+		return nil, fmt.Errorf("product %s not priced in %s", productID, currency)
+	}
 	return &product, nil
 }
 
+func currencyKey(userID string) string {
+	return fmt.Sprintf("cart:%s:currency", userID)
+}
+
+func regionKey(userID string) string {
+	return fmt.Sprintf("cart:%s:region", userID)
+}
+
+// cartCurrency returns the currency userID's cart is priced in. requested,
+// from ?currency=, only takes effect while the cart is empty. Orders store
+// totals with two decimals, so finer currencies are refused.
+func cartCurrency(userID, requested string) (string, error) {
+	key := fmt.Sprintf("cart:%s", userID)
+	requested = strings.ToUpper(strings.TrimSpace(requested))
+	if requested != "" && (!money.ValidCurrency(requested) || money.Exponent(requested) > 2) {
+		return "", money.ErrInvalidCurrency
+	}
+	n, err := rdb.HLen(ctx, key).Result()
+	if err != nil {
+		return "", err
+	}
+	if n == 0 && requested != "" {
+		return requested, rdb.Set(ctx, currencyKey(userID), requested, 0).Err()
+	}
+	current, err := rdb.Get(ctx, currencyKey(userID)).Result()
+	if err == redis.Nil {
+		current = money.DefaultCurrency
+	} else if err != nil {
+		return "", err
+	}
+	if requested != "" && requested != current {
+		return "", fmt.Errorf("%w: cart is priced in %s", money.ErrCurrencyMismatch, current)
+	}
+	return current, nil
+}
+
+// loadCart reads userID's items and prices them in the cart's currency for
+// its region. Items stored before carts had a currency are taken to be in
+// it.
+func loadCart(userID string) (Cart, error) {
+	cart := Cart{UserID: userID}
+	currency, err := cartCurrency(userID, "")
+	if err != nil {
+		return cart, err
+	}
+	cart.Currency = currency
+	cart.Region, err = rdb.Get(ctx, regionKey(userID)).Result()
+	if err != nil && err != redis.Nil {
+		return cart, err
+	}
+	if cart.coupons, err = cartCoupons(userID); err != nil {
+		return cart, err
+	}
+	if cart.UpdatedAt, err = cartModifiedAt(userID); err != nil {
+		return cart, err
+	}
+	entries, err := rdb.HGetAll(ctx, fmt.Sprintf("cart:%s", userID)).Result()
+	if err != nil {
+		return cart, err
+	}
+	for id, val := range entries {
+		var item CartItem
+		json.Unmarshal([]byte(val), &item)
+		item.ID = id
+		item.Price = item.Price.In(currency)
+		if item.WasPrice != nil {
+			was := item.WasPrice.In(currency)
+			item.WasPrice = &was
+		}
+		cart.Items = append(cart.Items, item)
+	}
+	return cart, priceCart(&cart)
+}
+
+// lineID is the hash field of the cart line for a product, or for one SKU
+// of it, so adding the same thing twice lands on the same line.
+func lineID(productID string, skuID int) string {
+	if skuID != 0 {
+		return fmt.Sprintf("%s:%d", productID, skuID)
+	}
+	return productID
+}
+
+// addToCart adds the requested quantity, one by default, to the cart line
+// for the product or SKU, creating the line when it is new. The line is
+// repriced at the current price either way.
 func addToCart(w http.ResponseWriter, r *http.Request) {
 	var item CartItem
 	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
-	product, err := getProductDetails(item.ProductID)
+	if item.ProductID == "" {
+		http.Error(w, "Missing product_id", http.StatusBadRequest)
+		return
+	}
+	if !validProductRef(item.ProductID, item.SKUID) {
+		http.Error(w, errProductRef.Error(), http.StatusBadRequest)
+		return
+	}
+	if item.Quantity == 0 {
+		item.Quantity = 1
+	}
+	if !validQuantity(item.Quantity) {
+		http.Error(w, errQuantityRange.Error(), http.StatusBadRequest)
+		return
+	}
+	userID := mux.Vars(r)["user_id"]
+	currency, err := cartCurrency(userID, r.URL.Query().Get("currency"))
+	if errors.Is(err, money.ErrInvalidCurrency) {
+		http.Error(w, "Invalid currency", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, money.ErrCurrencyMismatch) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to read cart", http.StatusInternalServerError)
+		return
+	}
+	product, err := getProductDetails(item.ProductID, item.SKUID, currency)
 	if err != nil {
 		http.Error(w, "Product not found", http.StatusNotFound)
 		return
 	}
-	item.Price = product.Price
-	userID := mux.Vars(r)["user_id"]
+	item.Price, item.WasPrice = product.chargePrice(), product.WasPrice
+	item.WeightGrams, item.Category, item.LineSubtotal = product.WeightGrams, product.Category, nil
 	key := fmt.Sprintf("cart:%s", userID)
-	itemID := uuid.New().String()
-	itemBytes, _ := json.Marshal(item)
-	rdb.HSet(ctx, key, itemID, itemBytes)
-	w.WriteHeader(http.StatusCreated)
+	itemID := lineID(item.ProductID, item.SKUID)
+	line, created, err := addCartLine(key, itemID, item)
+	if errors.Is(err, errQuantityRange) || err == errVersionConflict {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to add cart item", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag(line.Version))
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
 	w.Write([]byte(itemID))
 }
 
+// addCartLine adds item.Quantity units to line itemID of the cart at key
+// under WATCH. Carts from before lines were keyed by product may hold the
+// same product and SKU under other fields, one per add; those are folded
+// into the line. It reports whether the line is new.
+func addCartLine(key, itemID string, item CartItem) (CartItem, bool, error) {
+	for attempt := 0; attempt < maxWriteRetries; attempt++ {
+		var line CartItem
+		var created bool
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			entries, err := tx.HGetAll(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			quantity, version := item.Quantity, 0
+			created = true
+			var folded []string
+			for id, val := range entries {
+				var existing CartItem
+				if err := json.Unmarshal([]byte(val), &existing); err != nil {
+					return err
+				}
+				if lineID(existing.ProductID, existing.SKUID) != itemID {
+					continue
+				}
+				quantity += existing.Quantity
+				if id == itemID {
+					version, created = existing.Version, false
+				} else {
+					folded = append(folded, id)
+				}
+			}
+			if quantity > maxItemQuantity {
+				return fmt.Errorf("%w; the cart already holds %d", errQuantityRange, quantity-item.Quantity)
+			}
+			line = item
+			line.ID, line.Quantity, line.Version = "", quantity, version+1
+			line.UpdatedAt = time.Now().UTC()
+			itemBytes, _ := json.Marshal(line)
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if len(folded) > 0 {
+					pipe.HDel(ctx, key, folded...)
+				}
+				return pipe.HSet(ctx, key, itemID, itemBytes).Err()
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return line, created, err
+		}
+	}
+	return CartItem{}, false, errVersionConflict
+}
+
+// getCart returns the priced cart. ?region= estimates taxes for another
+// region than the one stored with the cart.
 func getCart(w http.ResponseWriter, r *http.Request) {
 	userID := mux.Vars(r)["user_id"]
-	key := fmt.Sprintf("cart:%s", userID)
-	entries, err := rdb.HGetAll(ctx, key).Result()
+	cart, err := loadCart(userID)
 	if err != nil {
 		http.Error(w, "Failed to get cart", http.StatusInternalServerError)
 		return
 	}
-	var items []CartItem
-	for _, val := range entries {
-		var item CartItem
-		json.Unmarshal([]byte(val), &item)
-		items = append(items, item)
+	if region := normalizeRegion(r.URL.Query().Get("region")); region != "" {
+		if !validRegion(region) {
+			http.Error(w, "Invalid region", http.StatusBadRequest)
+			return
+		}
+		cart.Region = region
+		if err := priceCart(&cart); err != nil {
+			http.Error(w, "Failed to get cart", http.StatusInternalServerError)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(cart)
+}
+
+// setCartRegion stores the region the cart ships to, which decides its
+// tax rate at checkout.
+func setCartRegion(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["user_id"]
+	var body struct {
+		Region string `json:"region"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	region := normalizeRegion(body.Region)
+	if !validRegion(region) {
+		http.Error(w, "Invalid region", http.StatusBadRequest)
+		return
+	}
+	if err := rdb.Set(ctx, regionKey(userID), region, 0).Err(); err != nil {
+		http.Error(w, "Failed to set region", http.StatusInternalServerError)
+		return
+	}
+	cart, err := loadCart(userID)
+	if err != nil {
+		http.Error(w, "Failed to get cart", http.StatusInternalServerError)
+		return
 	}
-	json.NewEncoder(w).Encode(Cart{UserID: userID, Items: items})
+	json.NewEncoder(w).Encode(cart)
 }
 
+// orderRequest is the body of order-service's POST /orders/. The order
+// service reads the cart back itself, so it only needs the owner.
+type orderRequest struct {
+	UserID int `json:"user_id"`
+}
+
+// checkout places the order for a signed-in user's cart. Guests merge
+// their cart into their account first.
 func checkout(w http.ResponseWriter, r *http.Request) {
 	userID := mux.Vars(r)["user_id"]
-	key := fmt.Sprintf("cart:%s", userID)
-	entries, err := rdb.HGetAll(ctx, key).Result()
+	if isGuestCart(userID) {
+		http.Error(w, "Sign in to check out", http.StatusForbidden)
+		return
+	}
+	accountID, err := strconv.Atoi(userID)
+	if err != nil || accountID <= 0 {
+		http.Error(w, "Cart does not belong to a user account", http.StatusBadRequest)
+		return
+	}
+	cart, err := loadCart(userID)
 	if err != nil {
 		http.Error(w, "Could not checkout", http.StatusInternalServerError)
 		return
 	}
-	var items []CartItem
-	for _, val := range entries {
-		var item CartItem
-		json.Unmarshal([]byte(val), &item)
-		items = append(items, item)
+	// Count coupon uses up front so concurrent checkouts cannot both take
+	// the last one; they are given back if the order fails
+	if err := redeemCoupons(userID, cart); err == errCouponUsedUp {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Could not checkout", http.StatusInternalServerError)
+		return
 	}
-	cart := Cart{UserID: userID, Items: items}
-	orderPayload, _ := json.Marshal(cart)
+	orderPayload, _ := json.Marshal(orderRequest{UserID: accountID})
 	resp, err := http.Post(orderSvcEndpoint, "application/json", bytes.NewBuffer(orderPayload))
+	if err == nil {
+		resp.Body.Close()
+	}
 	if err != nil || resp.StatusCode != http.StatusCreated {
+		releaseCoupons(userID, cart)
 		http.Error(w, "Failed to place order", http.StatusInternalServerError)
 		return
 	}
+	cartPayload, _ := json.Marshal(cart)
 	snsClient.Publish(&sns.PublishInput{
-		Message:  aws.String(string(orderPayload)),
+		Message:  aws.String(string(cartPayload)),
 		TopicArn: aws.String(snsTopicARN),
 	})
-	rdb.Del(ctx, key)
+	rdb.Del(ctx, append(cartKeys(userID), cartRedeemedKey(userID))...)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Order placed successfully."))
 }
 
+var (
+	errItemNotFound    = errors.New("item not found")
+	errVersionConflict = errors.New("cart item was modified since it was read; fetch it again and retry")
+	errQuantityRange   = fmt.Errorf("quantity must be between 1 and %d", maxItemQuantity)
+	errLineMismatch    = errors.New("product_id and sku_id are fixed by the cart line; add the other product instead")
+	errProductRef      = errors.New("product_id must be a positive integer and sku_id, when given, too")
+)
+
+// validProductRef reports whether productID and skuID can name a product
+// and SKU. Both end up in product-service URLs, so nothing but a positive
+// integer, written without leading zeros, gets through.
+func validProductRef(productID string, skuID int) bool {
+	id, err := strconv.ParseInt(productID, 10, 64)
+	return err == nil && id > 0 && strconv.FormatInt(id, 10) == productID && skuID >= 0
+}
+
+// maxItemQuantity caps the units of one product or SKU a cart line holds.
+const maxItemQuantity = 99
+
+func validQuantity(quantity int) bool {
+	return quantity >= 1 && quantity <= maxItemQuantity
+}
+
+// maxWriteRetries bounds how often a write is retried after another write
+// to the same cart slipped in between its read and its commit.
+const maxWriteRetries = 3
+
+// etag renders an item version as a strong entity tag.
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// etagMatches evaluates an If-Match header against the current version. An
+// absent header or "*" matches anything.
+func etagMatches(ifMatch string, version int) bool {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+	current := etag(version)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(tag) == current {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCartItem reads item itemID of the cart at key, checks it against
+// ifMatch and lets write queue the change, all under WATCH so a concurrent
+// write to the cart makes it start over instead of being overwritten.
+func writeCartItem(key, itemID, ifMatch string, write func(pipe redis.Pipeliner, current CartItem) error) error {
+	for attempt := 0; attempt < maxWriteRetries; attempt++ {
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			val, err := tx.HGet(ctx, key, itemID).Result()
+			if err == redis.Nil {
+				return errItemNotFound
+			} else if err != nil {
+				return err
+			}
+			var current CartItem
+			if err := json.Unmarshal([]byte(val), &current); err != nil {
+				return err
+			}
+			if !etagMatches(ifMatch, current.Version) {
+				return errVersionConflict
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return write(pipe, current)
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errVersionConflict
+}
+
+func writeCartItemError(w http.ResponseWriter, err error, action string) {
+	switch err {
+	case errItemNotFound:
+		http.Error(w, "Item not found", http.StatusNotFound)
+	case errVersionConflict:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errLineMismatch, errQuantityRange:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "Failed to "+action+" cart item", http.StatusInternalServerError)
+	}
+}
+
+func getCartItem(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+	itemID := vars["item_id"]
+	cart, err := loadCart(userID)
+	if err != nil {
+		http.Error(w, "Error fetching cart item", http.StatusInternalServerError)
+		return
+	}
+	for _, item := range cart.Items {
+		if item.ID == itemID {
+			w.Header().Set("ETag", etag(item.Version))
+			json.NewEncoder(w).Encode(item)
+			return
+		}
+	}
+	http.Error(w, "Item not found", http.StatusNotFound)
+}
+
+// updateCartItem replaces an item, refusing with 412 when If-Match names
+// a version other than the stored one. The product and SKU cannot change,
+// they are what the line is keyed by.
 func updateCartItem(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID := vars["user_id"]
@@ -168,35 +574,127 @@ func updateCartItem(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	_, err := rdb.HGet(ctx, key, itemID).Result()
-	if err == redis.Nil {
+	if !validQuantity(updatedItem.Quantity) {
+		http.Error(w, errQuantityRange.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validProductRef(updatedItem.ProductID, updatedItem.SKUID) {
+		http.Error(w, errProductRef.Error(), http.StatusBadRequest)
+		return
+	}
+	exists, err := rdb.HExists(ctx, key, itemID).Result()
+	if err != nil {
+		http.Error(w, "Error fetching cart item", http.StatusInternalServerError)
+		return
+	} else if !exists {
 		http.Error(w, "Item not found", http.StatusNotFound)
 		return
-	} else if err != nil {
+	}
+	currency, err := cartCurrency(userID, "")
+	if err != nil {
 		http.Error(w, "Error fetching cart item", http.StatusInternalServerError)
 		return
 	}
-	product, err := getProductDetails(updatedItem.ProductID)
+	product, err := getProductDetails(updatedItem.ProductID, updatedItem.SKUID, currency)
 	if err != nil {
 		http.Error(w, "Failed to fetch product", http.StatusInternalServerError)
 		return
 	}
-	updatedItem.Price = product.Price
-	itemBytes, _ := json.Marshal(updatedItem)
-	if err := rdb.HSet(ctx, key, itemID, itemBytes).Err(); err != nil {
-		http.Error(w, "Failed to update cart item", http.StatusInternalServerError)
+	updatedItem.Price, updatedItem.WasPrice = product.chargePrice(), product.WasPrice
+	updatedItem.WeightGrams, updatedItem.Category = product.WeightGrams, product.Category
+	updatedItem.ID, updatedItem.LineSubtotal = "", nil
+	err = writeCartItem(key, itemID, r.Header.Get("If-Match"), func(pipe redis.Pipeliner, current CartItem) error {
+		if updatedItem.ProductID != current.ProductID || updatedItem.SKUID != current.SKUID {
+			return errLineMismatch
+		}
+		updatedItem.Version, updatedItem.UpdatedAt = current.Version+1, time.Now().UTC()
+		itemBytes, _ := json.Marshal(updatedItem)
+		return pipe.HSet(ctx, key, itemID, itemBytes).Err()
+	})
+	if err != nil {
+		writeCartItemError(w, err, "update")
 		return
 	}
+	w.Header().Set("ETag", etag(updatedItem.Version))
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Cart item updated successfully"))
 }
 
+// setCartItemQuantity sets a line to an exact quantity; zero removes it.
+func setCartItemQuantity(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Quantity *int `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Quantity == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	writeCartItemQuantity(w, r, func(int) int { return *body.Quantity })
+}
+
+// changeCartItemQuantity adds delta, which may be negative, to a line's
+// quantity; a line brought down to zero is removed.
+func changeCartItemQuantity(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Delta int `json:"delta"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Delta == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	writeCartItemQuantity(w, r, func(current int) int { return current + body.Delta })
+}
+
+// writeCartItemQuantity moves a line to the quantity next computes from
+// the stored one, within writeCartItem so concurrent changes all count.
+func writeCartItemQuantity(w http.ResponseWriter, r *http.Request, next func(current int) int) {
+	vars := mux.Vars(r)
+	key := fmt.Sprintf("cart:%s", vars["user_id"])
+	itemID := vars["item_id"]
+	var updated CartItem
+	err := writeCartItem(key, itemID, r.Header.Get("If-Match"), func(pipe redis.Pipeliner, current CartItem) error {
+		quantity := next(current.Quantity)
+		if quantity == 0 {
+			updated = CartItem{}
+			return pipe.HDel(ctx, key, itemID).Err()
+		}
+		if !validQuantity(quantity) {
+			return errQuantityRange
+		}
+		updated = current
+		updated.Quantity, updated.Version = quantity, current.Version+1
+		updated.UpdatedAt = time.Now().UTC()
+		itemBytes, _ := json.Marshal(updated)
+		return pipe.HSet(ctx, key, itemID, itemBytes).Err()
+	})
+	if err != nil {
+		writeCartItemError(w, err, "update")
+		return
+	}
+	if updated.Version == 0 {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Cart item deleted successfully"))
+		return
+	}
+	updated.ID = itemID
+	w.Header().Set("ETag", etag(updated.Version))
+	json.NewEncoder(w).Encode(updated)
+}
+
 func deleteCartItem(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID := vars["user_id"]
 	itemID := vars["item_id"]
 	key := fmt.Sprintf("cart:%s", userID)
-	if err := rdb.HDel(ctx, key, itemID).Err(); err != nil {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		err := writeCartItem(key, itemID, ifMatch, func(pipe redis.Pipeliner, _ CartItem) error {
+			return pipe.HDel(ctx, key, itemID).Err()
+		})
+		if err != nil {
+			writeCartItemError(w, err, "delete")
+			return
+		}
+	} else if err := rdb.HDel(ctx, key, itemID).Err(); err != nil {
 		http.Error(w, "Failed to delete cart item", http.StatusInternalServerError)
 		return
 	}
@@ -207,15 +705,28 @@ func deleteCartItem(w http.ResponseWriter, r *http.Request) {
 func main() {
 	r := mux.NewRouter()
 	api := r.PathPrefix("/api/v1").Subrouter()
+	api.Use(guestCartGuard, trackCartActivity)
+	api.HandleFunc("/guest-carts", createGuestCart).Methods("POST")
 	api.HandleFunc("/cart/{user_id}", addToCart).Methods("POST")
 	api.HandleFunc("/cart/{user_id}", getCart).Methods("GET")
 	api.HandleFunc("/cart/{user_id}/checkout", checkout).Methods("POST")
+	api.HandleFunc("/cart/{user_id}/merge", mergeGuestCart).Methods("POST")
+	api.HandleFunc("/cart/{user_id}/region", setCartRegion).Methods("PUT")
+	api.HandleFunc("/cart/{user_id}/coupons", applyCoupon).Methods("POST")
+	api.HandleFunc("/cart/{user_id}/coupons/{code}", removeCoupon).Methods("DELETE")
+	api.HandleFunc("/coupons", requireCouponAdmin(listCoupons)).Methods("GET")
+	api.HandleFunc("/coupons", requireCouponAdmin(createCoupon)).Methods("POST")
+	api.HandleFunc("/coupons/{code}", requireCouponAdmin(couponHandler)).Methods("GET", "PUT", "DELETE")
+	api.HandleFunc("/cart/{user_id}/{item_id}", getCartItem).Methods("GET")
 	api.HandleFunc("/cart/{user_id}/{item_id}", updateCartItem).Methods("PUT")
+	api.HandleFunc("/cart/{user_id}/{item_id}", changeCartItemQuantity).Methods("PATCH")
 	api.HandleFunc("/cart/{user_id}/{item_id}", deleteCartItem).Methods("DELETE")
+	api.HandleFunc("/cart/{user_id}/{item_id}/quantity", setCartItemQuantity).Methods("PUT")
 	handler := cors.New(cors.Options{
 		AllowedOrigins: getAllowedOrigins(),
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders: []string{"Content-Type", "Authorization"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "If-Match", cartTokenHeader},
+		ExposedHeaders: []string{"ETag"},
 	}).Handler(r)
 	srv := &http.Server{
 		Handler:      handler,
@@ -223,6 +734,7 @@ func main() {
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
+	go watchAbandonedCarts()
 	log.Println("Shopping Cart Service running on port 8080")
 	log.Fatal(srv.ListenAndServe())
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"mallhive/shared/money"
+)
+
+func TestAddToCartProductID(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"product", `{"product_id": "7"}`, http.StatusCreated},
+		{"sku", `{"product_id": "7", "sku_id": 3}`, http.StatusCreated},
+		{"missing", `{}`, http.StatusBadRequest},
+		{"sub-resource", `{"product_id": "5/skus/3"}`, http.StatusBadRequest},
+		{"path traversal", `{"product_id": "../x"}`, http.StatusBadRequest},
+		{"query", `{"product_id": "7?currency=JPY"}`, http.StatusBadRequest},
+		{"leading zero", `{"product_id": "07"}`, http.StatusBadRequest},
+		{"zero", `{"product_id": "0"}`, http.StatusBadRequest},
+		{"negative", `{"product_id": "-7"}`, http.StatusBadRequest},
+		{"negative sku", `{"product_id": "7", "sku_id": -3}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestRedis(t)
+			var asked []string
+			products := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				asked = append(asked, r.URL.Path)
+				w.Write([]byte(`{"id": 7, "price": {"amount": 1000, "currency": "` + money.DefaultCurrency + `"}}`))
+			}))
+			defer products.Close()
+			savedURL := productSvcURL
+			productSvcURL = products.URL
+			defer func() { productSvcURL = savedURL }()
+
+			router := mux.NewRouter()
+			router.HandleFunc("/cart/{user_id}", addToCart)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/cart/42", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusBadRequest && len(asked) > 0 {
+				t.Errorf("product service asked for %v", asked)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"mallhive/shared/money"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// useTestRedis points the service at a fresh in-memory Redis for the test.
+func useTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	saved := rdb
+	rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		rdb.Close()
+		rdb = saved
+	})
+	return mr
+}
+
+// putCartLine stores a line straight into userID's cart.
+func putCartLine(t *testing.T, userID string, item CartItem) {
+	t.Helper()
+	data, _ := json.Marshal(item)
+	if err := rdb.HSet(ctx, "cart:"+userID, lineID(item.ProductID, item.SKUID), data).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// putCoupon stores c and applies it to userID's cart.
+func putCoupon(t *testing.T, userID string, c Coupon) {
+	t.Helper()
+	data, _ := json.Marshal(c)
+	if err := rdb.Set(ctx, couponKey(c.Code), data, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.RPush(ctx, cartCouponsKey(userID), c.Code).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	tests := []struct {
+		name         string
+		orderStatus  int
+		usedByUser   int // the user's redemptions before checkout
+		wantStatus   int
+		wantUses     int
+		wantUserUses int
+		wantCart     bool // cart still there afterwards
+	}{
+		{"order placed", http.StatusCreated, 0, http.StatusOK, 1, 1, false},
+		{"order service refuses", http.StatusBadRequest, 0, http.StatusInternalServerError, 0, 0, true},
+		{"order service answers 200", http.StatusOK, 0, http.StatusInternalServerError, 0, 0, true},
+		{"coupon used up by user", http.StatusCreated, 1, http.StatusConflict, 0, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestRedis(t)
+			var gotOrder map[string]any
+			orders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if err := json.Unmarshal(body, &gotOrder); err != nil {
+					t.Errorf("order request %s: %v", body, err)
+				}
+				w.WriteHeader(tt.orderStatus)
+			}))
+			defer orders.Close()
+			savedEndpoint := orderSvcEndpoint
+			orderSvcEndpoint = orders.URL
+			defer func() { orderSvcEndpoint = savedEndpoint }()
+
+			putCartLine(t, "42", CartItem{
+				ProductID: "7", Quantity: 2, Version: 1,
+				Price: money.Money{Amount: 1000, Currency: "USD"},
+			})
+			putCoupon(t, "42", Coupon{
+				Code: "ONCE", Type: CouponPercentage, Percent: "10",
+				MaxUses: 10, MaxUsesPerUser: 1, Active: true,
+			})
+			if tt.usedByUser > 0 {
+				rdb.Set(ctx, couponUsesKey("ONCE", "42"), tt.usedByUser, 0)
+			}
+
+			router := mux.NewRouter()
+			router.HandleFunc("/cart/{user_id}/checkout", checkout)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/cart/42/checkout", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.usedByUser == 0 && gotOrder["user_id"] != float64(42) {
+				t.Errorf("order request user_id = %#v, want the number 42", gotOrder["user_id"])
+			}
+			uses, _ := rdb.Get(ctx, couponUsesKey("ONCE", "")).Int()
+			if uses != tt.wantUses {
+				t.Errorf("coupon uses = %d, want %d", uses, tt.wantUses)
+			}
+			userUses, _ := rdb.Get(ctx, couponUsesKey("ONCE", "42")).Int()
+			if userUses != tt.wantUserUses {
+				t.Errorf("coupon uses by user = %d, want %d", userUses, tt.wantUserUses)
+			}
+			if n, _ := rdb.Exists(ctx, "cart:42").Result(); (n == 1) != tt.wantCart {
+				t.Errorf("cart exists = %v, want %v", n == 1, tt.wantCart)
+			}
+		})
+	}
+}
+
+// TestCheckoutLastCouponUse checks out with a coupon on its only allowed
+// use: the order service reads the cart back after the use was counted and
+// must still see the discount.
+func TestCheckoutLastCouponUse(t *testing.T) {
+	useTestRedis(t)
+	router := mux.NewRouter()
+	router.HandleFunc("/cart/{user_id}", getCart)
+	router.HandleFunc("/cart/{user_id}/checkout", checkout)
+	carts := httptest.NewServer(router)
+	defer carts.Close()
+
+	var seen Cart
+	orders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := http.Get(carts.URL + "/cart/42")
+		if err != nil {
+			t.Errorf("reading the cart back: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&seen)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer orders.Close()
+	savedEndpoint := orderSvcEndpoint
+	orderSvcEndpoint = orders.URL
+	defer func() { orderSvcEndpoint = savedEndpoint }()
+
+	putCartLine(t, "42", CartItem{ProductID: "7", Quantity: 2, Version: 1, Price: money.Money{Amount: 1000, Currency: "USD"}})
+	putCoupon(t, "42", Coupon{Code: "LAST", Type: CouponPercentage, Percent: "10", MaxUses: 1, Active: true})
+
+	resp, err := http.Post(carts.URL+"/cart/42/checkout", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if want := (money.Money{Amount: 200, Currency: "USD"}); seen.Discount != want || len(seen.Coupons) != 1 || seen.Coupons[0].Reason != "" {
+		t.Errorf("order service saw discount %v with coupons %+v, want %v from LAST", seen.Discount, seen.Coupons, want)
+	}
+	if uses, _ := rdb.Get(ctx, couponUsesKey("LAST", "")).Int(); uses != 1 {
+		t.Errorf("coupon uses = %d, want 1", uses)
+	}
+	if n, _ := rdb.Exists(ctx, cartRedeemedKey("42")).Result(); n != 0 {
+		t.Error("checkout left its redemptions behind")
+	}
+}
+
+func TestCheckoutRefusesGuests(t *testing.T) {
+	useTestRedis(t)
+	router := mux.NewRouter()
+	router.HandleFunc("/cart/{user_id}/checkout", checkout)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/cart/"+guestPrefix+"abc/checkout", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+// TestCheckoutCartContract pins the cart order-service reads back at
+// checkout to testdata/checkout_cart.json, which order-service's own tests
+// decode the way it does when placing the order. Run with -update after a
+// deliberate change to the response, then rerun order-service's tests.
+func TestCheckoutCartContract(t *testing.T) {
+	useTestRedis(t)
+	useTaxTable(t, `{"default": "0", "regions": {"DE": "19"}}`)
+	useShippingRules(t, `{"EUR": {"flat": "4.99"}}`)
+	eur := func(cents int64) money.Money { return money.Money{Amount: cents, Currency: "EUR"} }
+	putCartLine(t, "42", CartItem{
+		ProductID: "7", SKUID: 3, Quantity: 2, Version: 4,
+		Price: eur(1250), WasPrice: &money.Money{Amount: 1500, Currency: "EUR"},
+		WeightGrams: 300, Category: "shoes",
+		UpdatedAt: time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC),
+	})
+	rdb.Set(ctx, currencyKey("42"), "EUR", 0)
+	rdb.Set(ctx, regionKey("42"), "DE", 0)
+	putCoupon(t, "42", Coupon{Code: "TENOFF", Type: CouponPercentage, Percent: "10", Active: true})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/cart/{user_id}", getCart)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cart/42", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	const golden = "testdata/checkout_cart.json"
+	if *update {
+		if err := os.WriteFile(golden, rec.Body.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), want) {
+		t.Errorf("getCart served\n%s\nwant %s\n(run with -update if the change is deliberate)", rec.Body, want)
+	}
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"mallhive/shared/money"
+)
+
+// Coupon types
+const (
+	CouponPercentage   = "percentage"
+	CouponFixed        = "fixed"
+	CouponFreeShipping = "free_shipping"
+)
+
+// Coupon is a promotion shoppers apply by code. Percentage and fixed
+// coupons discount the lines they target, every line when neither
+// ProductIDs nor Categories is set; free-shipping coupons waive shipping.
+// Amount and MinSpend tie a coupon to their currency. A cart may combine
+// several coupons only when all of them are Stackable.
+type Coupon struct {
+	Code           string       `json:"code"`
+	Type           string       `json:"type"`
+	Percent        json.Number  `json:"percent,omitempty"` // percentage coupons, e.g. "15"
+	Amount         *money.Money `json:"amount,omitempty"`  // fixed coupons
+	MinSpend       *money.Money `json:"min_spend,omitempty"`
+	ProductIDs     []string     `json:"product_ids,omitempty"`
+	Categories     []string     `json:"categories,omitempty"` // category slugs
+	MaxUses        int          `json:"max_uses,omitempty"`   // 0 is unlimited
+	MaxUsesPerUser int          `json:"max_uses_per_user,omitempty"`
+	StartsAt       *time.Time   `json:"starts_at,omitempty"`
+	ExpiresAt      *time.Time   `json:"expires_at,omitempty"`
+	Stackable      bool         `json:"stackable"`
+	Active         bool         `json:"active"`
+
+	// Read-only: redemptions so far
+	Uses int `json:"uses"`
+}
+
+// AppliedCoupon is a coupon on a cart and what it takes off. A coupon that
+// stopped applying, e.g. because the cart fell below its minimum spend,
+// stays on the cart with a zero discount and the reason.
+type AppliedCoupon struct {
+	Code         string      `json:"code"`
+	Type         string      `json:"type"`
+	Discount     money.Money `json:"discount"`
+	FreeShipping bool        `json:"free_shipping,omitempty"`
+	Reason       string      `json:"reason,omitempty"`
+}
+
+var (
+	errCouponNotFound   = errors.New("coupon not found")
+	errCouponApplied    = errors.New("coupon is already applied")
+	errCouponNotStacked = errors.New("coupon cannot be combined with the coupons already applied")
+	errCouponUsedUp     = errors.New("coupon has reached its usage limit")
+)
+
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+func couponKey(code string) string {
+	return "coupon:" + code
+}
+
+// couponUsesKey counts redemptions of code overall, or by one user when
+// userID is given.
+func couponUsesKey(code, userID string) string {
+	if userID == "" {
+		return fmt.Sprintf("coupon:%s:uses", code)
+	}
+	return fmt.Sprintf("coupon:%s:uses:%s", code, userID)
+}
+
+func cartCouponsKey(userID string) string {
+	return fmt.Sprintf("cart:%s:coupons", userID)
+}
+
+// cartRedeemedKey is the set of coupons a checkout of userID's cart has
+// counted a use of while its order is being placed. The order service
+// reads the cart back meanwhile, and that use must not make a coupon on
+// its last allowed use look used up to it.
+func cartRedeemedKey(userID string) string {
+	return fmt.Sprintf("cart:%s:redeemed", userID)
+}
+
+// checkoutHold bounds how long a checkout's redemptions are excluded from
+// the cart's own limit checks, should it never finish.
+const checkoutHold = 5 * time.Minute
+
+// couponIndexKey is the set of every coupon code, for listing.
+const couponIndexKey = "coupons"
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// validateCoupon checks a coupon definition before it is stored.
+func validateCoupon(c *Coupon) error {
+	c.Code = normalizeCouponCode(c.Code)
+	if !couponCodePattern.MatchString(c.Code) {
+		return errors.New("code must be 3 to 32 letters, digits, '-' or '_'")
+	}
+	switch c.Type {
+	case CouponPercentage:
+		if _, err := couponPercent(c.Percent); err != nil {
+			return err
+		}
+		c.Amount = nil
+	case CouponFixed:
+		if c.Amount == nil || c.Amount.Currency == "" || c.Amount.Amount <= 0 {
+			return errors.New("fixed coupons need a positive amount with a currency")
+		}
+		c.Percent = ""
+	case CouponFreeShipping:
+		c.Percent, c.Amount = "", nil
+	default:
+		return errors.New("type must be percentage, fixed or free_shipping")
+	}
+	if c.MinSpend != nil {
+		// A bare minimum spend is in the fixed amount's currency
+		if c.Amount != nil {
+			spend := c.MinSpend.In(c.Amount.Currency)
+			c.MinSpend = &spend
+		}
+		if c.MinSpend.Currency == "" || c.MinSpend.Amount < 0 {
+			return errors.New("min_spend needs a non-negative amount with a currency")
+		}
+		if c.Amount != nil && c.Amount.Currency != c.MinSpend.Currency {
+			return errors.New("amount and min_spend must be in the same currency")
+		}
+	}
+	for _, m := range []*money.Money{c.Amount, c.MinSpend} {
+		if m != nil && (!money.ValidCurrency(m.Currency) || money.Exponent(m.Currency) > 2) {
+			return money.ErrInvalidCurrency
+		}
+	}
+	if c.MaxUses < 0 || c.MaxUsesPerUser < 0 {
+		return errors.New("usage limits must not be negative")
+	}
+	if c.StartsAt != nil && c.ExpiresAt != nil && !c.ExpiresAt.After(*c.StartsAt) {
+		return errors.New("expires_at must be after starts_at")
+	}
+	for i, slug := range c.Categories {
+		c.Categories[i] = strings.ToLower(strings.TrimSpace(slug))
+	}
+	return nil
+}
+
+// couponPercent reads a percentage as a fraction; it must be above 0 and
+// at most 100.
+func couponPercent(n json.Number) (*big.Rat, error) {
+	percent, ok := new(big.Rat).SetString(n.String())
+	if !ok || percent.Sign() <= 0 || percent.Cmp(big.NewRat(100, 1)) > 0 {
+		return nil, errors.New("percent must be above 0 and at most 100")
+	}
+	return percent.Quo(percent, big.NewRat(100, 1)), nil
+}
+
+func loadCoupon(code string) (Coupon, error) {
+	var c Coupon
+	val, err := rdb.Get(ctx, couponKey(code)).Result()
+	if err == redis.Nil {
+		return c, errCouponNotFound
+	} else if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal([]byte(val), &c); err != nil {
+		return c, err
+	}
+	uses, err := rdb.Get(ctx, couponUsesKey(code, "")).Int()
+	if err != nil && err != redis.Nil {
+		return c, err
+	}
+	c.Uses = uses
+	return c, nil
+}
+
+// cartCoupons loads the coupons on userID's cart in the order they were
+// applied. Coupons deleted since are dropped, and a use counted by the
+// cart's checkout in progress is left out of Uses.
+func cartCoupons(userID string) ([]Coupon, error) {
+	codes, err := rdb.LRange(ctx, cartCouponsKey(userID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	redeemed, err := rdb.SMembers(ctx, cartRedeemedKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	coupons := make([]Coupon, 0, len(codes))
+	for _, code := range codes {
+		c, err := loadCoupon(code)
+		if err == errCouponNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, r := range redeemed {
+			if r == c.Code && c.Uses > 0 {
+				c.Uses--
+			}
+		}
+		coupons = append(coupons, c)
+	}
+	return coupons, nil
+}
+
+// unavailable says why c cannot be used at all right now, or "".
+func (c Coupon) unavailable(now time.Time) string {
+	switch {
+	case !c.Active:
+		return "coupon is not active"
+	case c.StartsAt != nil && now.Before(*c.StartsAt):
+		return "coupon is not valid yet"
+	case c.ExpiresAt != nil && !now.Before(*c.ExpiresAt):
+		return "coupon has expired"
+	case c.MaxUses > 0 && c.Uses >= c.MaxUses:
+		return errCouponUsedUp.Error()
+	}
+	return ""
+}
+
+// targets reports whether c discounts item.
+func (c Coupon) targets(item CartItem) bool {
+	if len(c.ProductIDs) == 0 && len(c.Categories) == 0 {
+		return true
+	}
+	for _, id := range c.ProductIDs {
+		if id == item.ProductID {
+			return true
+		}
+	}
+	for _, slug := range c.Categories {
+		if slug == item.Category {
+			return true
+		}
+	}
+	return false
+}
+
+// applyCoupons works out what each of the cart's coupons takes off, in the
+// order they were applied, and returns whether shipping is waived. Each
+// discount is capped at what is left of the lines it targets after the
+// coupons before it, so the discount never exceeds the subtotal.
+func applyCoupons(cart *Cart, coupons []Coupon, now time.Time) (bool, error) {
+	remaining := make([]int64, len(cart.Items))
+	for i, item := range cart.Items {
+		remaining[i] = item.LineSubtotal.Amount
+	}
+	freeShipping := false
+	cart.Coupons = nil
+	for _, c := range coupons {
+		applied := AppliedCoupon{Code: c.Code, Type: c.Type, Discount: money.Money{Currency: cart.Currency}}
+		applied.Reason = couponReason(c, cart, now)
+		if applied.Reason == "" {
+			var eligible int64
+			for i, item := range cart.Items {
+				if c.targets(item) {
+					eligible += remaining[i]
+				}
+			}
+			var off money.Money
+			var err error
+			switch c.Type {
+			case CouponPercentage:
+				rate, _ := couponPercent(c.Percent)
+				off, err = applyRate(money.Money{Amount: eligible, Currency: cart.Currency}, rate)
+			case CouponFixed:
+				off = *c.Amount
+			case CouponFreeShipping:
+				applied.FreeShipping, freeShipping = true, true
+			}
+			if err != nil {
+				return false, err
+			}
+			if off.Amount > eligible {
+				off.Amount = eligible
+			}
+			applied.Discount.Amount = off.Amount
+			// Take the discount off the targeted lines in order
+			left := off.Amount
+			for i, item := range cart.Items {
+				if left == 0 {
+					break
+				}
+				if c.targets(item) {
+					take := min(left, remaining[i])
+					remaining[i] -= take
+					left -= take
+				}
+			}
+		}
+		var err error
+		if cart.Discount, err = cart.Discount.Add(applied.Discount); err != nil {
+			return false, err
+		}
+		cart.Coupons = append(cart.Coupons, applied)
+	}
+	return freeShipping, nil
+}
+
+// couponReason says why c takes nothing off cart, or "" when it applies.
+func couponReason(c Coupon, cart *Cart, now time.Time) string {
+	if reason := c.unavailable(now); reason != "" {
+		return reason
+	}
+	for _, m := range []*money.Money{c.Amount, c.MinSpend} {
+		if m != nil && m.Currency != cart.Currency {
+			return fmt.Sprintf("coupon is only valid for %s carts", m.Currency)
+		}
+	}
+	if c.MinSpend != nil && cart.Subtotal.Amount < c.MinSpend.Amount {
+		return fmt.Sprintf("minimum spend is %s", c.MinSpend)
+	}
+	if c.Type != CouponFreeShipping {
+		for _, item := range cart.Items {
+			if c.targets(item) {
+				return ""
+			}
+		}
+		return "no item in the cart qualifies"
+	}
+	return ""
+}
+
+// applyCoupon serves POST /cart/{user_id}/coupons with {"code": "..."} and
+// returns the repriced cart.
+func applyCoupon(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["user_id"]
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	code := normalizeCouponCode(body.Code)
+	coupon, err := loadCoupon(code)
+	if err == errCouponNotFound {
+		http.Error(w, "Coupon not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to apply coupon", http.StatusInternalServerError)
+		return
+	}
+	err = addCartCoupon(userID, coupon)
+	var refused couponRefusedError
+	switch {
+	case err == errCouponApplied, err == errCouponNotStacked, err == errCouponUsedUp,
+		err == errVersionConflict, errors.As(err, &refused):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Failed to apply coupon", http.StatusInternalServerError)
+		return
+	}
+	cart, err := loadCart(userID)
+	if err != nil {
+		http.Error(w, "Failed to get cart", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(cart)
+}
+
+// couponRefusedError carries the couponReason a coupon does not apply to
+// the cart for.
+type couponRefusedError struct {
+	reason string
+}
+
+func (e couponRefusedError) Error() string { return e.reason }
+
+// addCartCoupon appends coupon to userID's cart. The cart's coupons are
+// checked and the code pushed under WATCH, so two coupons applied at once
+// cannot both pass the stacking rules against the list without the other.
+func addCartCoupon(userID string, coupon Coupon) error {
+	key := cartCouponsKey(userID)
+	for attempt := 0; attempt < maxWriteRetries; attempt++ {
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			cart, err := loadCart(userID)
+			if err != nil {
+				return err
+			}
+			if err := checkCouponFits(cart, coupon, userID); err != nil {
+				return err
+			}
+			if reason := couponReason(coupon, &cart, time.Now()); reason != "" {
+				return couponRefusedError{reason}
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return pipe.RPush(ctx, key, coupon.Code).Err()
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errVersionConflict
+}
+
+// checkCouponFits enforces the stacking rules and the per-user limit for
+// adding coupon to cart.
+func checkCouponFits(cart Cart, coupon Coupon, userID string) error {
+	for _, c := range cart.coupons {
+		if c.Code == coupon.Code {
+			return errCouponApplied
+		}
+		if !c.Stackable || !coupon.Stackable {
+			return errCouponNotStacked
+		}
+	}
+	if coupon.MaxUsesPerUser > 0 {
+		used, err := rdb.Get(ctx, couponUsesKey(coupon.Code, userID)).Int()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if used >= coupon.MaxUsesPerUser {
+			return errCouponUsedUp
+		}
+	}
+	return nil
+}
+
+// removeCoupon serves DELETE /cart/{user_id}/coupons/{code}.
+func removeCoupon(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+	code := normalizeCouponCode(vars["code"])
+	n, err := rdb.LRem(ctx, cartCouponsKey(userID), 0, code).Result()
+	if err != nil {
+		http.Error(w, "Failed to remove coupon", http.StatusInternalServerError)
+		return
+	} else if n == 0 {
+		http.Error(w, "Coupon not applied", http.StatusNotFound)
+		return
+	}
+	cart, err := loadCart(userID)
+	if err != nil {
+		http.Error(w, "Failed to get cart", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(cart)
+}
+
+// redeemCoupons counts one use of each coupon that took something off the
+// cart, against the global and per-user limits, under WATCH so concurrent
+// checkouts cannot overrun them. Either every coupon is counted or none.
+// The counted coupons are noted under cartRedeemedKey until the checkout
+// ends.
+func redeemCoupons(userID string, cart Cart) error {
+	var keys []string
+	var codes []interface{}
+	limits := map[string]int{}
+	for _, applied := range cart.Coupons {
+		if applied.Reason != "" {
+			continue
+		}
+		c, err := loadCoupon(applied.Code)
+		if err != nil {
+			return err
+		}
+		global, user := couponUsesKey(c.Code, ""), couponUsesKey(c.Code, userID)
+		keys = append(keys, global, user)
+		limits[global], limits[user] = c.MaxUses, c.MaxUsesPerUser
+		codes = append(codes, c.Code)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	for attempt := 0; attempt < maxWriteRetries; attempt++ {
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			for _, key := range keys {
+				used, err := tx.Get(ctx, key).Int()
+				if err != nil && err != redis.Nil {
+					return err
+				}
+				if limits[key] > 0 && used >= limits[key] {
+					return errCouponUsedUp
+				}
+			}
+			_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, key := range keys {
+					pipe.Incr(ctx, key)
+				}
+				pipe.Del(ctx, cartRedeemedKey(userID))
+				pipe.SAdd(ctx, cartRedeemedKey(userID), codes...)
+				pipe.Expire(ctx, cartRedeemedKey(userID), checkoutHold)
+				return nil
+			})
+			return err
+		}, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errVersionConflict
+}
+
+// releaseCoupons gives back the uses redeemCoupons counted when the order
+// could not be placed.
+func releaseCoupons(userID string, cart Cart) {
+	for _, applied := range cart.Coupons {
+		if applied.Reason != "" {
+			continue
+		}
+		rdb.Decr(ctx, couponUsesKey(applied.Code, ""))
+		rdb.Decr(ctx, couponUsesKey(applied.Code, userID))
+	}
+	rdb.Del(ctx, cartRedeemedKey(userID))
+}
+
+// requireCouponAdmin lets coupon management through only with the bearer
+// token in COUPON_ADMIN_TOKEN. Without one configured it stays closed.
+func requireCouponAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		want := os.Getenv("COUPON_ADMIN_TOKEN")
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if want == "" || !ok || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// listCoupons serves GET /coupons, sorted by code.
+func listCoupons(w http.ResponseWriter, r *http.Request) {
+	codes, err := rdb.SMembers(ctx, couponIndexKey).Result()
+	if err != nil {
+		http.Error(w, "Failed to list coupons", http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(codes)
+	coupons := []Coupon{}
+	for _, code := range codes {
+		c, err := loadCoupon(code)
+		if err == errCouponNotFound {
+			continue
+		} else if err != nil {
+			http.Error(w, "Failed to list coupons", http.StatusInternalServerError)
+			return
+		}
+		coupons = append(coupons, c)
+	}
+	json.NewEncoder(w).Encode(coupons)
+}
+
+// createCoupon serves POST /coupons.
+func createCoupon(w http.ResponseWriter, r *http.Request) {
+	var c Coupon
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateCoupon(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Uses = 0
+	data, _ := json.Marshal(c)
+	created, err := rdb.SetNX(ctx, couponKey(c.Code), data, 0).Result()
+	if err != nil {
+		http.Error(w, "Failed to create coupon", http.StatusInternalServerError)
+		return
+	} else if !created {
+		http.Error(w, "Coupon code already exists", http.StatusConflict)
+		return
+	}
+	rdb.SAdd(ctx, couponIndexKey, c.Code)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// couponHandler serves GET, PUT and DELETE /coupons/{code}. PUT replaces
+// the definition and keeps the usage counts.
+func couponHandler(w http.ResponseWriter, r *http.Request) {
+	code := normalizeCouponCode(mux.Vars(r)["code"])
+	switch r.Method {
+	case http.MethodGet:
+		c, err := loadCoupon(code)
+		if err == errCouponNotFound {
+			http.Error(w, "Coupon not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to get coupon", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(c)
+
+	case http.MethodPut:
+		var c Coupon
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		c.Code, c.Uses = code, 0
+		if err := validateCoupon(&c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := json.Marshal(c)
+		updated, err := rdb.SetXX(ctx, couponKey(code), data, 0).Result()
+		if err != nil {
+			http.Error(w, "Failed to update coupon", http.StatusInternalServerError)
+			return
+		} else if !updated {
+			http.Error(w, "Coupon not found", http.StatusNotFound)
+			return
+		}
+		if c, err = loadCoupon(code); err != nil {
+			http.Error(w, "Failed to get coupon", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(c)
+
+	case http.MethodDelete:
+		n, err := rdb.Del(ctx, couponKey(code)).Result()
+		if err != nil {
+			http.Error(w, "Failed to delete coupon", http.StatusInternalServerError)
+			return
+		} else if n == 0 {
+			http.Error(w, "Coupon not found", http.StatusNotFound)
+			return
+		}
+		rdb.SRem(ctx, couponIndexKey, code)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Coupon deleted successfully"))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"mallhive/shared/money"
+)
+
+func TestAddCartCoupon(t *testing.T) {
+	stackable := Coupon{Code: "STACK", Type: CouponFixed, Amount: &money.Money{Amount: 100, Currency: "USD"}, Stackable: true, Active: true}
+	single := Coupon{Code: "SINGLE", Type: CouponFixed, Amount: &money.Money{Amount: 100, Currency: "USD"}, Active: true}
+	minSpend := Coupon{Code: "BIG", Type: CouponFreeShipping, MinSpend: &money.Money{Amount: 100000, Currency: "USD"}, Stackable: true, Active: true}
+
+	tests := []struct {
+		name    string
+		applied []Coupon
+		add     Coupon
+		wantErr error
+	}{
+		{"first coupon", nil, single, nil},
+		{"stacks", []Coupon{stackable}, Coupon{Code: "MORE", Type: CouponFreeShipping, Stackable: true, Active: true}, nil},
+		{"applied twice", []Coupon{stackable}, stackable, errCouponApplied},
+		{"does not stack", []Coupon{single}, stackable, errCouponNotStacked},
+		{"below minimum spend", nil, minSpend, couponRefusedError{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestRedis(t)
+			putCartLine(t, "42", CartItem{ProductID: "7", Quantity: 1, Version: 1, Price: money.Money{Amount: 1000, Currency: "USD"}})
+			for _, c := range append(tt.applied, tt.add) {
+				data, _ := json.Marshal(c)
+				rdb.Set(ctx, couponKey(c.Code), data, 0)
+			}
+			for _, c := range tt.applied {
+				rdb.RPush(ctx, cartCouponsKey("42"), c.Code)
+			}
+
+			err := addCartCoupon("42", tt.add)
+			var refused couponRefusedError
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("addCartCoupon: %v", err)
+			case errors.As(tt.wantErr, &refused):
+				if !errors.As(err, &refused) {
+					t.Fatalf("addCartCoupon = %v, want a refusal", err)
+				}
+			case err != tt.wantErr:
+				t.Fatalf("addCartCoupon = %v, want %v", err, tt.wantErr)
+			}
+
+			codes, _ := rdb.LRange(ctx, cartCouponsKey("42"), 0, -1).Result()
+			want := len(tt.applied)
+			if tt.wantErr == nil {
+				want++
+			}
+			if len(codes) != want {
+				t.Errorf("cart coupons = %v, want %d", codes, want)
+			}
+		})
+	}
+}
+
+// TestApplyCouponsLineOrder spreads a fixed discount over several lines
+// before a category coupon: what is left for the category depends on which
+// lines the fixed discount used up, so it must not depend on the order the
+// lines were read in.
+func TestApplyCouponsLineOrder(t *testing.T) {
+	shoes := CartItem{ID: "7", ProductID: "7", Category: "shoes", Price: usd(1000), Quantity: 1}
+	hat := CartItem{ID: "9", ProductID: "9", Category: "hats", Price: usd(1000), Quantity: 1}
+	scarf := CartItem{ID: "12", ProductID: "12", Category: "scarves", Price: usd(500), Quantity: 1}
+	coupons := []Coupon{
+		{Code: "FIFTEEN", Type: CouponFixed, Amount: &money.Money{Amount: 1500, Currency: "USD"}, Stackable: true, Active: true},
+		{Code: "SHOES", Type: CouponPercentage, Percent: "50", Categories: []string{"shoes"}, Stackable: true, Active: true},
+	}
+	for _, items := range [][]CartItem{{shoes, hat, scarf}, {hat, scarf, shoes}, {scarf, shoes, hat}} {
+		cart := Cart{Currency: "USD", Items: items, coupons: coupons}
+		if err := priceCart(&cart); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, item := range cart.Items {
+			ids = append(ids, item.ID)
+		}
+		// "12" sorts first: FIFTEEN takes all of it and 10.00 of the shoes
+		if !reflect.DeepEqual(ids, []string{"12", "7", "9"}) {
+			t.Errorf("lines %v, want [12 7 9]", ids)
+		}
+		if cart.Coupons[0].Discount != usd(1500) || cart.Coupons[1].Discount != usd(0) || cart.Discount != usd(1500) {
+			t.Errorf("lines %v: discounts %v and %v, total %v, want 15.00, 0.00 and 15.00 USD",
+				ids, cart.Coupons[0].Discount, cart.Coupons[1].Discount, cart.Discount)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"mallhive/shared/money"
+)
+
+// Guest carts live under a generated id such as "guest-3f9c...", in place
+// of a user id, and every request for one must carry its signed token in
+// the X-Cart-Token header.
+const (
+	guestPrefix      = "guest-"
+	cartTokenHeader  = "X-Cart-Token"
+	defaultMergeRule = MergeSum
+)
+
+// Merge rules for a product on both carts
+const (
+	MergeSum        = "sum"         // add the quantities, up to maxItemQuantity
+	MergeKeepNewest = "keep_newest" // keep the line changed last
+)
+
+var (
+	errGuestCartsOff    = errors.New("guest carts are not configured")
+	errInvalidCartToken = errors.New("invalid cart token")
+	errMergeRule        = fmt.Errorf("strategy must be %s or %s", MergeSum, MergeKeepNewest)
+)
+
+func isGuestCart(cartID string) bool {
+	return strings.HasPrefix(cartID, guestPrefix)
+}
+
+// cartTokenSecret signs guest cart tokens; guest carts are off without it.
+func cartTokenSecret() []byte {
+	return []byte(os.Getenv("CART_TOKEN_SECRET"))
+}
+
+func signCartID(secret []byte, cartID string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(cartID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newCartToken returns "<cart id>.<signature>" for cartID.
+func newCartToken(cartID string) (string, error) {
+	secret := cartTokenSecret()
+	if len(secret) == 0 {
+		return "", errGuestCartsOff
+	}
+	return cartID + "." + signCartID(secret, cartID), nil
+}
+
+// verifyCartToken returns the guest cart id token was issued for.
+func verifyCartToken(token string) (string, error) {
+	secret := cartTokenSecret()
+	if len(secret) == 0 {
+		return "", errGuestCartsOff
+	}
+	cartID, sig, ok := strings.Cut(token, ".")
+	if !ok || !isGuestCart(cartID) || !hmac.Equal([]byte(sig), []byte(signCartID(secret, cartID))) {
+		return "", errInvalidCartToken
+	}
+	return cartID, nil
+}
+
+// createGuestCart serves POST /guest-carts: it hands out a new guest cart
+// id and the token that unlocks it. The cart itself appears on first add.
+func createGuestCart(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "Failed to create guest cart", http.StatusInternalServerError)
+		return
+	}
+	cartID := guestPrefix + hex.EncodeToString(buf)
+	token, err := newCartToken(cartID)
+	if err == errGuestCartsOff {
+		http.Error(w, "Guest carts are not available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"cart_id": cartID, "cart_token": token})
+}
+
+// guestCartGuard rejects requests for a guest cart that lack its token.
+// User carts pass through untouched.
+func guestCartGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cartID := mux.Vars(r)["user_id"]
+		if !isGuestCart(cartID) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tokenID, err := verifyCartToken(r.Header.Get(cartTokenHeader))
+		if err != nil || tokenID != cartID {
+			http.Error(w, "Invalid cart token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mergeRule is ?strategy= when given, else CART_MERGE_STRATEGY, else sum.
+func mergeRule(requested string) (string, error) {
+	rule := requested
+	if rule == "" {
+		rule = os.Getenv("CART_MERGE_STRATEGY")
+	}
+	if rule == "" {
+		rule = defaultMergeRule
+	}
+	if rule != MergeSum && rule != MergeKeepNewest {
+		return "", errMergeRule
+	}
+	return rule, nil
+}
+
+// mergeGuestCart serves POST /cart/{user_id}/merge, called on login with
+// the guest cart's token in X-Cart-Token. The guest's lines move into the
+// user's cart, repriced if the carts differ in currency; a product on both
+// is resolved by the merge rule. The user's currency, region and coupons
+// win; the guest's apply when the user's cart has none. The guest cart is
+// deleted in the same transaction.
+func mergeGuestCart(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["user_id"]
+	if isGuestCart(userID) {
+		http.Error(w, "Cannot merge into a guest cart", http.StatusBadRequest)
+		return
+	}
+	guestID, err := verifyCartToken(r.Header.Get(cartTokenHeader))
+	if err != nil {
+		http.Error(w, "Invalid cart token", http.StatusUnauthorized)
+		return
+	}
+	rule, err := mergeRule(r.URL.Query().Get("strategy"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = mergeCarts(guestID, userID, rule)
+	if err == errVersionConflict {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to merge carts", http.StatusInternalServerError)
+		return
+	}
+	cart, err := loadCart(userID)
+	if err != nil {
+		http.Error(w, "Failed to get cart", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(cart)
+}
+
+// cartKeys lists every key a cart is stored under.
+func cartKeys(cartID string) []string {
+	return []string{fmt.Sprintf("cart:%s", cartID), currencyKey(cartID), regionKey(cartID), cartCouponsKey(cartID), abandonedKey(cartID), abandonedDeliveriesKey(cartID)}
+}
+
+// mergeCarts moves guestID's cart into userID's under WATCH on both. The
+// guest's lines are priced in the merged cart's currency beforehand, so no
+// product-service call runs while the carts are watched; a guest cart that
+// changed in between is priced again.
+func mergeCarts(guestID, userID, rule string) error {
+	userKey := fmt.Sprintf("cart:%s", userID)
+	keys := append(cartKeys(guestID), cartKeys(userID)...)
+	for attempt := 0; attempt < maxWriteRetries; attempt++ {
+		currency, prices, err := priceGuestLines(guestID, userID)
+		if err != nil {
+			return err
+		}
+		err = rdb.Watch(ctx, func(tx *redis.Tx) error {
+			guest, err := readCartState(tx, guestID)
+			if err != nil || len(guest.lines) == 0 {
+				return err
+			}
+			user, err := readCartState(tx, userID)
+			if err != nil {
+				return err
+			}
+			if mergedCurrency(guest, user) != currency {
+				return errStalePrices
+			}
+			merged, err := mergeLines(guest, user, currency, rule, prices, time.Now().UTC())
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				for id, line := range merged {
+					line.ID, line.LineSubtotal = "", nil
+					itemBytes, _ := json.Marshal(line)
+					pipe.HSet(ctx, userKey, id, itemBytes)
+				}
+				pipe.Set(ctx, currencyKey(userID), currency, 0)
+				if user.region == "" && guest.region != "" {
+					pipe.Set(ctx, regionKey(userID), guest.region, 0)
+				}
+				if len(user.coupons) == 0 && len(guest.coupons) > 0 {
+					pipe.RPush(ctx, cartCouponsKey(userID), toAny(guest.coupons)...)
+				}
+				pipe.Del(ctx, cartKeys(guestID)...)
+				pipe.ZRem(ctx, modifiedCartsKey, guestID)
+				return nil
+			})
+			return err
+		}, keys...)
+		if err != redis.TxFailedErr && err != errStalePrices {
+			if err == nil {
+				// A guest cart without lines may still hold a currency or region
+				err = rdb.Del(ctx, cartKeys(guestID)...).Err()
+			}
+			return err
+		}
+	}
+	return errVersionConflict
+}
+
+// errStalePrices means the carts changed between pricing the guest's lines
+// and merging them.
+var errStalePrices = errors.New("carts changed while pricing the guest's lines")
+
+// priceGuestLines reads both carts and fetches the price of each of the
+// guest's lines in the currency the merged cart will be in, keyed by line.
+// When the guest cart is in that currency already there is nothing to fetch.
+func priceGuestLines(guestID, userID string) (string, map[string]Product, error) {
+	guest, err := readCartState(rdb, guestID)
+	if err != nil {
+		return "", nil, err
+	}
+	user, err := readCartState(rdb, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	currency := mergedCurrency(guest, user)
+	if guest.currency == currency {
+		return currency, nil, nil
+	}
+	prices := make(map[string]Product, len(guest.lines))
+	for id, line := range guest.lines {
+		product, err := getProductDetails(line.ProductID, line.SKUID, currency)
+		if err != nil {
+			return "", nil, err
+		}
+		prices[id] = *product
+	}
+	return currency, prices, nil
+}
+
+// mergedCurrency is the currency of the cart mergeCarts produces: the
+// user's, unless the user's cart is empty.
+func mergedCurrency(guest, user cartState) string {
+	if len(user.lines) == 0 {
+		return guest.currency
+	}
+	return user.currency
+}
+
+// mergeLines works out the user's lines that change when guest is merged
+// into user, keyed by line. Guest lines in another currency are repriced
+// from prices; a line prices has no entry for returns errStalePrices. A
+// product on both carts is summed up to maxItemQuantity under MergeSum, or
+// under MergeKeepNewest takes whichever line was changed last.
+func mergeLines(guest, user cartState, currency, rule string, prices map[string]Product, now time.Time) (map[string]CartItem, error) {
+	merged := map[string]CartItem{}
+	for id, line := range guest.lines {
+		if guest.currency != currency {
+			product, ok := prices[id]
+			if !ok {
+				return nil, errStalePrices
+			}
+			line.Price, line.WasPrice = product.chargePrice(), product.WasPrice
+		}
+		existing, ok := user.lines[id]
+		if !ok {
+			merged[id] = line
+			continue
+		}
+		switch {
+		case rule == MergeSum:
+			existing.Quantity = min(existing.Quantity+line.Quantity, maxItemQuantity)
+		case line.UpdatedAt.After(existing.UpdatedAt):
+			line.Version = existing.Version
+			existing = line
+		default:
+			continue // the user's line is newer and stays as it is
+		}
+		existing.Version++
+		existing.UpdatedAt = now
+		merged[id] = existing
+	}
+	return merged, nil
+}
+
+// cartState is a cart as stored.
+type cartState struct {
+	lines    map[string]CartItem
+	currency string
+	region   string
+	coupons  []string
+}
+
+func readCartState(c redis.Cmdable, cartID string) (cartState, error) {
+	state := cartState{lines: map[string]CartItem{}, currency: money.DefaultCurrency}
+	entries, err := c.HGetAll(ctx, fmt.Sprintf("cart:%s", cartID)).Result()
+	if err != nil {
+		return state, err
+	}
+	for id, val := range entries {
+		var item CartItem
+		if err := json.Unmarshal([]byte(val), &item); err != nil {
+			return state, err
+		}
+		state.lines[id] = item
+	}
+	if currency, err := c.Get(ctx, currencyKey(cartID)).Result(); err == nil {
+		state.currency = currency
+	} else if err != redis.Nil {
+		return state, err
+	}
+	if region, err := c.Get(ctx, regionKey(cartID)).Result(); err == nil {
+		state.region = region
+	} else if err != redis.Nil {
+		return state, err
+	}
+	state.coupons, err = c.LRange(ctx, cartCouponsKey(cartID), 0, -1).Result()
+	return state, err
+}
+
+func toAny(values []string) []any {
+	out := make([]any, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"mallhive/shared/money"
+)
+
+func TestVerifyCartToken(t *testing.T) {
+	t.Setenv("CART_TOKEN_SECRET", "test-secret")
+	valid, err := newCartToken("guest-abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := newCartToken("guest-def")
+	tests := []struct {
+		name  string
+		token string
+		want  string // cart id, "" for rejected
+	}{
+		{"valid", valid, "guest-abc"},
+		{"empty", "", ""},
+		{"no signature", "guest-abc", ""},
+		{"empty signature", "guest-abc.", ""},
+		{"forged signature", "guest-abc." + signCartID([]byte("other-secret"), "guest-abc"), ""},
+		{"signature of another cart", "guest-abc." + other[len("guest-def."):], ""},
+		{"tampered cart id", "guest-abd." + valid[len("guest-abc."):], ""},
+		{"user cart", "42." + signCartID([]byte("test-secret"), "42"), ""},
+	}
+	for _, tt := range tests {
+		got, err := verifyCartToken(tt.token)
+		if tt.want == "" {
+			if err != errInvalidCartToken {
+				t.Errorf("%s: verifyCartToken(%q) = %q, %v, want errInvalidCartToken", tt.name, tt.token, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: verifyCartToken(%q) = %q, %v, want %q", tt.name, tt.token, got, err, tt.want)
+		}
+	}
+}
+
+func TestCartTokensNeedSecret(t *testing.T) {
+	t.Setenv("CART_TOKEN_SECRET", "")
+	if _, err := newCartToken("guest-abc"); err != errGuestCartsOff {
+		t.Errorf("newCartToken without a secret: %v, want errGuestCartsOff", err)
+	}
+	if _, err := verifyCartToken("guest-abc." + signCartID(nil, "guest-abc")); err != errGuestCartsOff {
+		t.Errorf("verifyCartToken without a secret: %v, want errGuestCartsOff", err)
+	}
+}
+
+func TestGuestCartGuard(t *testing.T) {
+	t.Setenv("CART_TOKEN_SECRET", "test-secret")
+	token, _ := newCartToken("guest-abc")
+	otherToken, _ := newCartToken("guest-def")
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"own token", "/cart/guest-abc", token, http.StatusOK},
+		{"no token", "/cart/guest-abc", "", http.StatusUnauthorized},
+		{"token for another cart", "/cart/guest-abc", otherToken, http.StatusUnauthorized},
+		{"user cart", "/cart/42", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		router := mux.NewRouter()
+		router.Use(guestCartGuard)
+		router.HandleFunc("/cart/{user_id}", func(w http.ResponseWriter, r *http.Request) {})
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set(cartTokenHeader, tt.token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestMergeLines(t *testing.T) {
+	older := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	now := newer.Add(time.Hour)
+	line := func(qty, version int, price money.Money, updated time.Time) CartItem {
+		return CartItem{ProductID: "7", Quantity: qty, Version: version, Price: price, UpdatedAt: updated}
+	}
+	eur := func(cents int64) money.Money { return money.Money{Amount: cents, Currency: "EUR"} }
+	state := func(currency string, lines ...CartItem) cartState {
+		s := cartState{lines: map[string]CartItem{}, currency: currency}
+		for _, l := range lines {
+			s.lines[lineID(l.ProductID, l.SKUID)] = l
+		}
+		return s
+	}
+
+	tests := []struct {
+		name   string
+		guest  cartState
+		user   cartState
+		rule   string
+		prices map[string]Product
+		want   map[string]CartItem
+	}{
+		{
+			name:  "guest line moves over",
+			guest: state("USD", line(2, 1, usd(500), older)),
+			user:  state("USD"),
+			rule:  MergeSum,
+			want:  map[string]CartItem{"7": line(2, 1, usd(500), older)},
+		},
+		{
+			name:  "sum adds quantities",
+			guest: state("USD", line(2, 1, usd(500), older)),
+			user:  state("USD", line(3, 4, usd(500), newer)),
+			rule:  MergeSum,
+			want:  map[string]CartItem{"7": line(5, 5, usd(500), now)},
+		},
+		{
+			name:  "sum caps at maxItemQuantity",
+			guest: state("USD", line(60, 1, usd(500), older)),
+			user:  state("USD", line(50, 2, usd(500), newer)),
+			rule:  MergeSum,
+			want:  map[string]CartItem{"7": line(maxItemQuantity, 3, usd(500), now)},
+		},
+		{
+			name:  "keep_newest takes the newer guest line",
+			guest: state("USD", line(1, 1, usd(450), newer)),
+			user:  state("USD", line(4, 6, usd(500), older)),
+			rule:  MergeKeepNewest,
+			want:  map[string]CartItem{"7": line(1, 7, usd(450), now)},
+		},
+		{
+			name:  "keep_newest leaves the newer user line",
+			guest: state("USD", line(1, 1, usd(450), older)),
+			user:  state("USD", line(4, 6, usd(500), newer)),
+			rule:  MergeKeepNewest,
+			want:  map[string]CartItem{},
+		},
+		{
+			name:   "guest line repriced into the user's currency",
+			guest:  state("USD", line(2, 1, usd(500), older)),
+			user:   state("EUR", CartItem{ProductID: "8", Quantity: 1, Version: 1, Price: eur(900)}),
+			rule:   MergeSum,
+			prices: map[string]Product{"7": {ID: 7, Price: eur(480)}},
+			want:   map[string]CartItem{"7": line(2, 1, eur(480), older)},
+		},
+		{
+			name:   "repricing charges the effective price",
+			guest:  state("USD", line(2, 1, usd(500), older)),
+			user:   state("EUR", CartItem{ProductID: "8", Quantity: 1, Version: 1, Price: eur(900)}),
+			rule:   MergeSum,
+			prices: map[string]Product{"7": {ID: 7, Price: eur(480), EffectivePrice: &money.Money{Amount: 400, Currency: "EUR"}}},
+			want:   map[string]CartItem{"7": line(2, 1, eur(400), older)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			currency := mergedCurrency(tt.guest, tt.user)
+			got, err := mergeLines(tt.guest, tt.user, currency, tt.rule, tt.prices, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("merged %d lines, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for id, want := range tt.want {
+				g := got[id]
+				if g.Quantity != want.Quantity || g.Version != want.Version || g.Price != want.Price || !g.UpdatedAt.Equal(want.UpdatedAt) {
+					t.Errorf("line %s = qty %d v%d %v at %v, want qty %d v%d %v at %v", id,
+						g.Quantity, g.Version, g.Price, g.UpdatedAt, want.Quantity, want.Version, want.Price, want.UpdatedAt)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeLinesStalePrices(t *testing.T) {
+	guest := cartState{currency: "USD", lines: map[string]CartItem{"7": {ProductID: "7", Quantity: 1, Price: usd(500)}}}
+	user := cartState{currency: "EUR", lines: map[string]CartItem{"8": {ProductID: "8", Quantity: 1}}}
+	if _, err := mergeLines(guest, user, "EUR", MergeSum, map[string]Product{}, time.Now()); err != errStalePrices {
+		t.Errorf("mergeLines without a price for a repriced line: %v, want errStalePrices", err)
+	}
+}
+
+func TestMergeCarts(t *testing.T) {
+	useTestRedis(t)
+	products := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/7" || r.URL.Query().Get("currency") != "EUR" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(Product{ID: 7, Price: money.Money{Amount: 480, Currency: "EUR"}})
+	}))
+	defer products.Close()
+	savedURL := productSvcURL
+	productSvcURL = products.URL
+	defer func() { productSvcURL = savedURL }()
+
+	putCartLine(t, "guest-abc", CartItem{ProductID: "7", Quantity: 2, Version: 1, Price: usd(500)})
+	rdb.Set(ctx, currencyKey("guest-abc"), "USD", 0)
+	rdb.Set(ctx, regionKey("guest-abc"), "DE", 0)
+	putCartLine(t, "42", CartItem{ProductID: "8", Quantity: 1, Version: 1, Price: money.Money{Amount: 900, Currency: "EUR"}})
+	rdb.Set(ctx, currencyKey("42"), "EUR", 0)
+
+	if err := mergeCarts("guest-abc", "42", MergeSum); err != nil {
+		t.Fatal(err)
+	}
+	cart, err := loadCart("42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart.Currency != "EUR" || cart.Region != "DE" || cart.ItemCount != 3 {
+		t.Errorf("merged cart %s in %s with %d items, want EUR, DE and 3", cart.Currency, cart.Region, cart.ItemCount)
+	}
+	if want := (money.Money{Amount: 1860, Currency: "EUR"}); cart.Subtotal != want {
+		t.Errorf("merged subtotal %v, want %v", cart.Subtotal, want)
+	}
+	if n, _ := rdb.Exists(ctx, cartKeys("guest-abc")...).Result(); n != 0 {
+		t.Errorf("%d guest cart keys left after merging", n)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"mallhive/shared/money"
+)
+
+// TaxTable is the format of TAX_RATES_FILE: percentage rates by region,
+// e.g. {"default": "0", "regions": {"US-CA": "7.25", "DE": 19}}. A region
+// such as "US-NY" falls back to its country "US", then to the default.
+type TaxTable struct {
+	Default json.Number            `json:"default"`
+	Regions map[string]json.Number `json:"regions"`
+}
+
+// ShippingRule prices shipping in one currency: Flat per order plus PerKg
+// for every started kilogram, waived once the discounted subtotal reaches
+// FreeOver. Amounts may be given as bare decimals.
+type ShippingRule struct {
+	Flat     money.Money  `json:"flat"`
+	PerKg    money.Money  `json:"per_kg"`
+	FreeOver *money.Money `json:"free_over"`
+}
+
+var (
+	// Upper-case region to rate as a fraction; "" holds the default
+	taxRates = map[string]*big.Rat{"": new(big.Rat)}
+	// Currency to shipping rule; currencies without one ship free
+	shippingRules = map[string]ShippingRule{}
+)
+
+// loadPricingRules reads TAX_RATES_FILE and SHIPPING_RULES_FILE, the latter
+// keyed by currency, e.g. {"USD": {"flat": "4.99", "free_over": "50"}}.
+// Without them carts are untaxed and ship free.
+func loadPricingRules() error {
+	if path := os.Getenv("TAX_RATES_FILE"); path != "" {
+		var t TaxTable
+		if err := readJSONFile(path, &t); err != nil {
+			return fmt.Errorf("tax rates: %w", err)
+		}
+		rates, err := parseTaxTable(t)
+		if err != nil {
+			return fmt.Errorf("tax rates: %w", err)
+		}
+		taxRates = rates
+	}
+	if path := os.Getenv("SHIPPING_RULES_FILE"); path != "" {
+		var rules map[string]ShippingRule
+		if err := readJSONFile(path, &rules); err != nil {
+			return fmt.Errorf("shipping rules: %w", err)
+		}
+		parsed, err := parseShippingRules(rules)
+		if err != nil {
+			return fmt.Errorf("shipping rules: %w", err)
+		}
+		shippingRules = parsed
+	}
+	return nil
+}
+
+func readJSONFile(path string, v any) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+func parseTaxTable(t TaxTable) (map[string]*big.Rat, error) {
+	rates := map[string]*big.Rat{}
+	parse := func(region string, n json.Number) error {
+		if n == "" {
+			n = "0"
+		}
+		percent, ok := new(big.Rat).SetString(n.String())
+		if !ok || percent.Sign() < 0 || percent.Cmp(big.NewRat(100, 1)) > 0 {
+			return fmt.Errorf("invalid rate %q for region %q", n, region)
+		}
+		rates[region] = percent.Quo(percent, big.NewRat(100, 1))
+		return nil
+	}
+	if err := parse("", t.Default); err != nil {
+		return nil, err
+	}
+	for region, n := range t.Regions {
+		if err := parse(normalizeRegion(region), n); err != nil {
+			return nil, err
+		}
+	}
+	return rates, nil
+}
+
+func parseShippingRules(rules map[string]ShippingRule) (map[string]ShippingRule, error) {
+	parsed := make(map[string]ShippingRule, len(rules))
+	for code, rule := range rules {
+		code = strings.ToUpper(code)
+		if !money.ValidCurrency(code) {
+			return nil, fmt.Errorf("%w: %q", money.ErrInvalidCurrency, code)
+		}
+		rule.Flat, rule.PerKg = rule.Flat.In(code), rule.PerKg.In(code)
+		amounts := []money.Money{rule.Flat, rule.PerKg}
+		if rule.FreeOver != nil {
+			free := rule.FreeOver.In(code)
+			rule.FreeOver = &free
+			amounts = append(amounts, free)
+		}
+		for _, m := range amounts {
+			if m.Currency != code || m.Amount < 0 {
+				return nil, fmt.Errorf("%s rule amounts must be non-negative %s", code, code)
+			}
+		}
+		parsed[code] = rule
+	}
+	return parsed, nil
+}
+
+func normalizeRegion(region string) string {
+	return strings.ToUpper(strings.TrimSpace(region))
+}
+
+// validRegion accepts codes such as "DE" or "US-CA".
+func validRegion(region string) bool {
+	if region == "" || len(region) > 16 {
+		return false
+	}
+	for _, r := range region {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// taxRate finds the rate for region: the region itself, then its country
+// (the part before "-"), then the default.
+func taxRate(region string) *big.Rat {
+	region = normalizeRegion(region)
+	if rate, ok := taxRates[region]; ok {
+		return rate
+	}
+	if country, _, found := strings.Cut(region, "-"); found {
+		if rate, ok := taxRates[country]; ok {
+			return rate
+		}
+	}
+	return taxRates[""]
+}
+
+// applyRate returns m times rate, rounded half away from zero to the minor
+// unit.
+func applyRate(m money.Money, rate *big.Rat) (money.Money, error) {
+	r := new(big.Rat).SetInt64(m.Amount)
+	r.Mul(r, rate)
+	q, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if rem.Abs(rem).Lsh(rem, 1).Cmp(r.Denom()) >= 0 {
+		if r.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	if !q.IsInt64() {
+		return m, money.ErrInvalidAmount
+	}
+	m.Amount = q.Int64()
+	return m, nil
+}
+
+// shippingCost applies the currency's shipping rule to a cart weighing
+// grams whose discounted subtotal is goods. Empty carts ship free.
+func shippingCost(goods money.Money, grams, items int) (money.Money, error) {
+	cost := money.Money{Currency: goods.Currency}
+	rule, ok := shippingRules[goods.Currency]
+	if !ok || items == 0 {
+		return cost, nil
+	}
+	if rule.FreeOver != nil && goods.Amount >= rule.FreeOver.Amount {
+		return cost, nil
+	}
+	kilos := (grams + 999) / 1000
+	weight, err := rule.PerKg.Mul(kilos)
+	if err != nil {
+		return cost, err
+	}
+	if cost, err = cost.Add(rule.Flat); err != nil {
+		return cost, err
+	}
+	return cost.Add(weight)
+}
+
+// priceCart fills in the line subtotals and the cart's summary: item
+// count, subtotal, coupon discounts, tax on the discounted goods in the
+// cart's region, shipping and the total the order service charges. Items
+// must already be in the cart's currency. The lines are first sorted by
+// line ID, the order coupons are taken off them in, so a cart read back
+// from Redis prices the same every time.
+func priceCart(cart *Cart) error {
+	sort.SliceStable(cart.Items, func(i, j int) bool { return cart.Items[i].ID < cart.Items[j].ID })
+	zero := money.Money{Currency: cart.Currency}
+	cart.ItemCount = 0
+	cart.Subtotal, cart.Discount, cart.Tax, cart.Shipping = zero, zero, zero, zero
+	grams := 0
+	for i := range cart.Items {
+		item := &cart.Items[i]
+		line, err := item.Price.Mul(item.Quantity)
+		if err != nil {
+			return err
+		}
+		item.LineSubtotal = &line
+		if cart.Subtotal, err = cart.Subtotal.Add(line); err != nil {
+			return err
+		}
+		cart.ItemCount += item.Quantity
+		grams += item.WeightGrams * item.Quantity
+	}
+
+	freeShipping, err := applyCoupons(cart, cart.coupons, time.Now())
+	if err != nil {
+		return err
+	}
+	goods, err := cart.Subtotal.Sub(cart.Discount)
+	if err != nil {
+		return err
+	}
+	rate := taxRate(cart.Region)
+	percent := new(big.Rat).Mul(rate, big.NewRat(100, 1)).FloatString(4)
+	cart.TaxRate = strings.TrimSuffix(strings.TrimRight(percent, "0"), ".")
+	if cart.Tax, err = applyRate(goods, rate); err != nil {
+		return err
+	}
+	if cart.Shipping, err = shippingCost(goods, grams, cart.ItemCount); err != nil {
+		return err
+	}
+	if freeShipping {
+		cart.Shipping = zero
+	}
+	if cart.Total, err = goods.Add(cart.Tax); err != nil {
+		return err
+	}
+	cart.Total, err = cart.Total.Add(cart.Shipping)
+	return err
+}
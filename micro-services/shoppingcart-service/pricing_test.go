@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"mallhive/shared/money"
+)
+
+func usd(cents int64) money.Money {
+	return money.Money{Amount: cents, Currency: "USD"}
+}
+
+// useTaxTable installs the rates in table for the test.
+func useTaxTable(t *testing.T, table string) {
+	t.Helper()
+	var tt TaxTable
+	if err := json.Unmarshal([]byte(table), &tt); err != nil {
+		t.Fatal(err)
+	}
+	rates, err := parseTaxTable(tt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := taxRates
+	taxRates = rates
+	t.Cleanup(func() { taxRates = saved })
+}
+
+// useShippingRules installs the rules in doc for the test.
+func useShippingRules(t *testing.T, doc string) {
+	t.Helper()
+	var rules map[string]ShippingRule
+	if err := json.Unmarshal([]byte(doc), &rules); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseShippingRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := shippingRules
+	shippingRules = parsed
+	t.Cleanup(func() { shippingRules = saved })
+}
+
+func TestPriceCartLines(t *testing.T) {
+	tests := []struct {
+		items        []CartItem
+		wantLines    []int64
+		wantSubtotal int64
+		wantCount    int
+	}{
+		{nil, nil, 0, 0},
+		{[]CartItem{{Price: usd(1999), Quantity: 1}}, []int64{1999}, 1999, 1},
+		{[]CartItem{{Price: usd(1999), Quantity: 3}}, []int64{5997}, 5997, 3},
+		{[]CartItem{{Price: usd(1999), Quantity: 2}, {Price: usd(500), Quantity: 1}}, []int64{3998, 500}, 4498, 3},
+		{[]CartItem{{Price: usd(1), Quantity: 99}, {Price: usd(0), Quantity: 5}}, []int64{99, 0}, 99, 104},
+	}
+	for _, tt := range tests {
+		cart := Cart{Currency: "USD", Items: tt.items}
+		if err := priceCart(&cart); err != nil {
+			t.Errorf("priceCart(%v): %v", tt.items, err)
+			continue
+		}
+		for i, want := range tt.wantLines {
+			if got := cart.Items[i].LineSubtotal; got == nil || *got != usd(want) {
+				t.Errorf("line %d of %v = %v, want %v", i, tt.items, got, usd(want))
+			}
+		}
+		if cart.Subtotal != usd(tt.wantSubtotal) || cart.ItemCount != tt.wantCount {
+			t.Errorf("priceCart(%v) subtotal %v count %d, want %v count %d",
+				tt.items, cart.Subtotal, cart.ItemCount, usd(tt.wantSubtotal), tt.wantCount)
+		}
+		if cart.Total != cart.Subtotal {
+			t.Errorf("priceCart(%v) total %v, want the untaxed subtotal %v", tt.items, cart.Total, cart.Subtotal)
+		}
+	}
+}
+
+func TestPriceCartRejectsMixedCurrencies(t *testing.T) {
+	cart := Cart{Currency: "USD", Items: []CartItem{{Price: money.Money{Amount: 100, Currency: "EUR"}, Quantity: 1}}}
+	if err := priceCart(&cart); err == nil {
+		t.Error("priceCart with a EUR line in a USD cart succeeded, want error")
+	}
+}
+
+func TestTaxRate(t *testing.T) {
+	useTaxTable(t, `{"default": "2", "regions": {"US": "5", "us-ca": "7.25", "DE": 19}}`)
+	tests := []struct {
+		region string
+		want   string // percent
+	}{
+		{"US-CA", "7.25"},
+		{" us-ca ", "7.25"},
+		{"US-NY", "5"}, // falls back to the country
+		{"US", "5"},
+		{"DE", "19"},
+		{"DE-BY", "19"},
+		{"FR", "2"}, // falls back to the default
+		{"", "2"},
+	}
+	for _, tt := range tests {
+		got := new(big.Rat).Mul(taxRate(tt.region), big.NewRat(100, 1))
+		want, _ := new(big.Rat).SetString(tt.want)
+		if got.Cmp(want) != 0 {
+			t.Errorf("taxRate(%q) = %s%%, want %s%%", tt.region, got.FloatString(2), tt.want)
+		}
+	}
+}
+
+func TestApplyRate(t *testing.T) {
+	tests := []struct {
+		m       money.Money
+		percent string
+		want    int64
+	}{
+		{usd(1000), "7.25", 73}, // 72.5, half away from zero
+		{usd(999), "7.25", 72},  // 72.4275
+		{usd(4498), "7.25", 326},
+		{usd(4498), "19", 855}, // 854.62
+		{usd(1), "50", 1},
+		{usd(-1), "50", -1},
+		{usd(3), "50", 2}, // 1.5
+		{usd(1234), "0", 0},
+		{usd(1234), "100", 1234},
+		{money.Money{Amount: 333, Currency: "JPY"}, "10", 33},
+		{money.Money{Amount: 335, Currency: "JPY"}, "10", 34}, // 33.5
+	}
+	for _, tt := range tests {
+		rate, _ := new(big.Rat).SetString(tt.percent)
+		rate.Quo(rate, big.NewRat(100, 1))
+		got, err := applyRate(tt.m, rate)
+		if err != nil {
+			t.Errorf("applyRate(%v, %s%%): %v", tt.m, tt.percent, err)
+			continue
+		}
+		if got.Amount != tt.want || got.Currency != tt.m.Currency {
+			t.Errorf("applyRate(%v, %s%%) = %v, want %d %s", tt.m, tt.percent, got, tt.want, tt.m.Currency)
+		}
+	}
+}
+
+func TestPriceCartTax(t *testing.T) {
+	useTaxTable(t, `{"default": "0", "regions": {"US-CA": "7.25", "DE": "19", "JP": "10"}}`)
+	items := []CartItem{{Price: usd(1999), Quantity: 2}, {Price: usd(500), Quantity: 1}}
+	tests := []struct {
+		region    string
+		wantRate  string
+		wantTax   int64
+		wantTotal int64
+	}{
+		{"US-CA", "7.25", 326, 4824},
+		{"DE", "19", 855, 5353},
+		{"FR", "0", 0, 4498},
+		{"", "0", 0, 4498},
+	}
+	for _, tt := range tests {
+		cart := Cart{Currency: "USD", Region: tt.region, Items: append([]CartItem(nil), items...)}
+		if err := priceCart(&cart); err != nil {
+			t.Errorf("region %q: %v", tt.region, err)
+			continue
+		}
+		if cart.TaxRate != tt.wantRate || cart.Tax != usd(tt.wantTax) || cart.Total != usd(tt.wantTotal) {
+			t.Errorf("region %q: rate %s tax %v total %v, want rate %s tax %v total %v", tt.region,
+				cart.TaxRate, cart.Tax, cart.Total, tt.wantRate, usd(tt.wantTax), usd(tt.wantTotal))
+		}
+	}
+}
+
+func TestParseTaxTableRejects(t *testing.T) {
+	for _, table := range []TaxTable{
+		{Default: "-1"},
+		{Default: "101"},
+		{Default: "abc"},
+		{Regions: map[string]json.Number{"DE": "-0.5"}},
+	} {
+		if _, err := parseTaxTable(table); err == nil {
+			t.Errorf("parseTaxTable(%+v) succeeded, want error", table)
+		}
+	}
+}
+
+func TestShippingCost(t *testing.T) {
+	useShippingRules(t, `{"usd": {"flat": "4.99", "per_kg": "1", "free_over": "50"}, "JPY": {"flat": "500"}}`)
+	tests := []struct {
+		goods money.Money
+		grams int
+		items int
+		want  int64
+	}{
+		{usd(1000), 0, 1, 499}, // flat only
+		{usd(1000), 1, 1, 599}, // a started kilogram counts
+		{usd(1000), 1000, 1, 599},
+		{usd(1000), 1001, 2, 699},
+		{usd(1000), 12500, 3, 1799},
+		{usd(4999), 500, 1, 599}, // just under free_over
+		{usd(5000), 500, 1, 0},   // free from free_over on
+		{usd(9000), 20000, 1, 0},
+		{usd(0), 0, 0, 0},                                            // empty carts ship free
+		{money.Money{Amount: 1000, Currency: "EUR"}, 1000, 1, 0},     // no rule for EUR
+		{money.Money{Amount: 100000, Currency: "JPY"}, 5000, 1, 500}, // no free_over, no per_kg
+	}
+	for _, tt := range tests {
+		got, err := shippingCost(tt.goods, tt.grams, tt.items)
+		if err != nil {
+			t.Errorf("shippingCost(%v, %dg, %d items): %v", tt.goods, tt.grams, tt.items, err)
+			continue
+		}
+		if got.Amount != tt.want || got.Currency != tt.goods.Currency {
+			t.Errorf("shippingCost(%v, %dg, %d items) = %v, want %d %s",
+				tt.goods, tt.grams, tt.items, got, tt.want, tt.goods.Currency)
+		}
+	}
+}
+
+func TestPriceCartShipping(t *testing.T) {
+	useShippingRules(t, `{"USD": {"flat": "4.99", "per_kg": "1", "free_over": "50"}}`)
+	tests := []struct {
+		items        []CartItem
+		wantShipping int64
+		wantTotal    int64
+	}{
+		// 2 x 400g = 800g, one started kilogram
+		{[]CartItem{{Price: usd(1000), Quantity: 2, WeightGrams: 400}}, 599, 2599},
+		// 3 x 400g = 1200g, two started kilograms
+		{[]CartItem{{Price: usd(1000), Quantity: 3, WeightGrams: 400}}, 699, 3699},
+		// 50.00 of goods ships free whatever it weighs
+		{[]CartItem{{Price: usd(2500), Quantity: 2, WeightGrams: 30000}}, 0, 5000},
+	}
+	for _, tt := range tests {
+		cart := Cart{Currency: "USD", Items: tt.items}
+		if err := priceCart(&cart); err != nil {
+			t.Errorf("priceCart(%v): %v", tt.items, err)
+			continue
+		}
+		if cart.Shipping != usd(tt.wantShipping) || cart.Total != usd(tt.wantTotal) {
+			t.Errorf("priceCart(%v) shipping %v total %v, want %v and %v",
+				tt.items, cart.Shipping, cart.Total, usd(tt.wantShipping), usd(tt.wantTotal))
+		}
+	}
+}
+
+func TestPriceCartFreeShippingCoupon(t *testing.T) {
+	useShippingRules(t, `{"USD": {"flat": "4.99"}}`)
+	cart := Cart{
+		Currency: "USD",
+		Items:    []CartItem{{ProductID: "1", Price: usd(1000), Quantity: 1}},
+		coupons:  []Coupon{{Code: "SHIPFREE", Type: CouponFreeShipping, Active: true}},
+	}
+	if err := priceCart(&cart); err != nil {
+		t.Fatal(err)
+	}
+	if cart.Shipping != usd(0) || cart.Total != usd(1000) {
+		t.Errorf("shipping %v total %v, want 0.00 USD and 10.00 USD", cart.Shipping, cart.Total)
+	}
+}
+
+func TestParseShippingRulesRejects(t *testing.T) {
+	for _, doc := range []string{
+		`{"usdollar": {"flat": "1"}}`,
+		`{"USD": {"flat": "-1"}}`,
+		`{"USD": {"flat": {"amount": "1", "currency": "EUR"}}}`,
+		`{"USD": {"free_over": "-5"}}`,
+	} {
+		var rules map[string]ShippingRule
+		if err := json.Unmarshal([]byte(doc), &rules); err != nil {
+			continue // rejected while decoding
+		}
+		if _, err := parseShippingRules(rules); err == nil {
+			t.Errorf("parseShippingRules(%s) succeeded, want error", doc)
+		}
+	}
+}
@@ -70,8 +70,8 @@ async function loadRelatedProducts(productId) {
 function updateProductUI(product) {
   document.title = `${product.name} | Mallhive`;
   document.getElementById('productTitle').textContent = product.name;
-  document.getElementById('productPrice').textContent = `$${product.price.toLocaleString()}`;
-  document.getElementById('originalPrice').textContent = product.originalPrice ? `$${product.originalPrice.toLocaleString()}` : '';
+  document.getElementById('productPrice').textContent = formatMoney(product.effective_price || product.price);
+  document.getElementById('originalPrice').textContent = product.was_price ? formatMoney(product.was_price) : '';
   document.getElementById('discountPercentage').textContent = product.discountPercentage ? `-${product.discountPercentage}%` : '';
 
   const mainImage = document.getElementById('mainProductImage');
@@ -101,11 +101,19 @@ function renderRelatedProducts(products) {
     <div class="related-product" onclick="navigateToProduct('${product.id}')">
       <img src="${product.thumbnail}">
       <p class="related-title">${product.name}</p>
-      <p class="related-price">$${product.price.toLocaleString()}</p>
+      <p class="related-price">${formatMoney(product.effective_price || product.price)}</p>
     </div>
   `).join('');
 }
 
+// Format a money object from the APIs, {amount, currency}, whose amount is
+// in the currency's minor unit: cents, or yen for JPY
+function formatMoney(money) {
+  const format = new Intl.NumberFormat(undefined, { style: 'currency', currency: money.currency });
+  const digits = format.resolvedOptions().maximumFractionDigits;
+  return format.format(money.amount / 10 ** digits);
+}
+
 // Event Listeners
 function setupEventListeners() {
   document.getElementById('addToCartBtn').addEventListener('click', () => {
@@ -40,7 +40,7 @@ function updateCartUI() {
       <img src="${product.image}" alt="${product.name}" class="cart-item-image" />
       <div class="cart-item-details">
         <p class="cart-item-name">${product.name}</p>
-        <p class="cart-item-price">$${product.price.toLocaleString()}</p>
+        <p class="cart-item-price">${formatMoney(product.price)}</p>
         <p class="cart-item-quantity">Quantity: ${product.quantity}</p>
         <button class="remove-from-cart" data-product-id="${productId}">Remove</button>
       </div>
@@ -53,6 +53,14 @@ function updateCartUI() {
   window.dispatchEvent(new CustomEvent(CART_EVENTS.CART_UPDATED, { detail: currentCart }));
 }
 
+// Format a money object from the APIs, {amount, currency}, whose amount is
+// in the currency's minor unit: cents, or yen for JPY
+function formatMoney(money) {
+  const format = new Intl.NumberFormat(undefined, { style: 'currency', currency: money.currency });
+  const digits = format.resolvedOptions().maximumFractionDigits;
+  return format.format(money.amount / 10 ** digits);
+}
+
 // Event Listeners
 function setupEventListeners() {
   document.getElementById('checkoutBtn').addEventListener('click', () => {